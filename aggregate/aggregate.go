@@ -0,0 +1,160 @@
+package aggregate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/align"
+	"github.com/jianvhen/query/model"
+)
+
+// Param /graph/history 的聚合参数, 定义在model包中, 客户端不依赖本包
+type Param = model.AggregateParam
+
+// Check 检查聚合参数
+func Check(param *Param) error {
+	if _, err := Reducer(param.Fn); err != nil {
+		return err
+	}
+
+	switch {
+	case param.GroupBy == "", param.GroupBy == "endpoint", param.GroupBy == "counter":
+	case strings.HasPrefix(param.GroupBy, "tag:") && len(param.GroupBy) > len("tag:"):
+	default:
+		return fmt.Errorf("invalid group_by: %s", param.GroupBy)
+	}
+
+	if param.AlignStep < 0 {
+		return errors.New("invalid align_step")
+	}
+	return align.CheckFill(param.Fill)
+}
+
+// Aggregate 按param对齐并聚合多条曲线, 每个分组返回一条曲线, 按分组名排序
+// cf用于对齐时的降采样; 同一时间点上为NaN的值不参与计算, 全部为NaN时结果为NaN
+func Aggregate(param *Param, cf string, series []*cmodel.GraphQueryResponse, start, end int64) ([]*cmodel.GraphQueryResponse, error) {
+	reduce, err := Reducer(param.Fn)
+	if err != nil {
+		return nil, err
+	}
+
+	aligned := align.Align(series, start, end, int64(param.AlignStep), cf, param.Fill)
+
+	groups := make(map[string][]int)
+	for i, s := range aligned.Series {
+		key := groupKey(param.GroupBy, s)
+		groups[key] = append(groups[key], i)
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	ret := make([]*cmodel.GraphQueryResponse, 0, len(groups))
+	for _, key := range keys {
+		idxs := groups[key]
+		members := make([]*cmodel.GraphQueryResponse, 0, len(idxs))
+		for _, i := range idxs {
+			members = append(members, aligned.Series[i])
+		}
+
+		values := make([]*cmodel.RRDData, 0, len(aligned.Timestamps))
+		column := make([]float64, 0, len(idxs))
+		for j, ts := range aligned.Timestamps {
+			column = column[:0]
+			for _, i := range idxs {
+				column = append(column, aligned.Values[i][j])
+			}
+			values = append(values, &cmodel.RRDData{
+				Timestamp: ts,
+				Value:     cmodel.JsonFloat(reduce(column)),
+			})
+		}
+
+		ret = append(ret, &cmodel.GraphQueryResponse{
+			Endpoint: commonEndpoint(members),
+			Counter:  fmt.Sprintf("%s(%s)", param.Fn, groupLabel(param.GroupBy, key, members)),
+			DsType:   members[0].DsType,
+			Step:     int(aligned.Step),
+			Values:   values,
+		})
+	}
+
+	return ret, nil
+}
+
+func groupKey(groupBy string, s *cmodel.GraphQueryResponse) string {
+	switch {
+	case groupBy == "endpoint":
+		return s.Endpoint
+	case groupBy == "counter":
+		return s.Counter
+	case strings.HasPrefix(groupBy, "tag:"):
+		return Tags(s.Counter)[strings.TrimPrefix(groupBy, "tag:")]
+	}
+	return ""
+}
+
+func groupLabel(groupBy, key string, members []*cmodel.GraphQueryResponse) string {
+	if strings.HasPrefix(groupBy, "tag:") {
+		return fmt.Sprintf("%s/%s=%s", commonMetric(members), strings.TrimPrefix(groupBy, "tag:"), key)
+	}
+
+	counter := members[0].Counter
+	for _, s := range members {
+		if s.Counter != counter {
+			return commonMetric(members)
+		}
+	}
+	return counter
+}
+
+func commonEndpoint(members []*cmodel.GraphQueryResponse) string {
+	endpoint := members[0].Endpoint
+	for _, s := range members {
+		if s.Endpoint != endpoint {
+			return "*"
+		}
+	}
+	return endpoint
+}
+
+func commonMetric(members []*cmodel.GraphQueryResponse) string {
+	metric := Metric(members[0].Counter)
+	for _, s := range members {
+		if Metric(s.Counter) != metric {
+			return "*"
+		}
+	}
+	return metric
+}
+
+// Metric 返回counter中的metric部分, 如 net.if.in.bytes/iface=eth0 -> net.if.in.bytes
+func Metric(counter string) string {
+	if i := strings.Index(counter, "/"); i >= 0 {
+		return counter[:i]
+	}
+	return counter
+}
+
+// Tags 解析counter中的tags, 如 net.if.in.bytes/iface=eth0 -> {"iface": "eth0"}
+func Tags(counter string) map[string]string {
+	tags := make(map[string]string)
+	i := strings.Index(counter, "/")
+	if i < 0 {
+		return tags
+	}
+	for _, pair := range strings.Split(counter[i+1:], ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 {
+			tags[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return tags
+}
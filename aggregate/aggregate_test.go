@@ -0,0 +1,75 @@
+package aggregate
+
+import (
+	"math"
+	"testing"
+
+	cmodel "github.com/open-falcon/common/model"
+)
+
+func series(endpoint, counter string, values ...float64) *cmodel.GraphQueryResponse {
+	s := &cmodel.GraphQueryResponse{Endpoint: endpoint, Counter: counter, DsType: "GAUGE", Step: 60}
+	for i, v := range values {
+		s.Values = append(s.Values, &cmodel.RRDData{Timestamp: int64(60 * i), Value: cmodel.JsonFloat(v)})
+	}
+	return s
+}
+
+func TestAggregate(t *testing.T) {
+	nan := math.NaN()
+	in := []*cmodel.GraphQueryResponse{
+		series("host01", "net.if.in.bytes/iface=eth0", 1, nan, 3),
+		series("host02", "net.if.in.bytes/iface=eth0", 2, nan, nan),
+		series("host01", "net.if.in.bytes/iface=eth1", 10, 20, 30),
+	}
+
+	ret, err := Aggregate(&Param{Fn: "sum", GroupBy: "tag:iface"}, "AVERAGE", in, 0, 120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret) != 2 {
+		t.Fatalf("expected 2 groups, got %d", len(ret))
+	}
+	if ret[0].Counter != "sum(net.if.in.bytes/iface=eth0)" || ret[0].Endpoint != "*" {
+		t.Fatalf("unexpected group: %s %s", ret[0].Endpoint, ret[0].Counter)
+	}
+	if ret[1].Counter != "sum(net.if.in.bytes/iface=eth1)" || ret[1].Endpoint != "host01" {
+		t.Fatalf("unexpected group: %s %s", ret[1].Endpoint, ret[1].Counter)
+	}
+
+	// 同一时间点上全部为NaN时结果为NaN, 部分为NaN时只计算有效值
+	got := ret[0].Values
+	if len(got) != 3 || float64(got[0].Value) != 3 || !math.IsNaN(float64(got[1].Value)) || float64(got[2].Value) != 3 {
+		t.Fatalf("unexpected values: %v", got)
+	}
+}
+
+func TestParamCheck(t *testing.T) {
+	cases := []struct {
+		param Param
+		ok    bool
+	}{
+		{Param{Fn: "avg"}, true},
+		{Param{Fn: "p95", GroupBy: "endpoint", Fill: "linear"}, true},
+		{Param{Fn: "avg", GroupBy: "tag:"}, false},
+		{Param{Fn: "avg", GroupBy: "host"}, false},
+		{Param{Fn: "avg", AlignStep: -1}, false},
+		{Param{Fn: "avg", Fill: "zero"}, false},
+		{Param{Fn: "mean"}, false},
+	}
+	for _, c := range cases {
+		if err := Check(&c.param); (err == nil) != c.ok {
+			t.Errorf("%+v: expected ok=%v, got %v", c.param, c.ok, err)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	tags := Tags("net.if.in.bytes/iface=eth0, host = a")
+	if len(tags) != 2 || tags["iface"] != "eth0" || tags["host"] != "a" {
+		t.Fatalf("unexpected tags: %v", tags)
+	}
+	if Metric("net.if.in.bytes/iface=eth0") != "net.if.in.bytes" || Metric("cpu.idle") != "cpu.idle" {
+		t.Fatal("unexpected metric")
+	}
+}
@@ -0,0 +1,125 @@
+package aggregate
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ReduceFunc 把一组值归约为一个值, NaN不参与计算; 没有有效值时返回NaN
+type ReduceFunc func(values []float64) float64
+
+// Reducer 根据函数名返回对应的ReduceFunc: sum, avg, max, min, count, pNN(百分位, 如p95、p99.9)
+func Reducer(fn string) (ReduceFunc, error) {
+	switch fn {
+	case "sum":
+		return Sum, nil
+	case "avg":
+		return Avg, nil
+	case "max":
+		return Max, nil
+	case "min":
+		return Min, nil
+	case "count":
+		return Count, nil
+	}
+
+	if strings.HasPrefix(fn, "p") {
+		p, err := strconv.ParseFloat(fn[1:], 64)
+		if err == nil && p >= 0 && p <= 100 {
+			return func(values []float64) float64 { return Percentile(values, p) }, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid aggregate fn: %s", fn)
+}
+
+func Sum(values []float64) float64 {
+	sum, cnt := 0.0, 0
+	for _, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		sum += v
+		cnt++
+	}
+	if cnt == 0 {
+		return math.NaN()
+	}
+	return sum
+}
+
+func Avg(values []float64) float64 {
+	sum, cnt := 0.0, 0
+	for _, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		sum += v
+		cnt++
+	}
+	if cnt == 0 {
+		return math.NaN()
+	}
+	return sum / float64(cnt)
+}
+
+func Max(values []float64) float64 {
+	ret := math.NaN()
+	for _, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		if math.IsNaN(ret) || v > ret {
+			ret = v
+		}
+	}
+	return ret
+}
+
+func Min(values []float64) float64 {
+	ret := math.NaN()
+	for _, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		if math.IsNaN(ret) || v < ret {
+			ret = v
+		}
+	}
+	return ret
+}
+
+// Count 返回有效值的个数
+func Count(values []float64) float64 {
+	cnt := 0
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			cnt++
+		}
+	}
+	return float64(cnt)
+}
+
+// Percentile 返回第p百分位的值, 在相邻的两个值之间线性插值
+func Percentile(values []float64, p float64) float64 {
+	sorted := make([]float64, 0, len(values))
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			sorted = append(sorted, v)
+		}
+	}
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	sort.Float64s(sorted)
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	if lo == hi {
+		return sorted[lo]
+	}
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
@@ -0,0 +1,58 @@
+package aggregate
+
+import (
+	"math"
+	"testing"
+)
+
+func TestReducers(t *testing.T) {
+	nan := math.NaN()
+	values := []float64{4, nan, 1, 3, nan, 2}
+
+	cases := []struct {
+		fn       string
+		expected float64
+	}{
+		{"sum", 10},
+		{"avg", 2.5},
+		{"max", 4},
+		{"min", 1},
+		{"count", 4},
+		{"p0", 1},
+		{"p50", 2.5},
+		{"p100", 4},
+		{"p99.9", 3.997},
+	}
+	for _, c := range cases {
+		reduce, err := Reducer(c.fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := reduce(values); math.Abs(got-c.expected) > 1e-9 {
+			t.Errorf("%s: expected %v, got %v", c.fn, c.expected, got)
+		}
+
+		// 全部为NaN时, 除count外结果为NaN
+		got := reduce([]float64{nan, nan})
+		if c.fn == "count" {
+			if got != 0 {
+				t.Errorf("count of NaNs: expected 0, got %v", got)
+			}
+		} else if !math.IsNaN(got) {
+			t.Errorf("%s of NaNs: expected NaN, got %v", c.fn, got)
+		}
+	}
+
+	// max、min的第一个值为NaN时不影响比较
+	if Max([]float64{nan, -1, -2}) != -1 || Min([]float64{nan, 2, 1}) != 1 {
+		t.Fatal("max/min should skip a leading NaN")
+	}
+}
+
+func TestReducerInvalid(t *testing.T) {
+	for _, fn := range []string{"", "median", "p", "p101", "p-1", "pxx"} {
+		if _, err := Reducer(fn); err == nil {
+			t.Errorf("%q: expected error", fn)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package align
+
+import (
+	"fmt"
+	"math"
+
+	cmodel "github.com/open-falcon/common/model"
+)
+
+// 缺失数据点的填充方式
+const (
+	FillNull     = "null"     // 保留为NaN
+	FillPrevious = "previous" // 取前一个有效值
+	FillLinear   = "linear"   // 在前后两个有效值之间线性插值
+)
+
+const defaultStep = 60
+
+// MaxPoints 对齐后每条曲线最多的点数; step由调用方指定, 点数超过时按StepFor增大step
+const MaxPoints = 43200
+
+// Result 对齐后的多条曲线, Values[i]与Series[i]对应, Values[i][j]为Series[i]在Timestamps[j]上的值
+type Result struct {
+	Step       int64
+	Timestamps []int64
+	Series     []*cmodel.GraphQueryResponse
+	Values     [][]float64
+}
+
+func CheckFill(fill string) error {
+	switch fill {
+	case "", FillNull, FillPrevious, FillLinear:
+		return nil
+	}
+	return fmt.Errorf("invalid fill: %s", fill)
+}
+
+// CommonStep 返回多条曲线的公共步长, 即各曲线step中的最大值
+func CommonStep(series []*cmodel.GraphQueryResponse) int64 {
+	var step int64
+	for _, s := range series {
+		if s != nil && int64(s.Step) > step {
+			step = int64(s.Step)
+		}
+	}
+	if step <= 0 {
+		step = defaultStep
+	}
+	return step
+}
+
+// StepFor 返回不超过maxPoints个点时[start, end]所需的最小步长, 且为minStep的整数倍
+func StepFor(start, end, minStep int64, maxPoints int) int64 {
+	if minStep <= 0 {
+		minStep = defaultStep
+	}
+	if maxPoints <= 0 || end <= start {
+		return minStep
+	}
+	n := (end-start)/minStep + 1
+	if n <= int64(maxPoints) {
+		return minStep
+	}
+	mult := (n + int64(maxPoints) - 1) / int64(maxPoints)
+	return minStep * mult
+}
+
+// Align 把多条曲线对齐到 [start, end] 之间、以step为间隔的相同时间点上;
+// step<=0时使用CommonStep, 点数超过MaxPoints时step增大为其整数倍, 实际的step见Result.Step. 同一个步长内有多个数据点时(降采样), 按cf做归约:
+// AVERAGE取平均值, MAX取最大值, MIN取最小值; 没有数据的时间点按fill填充
+func Align(series []*cmodel.GraphQueryResponse, start, end, step int64, cf, fill string) *Result {
+	if step <= 0 {
+		step = CommonStep(series)
+	}
+	// start向下对齐到step时可能多出一个点
+	step = StepFor(start, end, step, MaxPoints-1)
+
+	first := start - start%step
+	n := 0
+	if end >= first {
+		n = int((end-first)/step) + 1
+	}
+
+	ret := &Result{Step: step, Timestamps: make([]int64, n)}
+	for i := range ret.Timestamps {
+		ret.Timestamps[i] = first + int64(i)*step
+	}
+	for _, s := range series {
+		if s == nil {
+			continue
+		}
+		ret.Series = append(ret.Series, s)
+		ret.Values = append(ret.Values, Fill(Rollup(s.Values, first, step, n, cf), fill))
+	}
+	return ret
+}
+
+// Rollup 把数据点归约到 first + i*step (0<=i<n) 上, 每个点覆盖[first+i*step, first+(i+1)*step);
+// 没有数据的点为NaN
+func Rollup(values []*cmodel.RRDData, first, step int64, n int, cf string) []float64 {
+	ret := make([]float64, n)
+	cnts := make([]int, n)
+	for i := range ret {
+		ret[i] = math.NaN()
+	}
+
+	for _, v := range values {
+		if v == nil || math.IsNaN(float64(v.Value)) || v.Timestamp < first {
+			continue
+		}
+		i := int((v.Timestamp - first) / step)
+		if i >= n {
+			continue
+		}
+
+		val := float64(v.Value)
+		if cnts[i] == 0 {
+			ret[i] = val
+		} else {
+			switch cf {
+			case "MAX":
+				ret[i] = math.Max(ret[i], val)
+			case "MIN":
+				ret[i] = math.Min(ret[i], val)
+			default:
+				ret[i] += val
+			}
+		}
+		cnts[i]++
+	}
+
+	if cf != "MAX" && cf != "MIN" {
+		for i := range ret {
+			if cnts[i] > 1 {
+				ret[i] /= float64(cnts[i])
+			}
+		}
+	}
+	return ret
+}
+
+// Fill 按fill填充values中的NaN, 直接修改并返回values
+func Fill(values []float64, fill string) []float64 {
+	switch fill {
+	case FillPrevious:
+		prev := math.NaN()
+		for i, v := range values {
+			if math.IsNaN(v) {
+				values[i] = prev
+			} else {
+				prev = v
+			}
+		}
+	case FillLinear:
+		last := -1
+		for i, v := range values {
+			if math.IsNaN(v) {
+				continue
+			}
+			if last >= 0 && i-last > 1 {
+				delta := (v - values[last]) / float64(i-last)
+				for j := last + 1; j < i; j++ {
+					values[j] = values[last] + delta*float64(j-last)
+				}
+			}
+			last = i
+		}
+	}
+	return values
+}
@@ -0,0 +1,118 @@
+package align
+
+import (
+	"math"
+	"testing"
+
+	cmodel "github.com/open-falcon/common/model"
+)
+
+func points(values ...float64) []*cmodel.RRDData {
+	ret := make([]*cmodel.RRDData, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		ret = append(ret, &cmodel.RRDData{Timestamp: int64(values[i]), Value: cmodel.JsonFloat(values[i+1])})
+	}
+	return ret
+}
+
+func equal(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.IsNaN(a[i]) != math.IsNaN(b[i]) || (!math.IsNaN(a[i]) && math.Abs(a[i]-b[i]) > 1e-9) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRollup(t *testing.T) {
+	nan := math.NaN()
+	// 步长120: [0,120)有60、90两个点, [120,240)的点为NaN, [240,360)有一个点; 早于first和超出n的点被忽略
+	values := points(-60, 100, 60, 1, 90, 3, 150, nan, 300, 5, 360, 100)
+	cases := map[string][]float64{
+		"AVERAGE": {2, nan, 5},
+		"MAX":     {3, nan, 5},
+		"MIN":     {1, nan, 5},
+	}
+	for cf, expected := range cases {
+		if got := Rollup(values, 0, 120, 3, cf); !equal(got, expected) {
+			t.Errorf("%s: expected %v, got %v", cf, expected, got)
+		}
+	}
+}
+
+func TestFill(t *testing.T) {
+	nan := math.NaN()
+	cases := []struct {
+		fill     string
+		expected []float64
+	}{
+		{FillNull, []float64{nan, 1, nan, nan, 4, nan}},
+		{FillPrevious, []float64{nan, 1, 1, 1, 4, 4}},
+		{FillLinear, []float64{nan, 1, 2, 3, 4, nan}},
+	}
+	for _, c := range cases {
+		got := Fill([]float64{nan, 1, nan, nan, 4, nan}, c.fill)
+		if !equal(got, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.fill, c.expected, got)
+		}
+	}
+}
+
+func TestAlign(t *testing.T) {
+	series := []*cmodel.GraphQueryResponse{
+		{Endpoint: "host01", Counter: "cpu.idle", Step: 60, Values: points(0, 1, 60, 2, 120, 3, 180, 4)},
+		nil,
+		{Endpoint: "host02", Counter: "cpu.idle", Step: 120, Values: points(0, 10, 120, 30)},
+	}
+
+	// step为0时取各曲线中最大的step, start向下对齐到step
+	ret := Align(series, 30, 200, 0, "AVERAGE", FillNull)
+	if ret.Step != 120 || len(ret.Timestamps) != 2 || ret.Timestamps[0] != 0 || ret.Timestamps[1] != 120 {
+		t.Fatalf("unexpected timestamps: %d %v", ret.Step, ret.Timestamps)
+	}
+	if len(ret.Series) != 2 || !equal(ret.Values[0], []float64{1.5, 3.5}) || !equal(ret.Values[1], []float64{10, 30}) {
+		t.Fatalf("unexpected values: %v", ret.Values)
+	}
+
+	if ret := Align(series, 200, 100, 60, "AVERAGE", ""); len(ret.Timestamps) != 0 || len(ret.Values[0]) != 0 {
+		t.Fatalf("expected no points when end < start, got %v", ret.Timestamps)
+	}
+}
+
+func TestAlignMaxPoints(t *testing.T) {
+	// 一年的范围步长为1秒时点数远超MaxPoints, step增大为1的整数倍
+	start, end := int64(59), int64(365*86400)
+	ret := Align(nil, start, end, 1, "AVERAGE", "")
+	if len(ret.Timestamps) > MaxPoints {
+		t.Fatalf("expected at most %d points, got %d", MaxPoints, len(ret.Timestamps))
+	}
+	if ret.Step <= 1 {
+		t.Fatalf("unexpected step: %d", ret.Step)
+	}
+
+	// 点数不超过MaxPoints时保持指定的step
+	if ret := Align(nil, 0, 86400, 60, "AVERAGE", ""); ret.Step != 60 || len(ret.Timestamps) != 1441 {
+		t.Fatalf("unexpected result: %d %d", ret.Step, len(ret.Timestamps))
+	}
+}
+
+func TestStepFor(t *testing.T) {
+	cases := []struct {
+		start, end, minStep int64
+		maxPoints           int
+		expected            int64
+	}{
+		{0, 3600, 60, 100, 60},
+		{0, 86400, 60, 100, 900},
+		{0, 86400, 0, 0, 60},
+		{100, 0, 60, 10, 60},
+	}
+	for _, c := range cases {
+		if got := StepFor(c.start, c.end, c.minStep, c.maxPoints); got != c.expected {
+			t.Errorf("StepFor(%d, %d, %d, %d): expected %d, got %d", c.start, c.end, c.minStep, c.maxPoints, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Package auth 认证http请求的调用方, 并按调用方的规则限制可以访问的路由和可以读取的endpoint.
+// 支持三种认证方式:
+//
+//	Authorization: Bearer <token>                      静态token, 见auth.tokens
+//	X-Auth-Key、X-Auth-Timestamp、X-Auth-Signature     hmac签名, 见Sign和auth.hmacKeys
+//	Authorization: Basic <base64(user:password)>       htpasswd文件中的用户, 见auth.htpasswd
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jianvhen/query/g"
+	"github.com/jianvhen/query/htpasswd"
+	"github.com/jianvhen/query/pattern"
+)
+
+// 认证方式
+const (
+	MethodToken = "token"
+	MethodHmac  = "hmac"
+	MethodBasic = "basic"
+)
+
+const defaultHmacMaxSkew = 300
+
+var (
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// ForbiddenError 调用方不能读取endpoint
+type ForbiddenError struct {
+	Principal string
+	Endpoint  string
+}
+
+func (this *ForbiddenError) Error() string {
+	return fmt.Sprintf("forbidden, %s can not read endpoint %s", this.Principal, this.Endpoint)
+}
+
+// Principal 通过认证的调用方
+type Principal struct {
+	Name   string
+	Method string
+
+	routes    []string
+	endpoints []*regexp.Regexp
+}
+
+func newPrincipal(p *g.AuthPrincipal, method string) (*Principal, error) {
+	ret := &Principal{Name: p.Name, Method: method, routes: p.Routes}
+	for _, endpoint := range p.Endpoints {
+		re, err := pattern.Compile(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("bad endpoint pattern %s of %s: %v", endpoint, p.Name, err)
+		}
+		ret.endpoints = append(ret.endpoints, re)
+	}
+	return ret, nil
+}
+
+// AllowRoute 调用方能否访问path; 没有配置routes时不限制
+func (this *Principal) AllowRoute(path string) bool {
+	if len(this.routes) == 0 {
+		return true
+	}
+	return matchRoutes(this.routes, path)
+}
+
+// RestrictsEndpoints 调用方是否只能读取部分endpoint
+func (this *Principal) RestrictsEndpoints() bool {
+	return len(this.endpoints) > 0
+}
+
+// AllowEndpoint 调用方能否读取endpoint; 没有配置endpoints时不限制
+func (this *Principal) AllowEndpoint(endpoint string) bool {
+	if len(this.endpoints) == 0 {
+		return true
+	}
+	for _, re := range this.endpoints {
+		if re.MatchString(endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRoutes 与http.ServeMux的规则相同: 以/结尾的路由匹配其下的所有路径, 否则完全匹配
+func matchRoutes(routes []string, path string) bool {
+	for _, route := range routes {
+		if strings.HasSuffix(route, "/") && strings.HasPrefix(path, route) || path == route {
+			return true
+		}
+	}
+	return false
+}
+
+type ctxKey struct{}
+
+// NewContext 返回带有调用方的context, service查询graph时据此检查endpoint
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, ctxKey{}, p)
+}
+
+// FromContext 返回context中的调用方, 没有时返回nil
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(ctxKey{}).(*Principal)
+	return p
+}
+
+// Authorize 检查context中的调用方能否读取endpoint, 不能读取时返回*ForbiddenError;
+// context中没有调用方时(没有开启认证, 或作为库使用)不限制
+func Authorize(ctx context.Context, endpoint string) error {
+	p := FromContext(ctx)
+	if p == nil || p.AllowEndpoint(endpoint) {
+		return nil
+	}
+	return &ForbiddenError{Principal: p.Name, Endpoint: endpoint}
+}
+
+type credential struct {
+	secret    string
+	principal *Principal
+}
+
+// Authenticator 按auth配置认证请求
+type Authenticator struct {
+	public   []string
+	tokens   []*credential
+	hmacKeys map[string]*credential
+	maxSkew  int64
+	htpasswd map[string]string
+	users    map[string]*Principal
+}
+
+// New 按配置构建Authenticator, 并读取htpasswd文件
+func New(cfg *g.AuthConfig) (*Authenticator, error) {
+	this := &Authenticator{
+		public:   cfg.Public,
+		hmacKeys: make(map[string]*credential),
+		maxSkew:  int64(cfg.HmacMaxSkew),
+		users:    make(map[string]*Principal),
+	}
+	if this.public == nil {
+		this.public = []string{"/health"}
+	}
+	if this.maxSkew <= 0 {
+		this.maxSkew = defaultHmacMaxSkew
+	}
+
+	for _, t := range cfg.Tokens {
+		p, err := newPrincipal(t, MethodToken)
+		if err != nil {
+			return nil, err
+		}
+		this.tokens = append(this.tokens, &credential{secret: t.Secret, principal: p})
+	}
+	for _, k := range cfg.HmacKeys {
+		p, err := newPrincipal(k, MethodHmac)
+		if err != nil {
+			return nil, err
+		}
+		this.hmacKeys[k.Name] = &credential{secret: k.Secret, principal: p}
+	}
+
+	if cfg.Htpasswd != "" {
+		users, err := htpasswd.Load(cfg.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		this.htpasswd = users
+	}
+	for _, u := range cfg.Users {
+		p, err := newPrincipal(u, MethodBasic)
+		if err != nil {
+			return nil, err
+		}
+		this.users[u.Name] = p
+	}
+	return this, nil
+}
+
+// Public 访问path是否不需要认证
+func (this *Authenticator) Public(path string) bool {
+	return matchRoutes(this.public, path)
+}
+
+// Basic 是否支持htpasswd用户的basic认证
+func (this *Authenticator) Basic() bool {
+	return this.htpasswd != nil
+}
+
+// Authenticate 按请求中的凭证认证调用方; 没有凭证时返回ErrNoCredentials, 凭证不正确时返回ErrInvalidCredentials或具体的原因.
+// hmac签名需要读取请求的body, 读取后放回, 不影响后续的处理
+func (this *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if r.Header.Get(HeaderSignature) != "" {
+		return this.authHmac(r)
+	}
+
+	header := r.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(header, "Bearer "):
+		token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		for _, t := range this.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t.secret)) == 1 {
+				return t.principal, nil
+			}
+		}
+		return nil, ErrInvalidCredentials
+	case strings.HasPrefix(header, "Basic "):
+		user, password, ok := r.BasicAuth()
+		if !ok || this.htpasswd == nil {
+			return nil, ErrInvalidCredentials
+		}
+		hash, found := this.htpasswd[user]
+		if !found || !htpasswd.Check(hash, password) {
+			return nil, ErrInvalidCredentials
+		}
+		if p, found := this.users[user]; found {
+			return p, nil
+		}
+		return &Principal{Name: user, Method: MethodBasic}, nil
+	}
+	return nil, ErrNoCredentials
+}
+
+var (
+	current    *Authenticator
+	currentCfg *g.AuthConfig
+	currentErr error
+	lock       = new(sync.Mutex)
+)
+
+// Current 返回当前配置对应的Authenticator, 热加载配置后重新构建; 没有开启认证时返回nil
+func Current() (*Authenticator, error) {
+	cfg := g.Config().Auth
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if cfg != currentCfg {
+		current, currentErr = New(cfg)
+		currentCfg = cfg
+		if currentErr != nil {
+			log.Printf("auth.New fail, all requests will be rejected, %v", currentErr)
+		}
+	}
+	return current, currentErr
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jianvhen/query/g"
+)
+
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	authn, err := New(&g.AuthConfig{
+		Enabled: true,
+		Tokens: []*g.AuthPrincipal{
+			{Name: "ops", Secret: "ops-token"},
+			{Name: "team-a", Secret: "team-a-token", Routes: []string{"/graph/", "/api/info"}, Endpoints: []string{"web-*", "/^db\\d+$/"}},
+		},
+		HmacKeys: []*g.AuthPrincipal{{Name: "ci", Secret: "ci-secret"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authn
+}
+
+func TestPrincipal(t *testing.T) {
+	authn := newTestAuthenticator(t)
+	ops, teamA := authn.tokens[0].principal, authn.tokens[1].principal
+
+	if ops.RestrictsEndpoints() || !ops.AllowRoute("/config") || !ops.AllowEndpoint("host01") {
+		t.Fatalf("unrestricted principal is restricted: %+v", ops)
+	}
+	if !teamA.RestrictsEndpoints() {
+		t.Fatalf("expected restricted principal: %+v", teamA)
+	}
+
+	routes := map[string]bool{
+		"/graph/history": true, "/graph/": true, "/api/info": true,
+		"/graph": false, "/api/info/one": false, "/api/history": false, "/config": false,
+	}
+	for route, expected := range routes {
+		if got := teamA.AllowRoute(route); got != expected {
+			t.Errorf("route %s: expected %v, got %v", route, expected, got)
+		}
+	}
+
+	endpoints := map[string]bool{
+		"web-01": true, "web-": true, "db1": true, "db12": true,
+		"host01": false, "db": false, "db1-backup": false, "my-web-01": false,
+	}
+	for endpoint, expected := range endpoints {
+		if got := teamA.AllowEndpoint(endpoint); got != expected {
+			t.Errorf("endpoint %s: expected %v, got %v", endpoint, expected, got)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	authn := newTestAuthenticator(t)
+
+	// 没有调用方时不限制
+	if err := Authorize(context.Background(), "host01"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewContext(context.Background(), authn.tokens[1].principal)
+	if FromContext(ctx) != authn.tokens[1].principal {
+		t.Fatal("principal not in context")
+	}
+	if err := Authorize(ctx, "web-01"); err != nil {
+		t.Fatal(err)
+	}
+	err := Authorize(ctx, "host01")
+	if e, ok := err.(*ForbiddenError); !ok || e.Principal != "team-a" || e.Endpoint != "host01" {
+		t.Fatalf("expected forbidden error, got %v", err)
+	}
+}
+
+func TestNewBadPattern(t *testing.T) {
+	_, err := New(&g.AuthConfig{Tokens: []*g.AuthPrincipal{{Name: "bad", Secret: "x", Endpoints: []string{"/web-(/"}}}})
+	if err == nil {
+		t.Fatal("expected error for bad endpoint pattern")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	authn := newTestAuthenticator(t)
+	request := func(body string) *http.Request {
+		r, err := http.NewRequest("POST", "http://127.0.0.1/graph/history?envelope=1", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := request("")
+	if _, err := authn.Authenticate(r); err != ErrNoCredentials {
+		t.Fatalf("expected no credentials, got %v", err)
+	}
+
+	r.Header.Set("Authorization", "Bearer team-a-token")
+	if p, err := authn.Authenticate(r); err != nil || p.Name != "team-a" || p.Method != MethodToken {
+		t.Fatalf("unexpected principal %+v, err %v", p, err)
+	}
+	r.Header.Set("Authorization", "Bearer team-a")
+	if _, err := authn.Authenticate(r); err != ErrInvalidCredentials {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+
+	// 没有配置htpasswd时不支持basic认证
+	r = request("")
+	r.SetBasicAuth("alice", "secret")
+	if _, err := authn.Authenticate(r); err != ErrInvalidCredentials || authn.Basic() {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+
+	// hmac签名覆盖body, 认证后body仍然可以读取
+	body := `[{"endpoint": "host01", "counter": "cpu.idle"}]`
+	r = request(body)
+	SignRequest(r, "ci", "ci-secret", []byte(body))
+	if p, err := authn.Authenticate(r); err != nil || p.Name != "ci" || p.Method != MethodHmac {
+		t.Fatalf("unexpected principal %+v, err %v", p, err)
+	}
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(r.Body)
+	if buf.String() != body {
+		t.Fatalf("body not restored: %q", buf.String())
+	}
+
+	for name, sign := range map[string]func(r *http.Request){
+		"unknown key":  func(r *http.Request) { SignRequest(r, "nope", "ci-secret", []byte(body)) },
+		"wrong secret": func(r *http.Request) { SignRequest(r, "ci", "nope", []byte(body)) },
+		"body changed": func(r *http.Request) { SignRequest(r, "ci", "ci-secret", []byte("[]")) },
+		"expired": func(r *http.Request) {
+			ts := time.Now().Unix() - 2*defaultHmacMaxSkew
+			r.Header.Set(HeaderKey, "ci")
+			r.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+			r.Header.Set(HeaderSignature, Sign("ci-secret", r.Method, r.URL.RequestURI(), ts, []byte(body)))
+		},
+	} {
+		r = request(body)
+		sign(r)
+		if _, err := authn.Authenticate(r); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// hmac签名的请求头
+const (
+	HeaderKey       = "X-Auth-Key"
+	HeaderTimestamp = "X-Auth-Timestamp"
+	HeaderSignature = "X-Auth-Signature"
+)
+
+// Sign 计算请求的hmac签名:
+// hex(hmac-sha256(secret, method + "\n" + uri + "\n" + timestamp + "\n" + hex(sha256(body))))
+// uri为请求的路径和参数, 如 /graph/history?envelope=1; timestamp为unix时间(秒)
+func Sign(secret, method, uri string, timestamp int64, body []byte) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", method, uri, timestamp, hex.EncodeToString(digest[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest 为请求加上hmac签名的请求头, body须与请求的body一致
+func SignRequest(r *http.Request, key, secret string, body []byte) {
+	ts := time.Now().Unix()
+	r.Header.Set(HeaderKey, key)
+	r.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	r.Header.Set(HeaderSignature, Sign(secret, r.Method, r.URL.RequestURI(), ts, body))
+}
+
+func (this *Authenticator) authHmac(r *http.Request) (*Principal, error) {
+	cred, found := this.hmacKeys[r.Header.Get(HeaderKey)]
+	if !found {
+		return nil, ErrInvalidCredentials
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s", HeaderTimestamp)
+	}
+	if skew := time.Now().Unix() - ts; skew > this.maxSkew || skew < -this.maxSkew {
+		return nil, fmt.Errorf("%s out of range", HeaderTimestamp)
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	expected := Sign(cred.secret, r.Method, r.URL.RequestURI(), ts, body)
+	if !hmac.Equal([]byte(r.Header.Get(HeaderSignature)), []byte(expected)) {
+		return nil, ErrInvalidCredentials
+	}
+	return cred.principal, nil
+}
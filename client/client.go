@@ -0,0 +1,236 @@
+// Package client 是query http接口的Go客户端
+//
+//	c := client.New("http://127.0.0.1:9966")
+//	data, err := c.History(ctx, &model.HistoryParam{...})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/auth"
+	"github.com/jianvhen/query/model"
+)
+
+const (
+	DefaultRetries   = 2
+	DefaultBackoff   = 100 * time.Millisecond
+	DefaultChunkSize = 500
+)
+
+type Client struct {
+	Addr       string       // query的http地址, 如 http://127.0.0.1:9966
+	HTTPClient *http.Client // 为nil时使用http.DefaultClient
+	Retries    int          // 网络错误和5xx时的重试次数
+	Backoff    time.Duration
+	ChunkSize  int // 每个请求最多包含的endpoint/counter数, 超过时分批请求
+
+	// query开启认证时使用: Token为静态token; HmacKey、HmacSecret不为空时对请求签名
+	Token      string
+	HmacKey    string
+	HmacSecret string
+}
+
+// Error query返回的错误, Msg为StdRender输出的 {"msg": ...}
+type Error struct {
+	StatusCode int
+	Msg        string
+}
+
+func (this *Error) Error() string {
+	return fmt.Sprintf("query: %d, %s", this.StatusCode, this.Msg)
+}
+
+func New(addr string) *Client {
+	return &Client{
+		Addr:      strings.TrimSuffix(addr, "/"),
+		Retries:   DefaultRetries,
+		Backoff:   DefaultBackoff,
+		ChunkSize: DefaultChunkSize,
+	}
+}
+
+// History 查询历史数据, 对应 POST /graph/history;
+// 带聚合参数时需要在一次请求中聚合全部曲线, 不分批
+func (this *Client) History(ctx context.Context, param *model.HistoryParam) ([]*cmodel.GraphQueryResponse, error) {
+	size := this.chunkSize()
+	if param.Aggregate != nil {
+		size = len(param.EndpointCounters)
+	}
+
+	ret := []*cmodel.GraphQueryResponse{}
+	for _, ecs := range chunkInfoParams(param.EndpointCounters, size) {
+		chunk := *param
+		chunk.EndpointCounters = ecs
+
+		var data []*cmodel.GraphQueryResponse
+		if err := this.post(ctx, "/graph/history", &chunk, &data); err != nil {
+			return nil, err
+		}
+		ret = append(ret, data...)
+	}
+	return ret, nil
+}
+
+// Info 查询rrd文件信息, 对应 POST /graph/info
+func (this *Client) Info(ctx context.Context, params []cmodel.GraphInfoParam) ([]*cmodel.GraphFullyInfo, error) {
+	ret := []*cmodel.GraphFullyInfo{}
+	for _, chunk := range chunkInfoParams(params, this.chunkSize()) {
+		var data []*cmodel.GraphFullyInfo
+		if err := this.post(ctx, "/graph/info", chunk, &data); err != nil {
+			return nil, err
+		}
+		ret = append(ret, data...)
+	}
+	return ret, nil
+}
+
+// Last 查询最新值, 对应 POST /graph/last
+func (this *Client) Last(ctx context.Context, params []cmodel.GraphLastParam) ([]*cmodel.GraphLastResp, error) {
+	return this.last(ctx, "/graph/last", params)
+}
+
+// LastRaw 查询最新的原始值, 对应 POST /graph/last/raw
+func (this *Client) LastRaw(ctx context.Context, params []cmodel.GraphLastParam) ([]*cmodel.GraphLastResp, error) {
+	return this.last(ctx, "/graph/last/raw", params)
+}
+
+func (this *Client) last(ctx context.Context, path string, params []cmodel.GraphLastParam) ([]*cmodel.GraphLastResp, error) {
+	ret := []*cmodel.GraphLastResp{}
+	for _, chunk := range chunkLastParams(params, this.chunkSize()) {
+		var data []*cmodel.GraphLastResp
+		if err := this.post(ctx, path, chunk, &data); err != nil {
+			return nil, err
+		}
+		ret = append(ret, data...)
+	}
+	return ret, nil
+}
+
+// post 发送json请求并解析响应; 网络错误和5xx时按指数退避重试, 4xx时直接返回*Error
+func (this *Client) post(ctx context.Context, path string, body interface{}, v interface{}) error {
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	backoff := this.Backoff
+	for i := 0; ; i++ {
+		err = this.do(ctx, path, bs, v)
+		if err == nil || i >= this.Retries || !retryable(err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (this *Client) do(ctx context.Context, path string, body []byte, v interface{}) error {
+	req, err := http.NewRequest("POST", this.Addr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	switch {
+	case this.HmacKey != "":
+		auth.SignRequest(req, this.HmacKey, this.HmacSecret, body)
+	case this.Token != "":
+		req.Header.Set("Authorization", "Bearer "+this.Token)
+	}
+
+	resp, err := this.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var msg struct {
+			Msg string `json:"msg"`
+		}
+		if json.Unmarshal(bs, &msg) != nil || msg.Msg == "" {
+			msg.Msg = strings.TrimSpace(string(bs))
+		}
+		return &Error{StatusCode: resp.StatusCode, Msg: msg.Msg}
+	}
+	return json.Unmarshal(bs, v)
+}
+
+// 只重试网络错误和5xx, 请求参数错误和响应解析错误重试也不会成功
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *Error:
+		return e.StatusCode >= 500
+	case *url.Error:
+		return true
+	}
+	return false
+}
+
+func (this *Client) httpClient() *http.Client {
+	if this.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return this.HTTPClient
+}
+
+func (this *Client) chunkSize() int {
+	if this.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	return this.ChunkSize
+}
+
+func chunkInfoParams(params []cmodel.GraphInfoParam, size int) [][]cmodel.GraphInfoParam {
+	if len(params) <= size || size <= 0 {
+		return [][]cmodel.GraphInfoParam{params}
+	}
+
+	ret := [][]cmodel.GraphInfoParam{}
+	for start := 0; start < len(params); start += size {
+		end := start + size
+		if end > len(params) {
+			end = len(params)
+		}
+		ret = append(ret, params[start:end])
+	}
+	return ret
+}
+
+func chunkLastParams(params []cmodel.GraphLastParam, size int) [][]cmodel.GraphLastParam {
+	if len(params) <= size || size <= 0 {
+		return [][]cmodel.GraphLastParam{params}
+	}
+
+	ret := [][]cmodel.GraphLastParam{}
+	for start := 0; start < len(params); start += size {
+		end := start + size
+		if end > len(params) {
+			end = len(params)
+		}
+		ret = append(ret, params[start:end])
+	}
+	return ret
+}
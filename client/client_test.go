@@ -0,0 +1,210 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/auth"
+	"github.com/jianvhen/query/model"
+)
+
+func newTestClient(url string) *Client {
+	c := New(url)
+	c.Backoff = time.Millisecond
+	return c
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestHistoryChunks(t *testing.T) {
+	var calls int32
+	maxChunk := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/graph/history" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		atomic.AddInt32(&calls, 1)
+
+		var body model.HistoryParam
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+			writeJson(w, http.StatusBadRequest, map[string]string{"msg": err.Error()})
+			return
+		}
+		if len(body.EndpointCounters) > maxChunk {
+			t.Errorf("chunk too large: %d", len(body.EndpointCounters))
+		}
+
+		data := []*cmodel.GraphQueryResponse{}
+		for _, ec := range body.EndpointCounters {
+			data = append(data, &cmodel.GraphQueryResponse{
+				Endpoint: ec.Endpoint,
+				Counter:  ec.Counter,
+				Step:     60,
+				Values:   []*cmodel.RRDData{{Timestamp: int64(body.Start), Value: 1}},
+			})
+		}
+		writeJson(w, http.StatusOK, data)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	c.ChunkSize = 2
+
+	param := &model.HistoryParam{Start: 60, End: 120, CF: "AVERAGE"}
+	for _, counter := range []string{"a", "b", "c", "d", "e"} {
+		param.EndpointCounters = append(param.EndpointCounters, cmodel.GraphInfoParam{Endpoint: "host", Counter: counter})
+	}
+
+	data, err := c.History(context.Background(), param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 5 || data[4].Counter != "e" || data[0].Values[0].Timestamp != 60 {
+		t.Fatalf("unexpected data: %+v", data)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 requests, got %d", calls)
+	}
+
+	// 带聚合参数时不分批
+	calls = 0
+	maxChunk = len(param.EndpointCounters)
+	param.Aggregate = &model.AggregateParam{Fn: "sum"}
+	if _, err := c.History(context.Background(), param); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 request, got %d", calls)
+	}
+}
+
+func TestRetryOnServerError(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			writeJson(w, http.StatusBadGateway, map[string]string{"msg": "busy"})
+			return
+		}
+		writeJson(w, http.StatusOK, []*cmodel.GraphLastResp{
+			{Endpoint: "host", Counter: "load.1min", Value: &cmodel.RRDData{Timestamp: 60, Value: 2}},
+		})
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	data, err := c.Last(context.Background(), []cmodel.GraphLastParam{{Endpoint: "host", Counter: "load.1min"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1 || data[0].Value.Value != 2 {
+		t.Fatalf("unexpected data: %+v", data)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+
+	// 重试次数用完后返回最后一次的错误
+	atomic.StoreInt32(&calls, -100)
+	c.Retries = 1
+	_, err = c.Last(context.Background(), []cmodel.GraphLastParam{{Endpoint: "host", Counter: "load.1min"}})
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusBadGateway || e.Msg != "busy" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := atomic.LoadInt32(&calls) + 100; n != 2 {
+		t.Fatalf("expected 2 requests, got %d", n)
+	}
+}
+
+func TestStdRenderError(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		writeJson(w, http.StatusBadRequest, map[string]string{"msg": "empty"})
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	_, err := c.Info(context.Background(), nil)
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != http.StatusBadRequest || e.Msg != "empty" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("4xx should not be retried, got %d requests", calls)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	c := newTestClient(srv.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	begin := time.Now()
+	_, err := c.LastRaw(ctx, []cmodel.GraphLastParam{{Endpoint: "host", Counter: "load.1min"}})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if time.Since(begin) > 2*time.Second {
+		t.Fatal("request was not cancelled")
+	}
+}
+
+func TestAuthHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.Header.Get(auth.HeaderKey) {
+		case "":
+			if r.Header.Get("Authorization") != "Bearer token01" {
+				writeJson(w, http.StatusUnauthorized, map[string]string{"msg": "no token"})
+				return
+			}
+		case "ci":
+			ts, _ := strconv.ParseInt(r.Header.Get(auth.HeaderTimestamp), 10, 64)
+			if r.Header.Get(auth.HeaderSignature) != auth.Sign("ci-secret", r.Method, r.URL.RequestURI(), ts, body) {
+				writeJson(w, http.StatusUnauthorized, map[string]string{"msg": "bad signature"})
+				return
+			}
+		}
+		writeJson(w, http.StatusOK, []*cmodel.GraphLastResp{})
+	}))
+	defer srv.Close()
+
+	params := []cmodel.GraphLastParam{{Endpoint: "host01", Counter: "cpu.idle"}}
+	c := newTestClient(srv.URL)
+	c.Token = "token01"
+	if _, err := c.Last(context.Background(), params); err != nil {
+		t.Fatalf("token: %v", err)
+	}
+
+	c = newTestClient(srv.URL)
+	c.HmacKey, c.HmacSecret = "ci", "ci-secret"
+	if _, err := c.Last(context.Background(), params); err != nil {
+		t.Fatalf("hmac: %v", err)
+	}
+
+	c.HmacSecret = "nope"
+	if _, err := c.Last(context.Background(), params); err == nil {
+		t.Fatal("expected error with wrong secret")
+	}
+}
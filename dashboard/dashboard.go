@@ -0,0 +1,117 @@
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jianvhen/query/g"
+)
+
+// dashboard提供endpoint和counter的索引查询; 请求跟随调用方的ctx取消,
+// ctx没有deadline时最多等待defaultTimeout
+var client = &http.Client{}
+
+const defaultTimeout = 10 * time.Second
+
+type apiResponse struct {
+	Ok   bool            `json:"ok"`
+	Msg  string          `json:"msg"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Endpoints 按正则表达式查询endpoint, 最多返回limit个
+func Endpoints(ctx context.Context, regex string, limit int) ([]string, error) {
+	params := url.Values{}
+	params.Set("q", regex)
+	params.Set("tags", "")
+	params.Set("limit", strconv.Itoa(limit))
+	params.Set("regex_query", "1")
+
+	req, err := http.NewRequest("GET", g.Config().Api.Dashboard+"/api/endpoints?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []string
+	if err := call(ctx, req, &endpoints); err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// Counters 查询endpoints上包含关键字q的counter, 最多返回limit个
+func Counters(ctx context.Context, endpoints []string, q string, limit int) ([]string, error) {
+	bs, err := json.Marshal(endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("endpoints", string(bs))
+	form.Set("q", q)
+	form.Set("limit", strconv.Itoa(limit))
+
+	req, err := http.NewRequest("POST", g.Config().Api.Dashboard+"/api/counters", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// 每一项为 [counter, type, step]
+	var items [][]interface{}
+	if err := call(ctx, req, &items); err != nil {
+		return nil, err
+	}
+
+	counters := make([]string, 0, len(items))
+	for _, item := range items {
+		if len(item) == 0 {
+			continue
+		}
+		if counter, ok := item[0].(string); ok {
+			counters = append(counters, counter)
+		}
+	}
+	return counters, nil
+}
+
+// call 发出请求并把返回的data解析到v中
+func call(ctx context.Context, req *http.Request, v interface{}) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	return decode(resp, v)
+}
+
+func decode(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("dashboard: %s %s", resp.Request.URL.Path, resp.Status)
+	}
+
+	var body apiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("dashboard: %s, %v", resp.Request.URL.Path, err)
+	}
+	if !body.Ok && body.Msg != "" {
+		return fmt.Errorf("dashboard: %s, %s", resp.Request.URL.Path, body.Msg)
+	}
+	if len(body.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body.Data, v)
+}
@@ -0,0 +1,176 @@
+package dashboard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/g"
+	"github.com/jianvhen/query/pattern"
+)
+
+// 模式中第一个通配符之前的字面部分, 作为dashboard counter查询的关键字
+func literalPrefix(s string) string {
+	if pattern.IsRegex(s) {
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return ""
+		}
+		prefix, _ := re.LiteralPrefix()
+		return strings.TrimPrefix(prefix, "^")
+	}
+	if i := strings.IndexAny(s, "*?[{"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// Expand 通过dashboard的索引把endpoint/counter中的模式展开为确定的endpoint/counter,
+// 展开后去重并保持请求的顺序; 模式匹配的endpoint、counter或展开的结果超过api.max时返回错误.
+// counter的模式在每个endpoint上分别展开, 不会组合出endpoint上不存在的counter
+func Expand(ctx context.Context, ecs []cmodel.GraphInfoParam) ([]cmodel.GraphInfoParam, error) {
+	patterns := false
+	for _, ec := range ecs {
+		if pattern.IsPattern(ec.Endpoint) || pattern.IsPattern(ec.Counter) {
+			patterns = true
+			break
+		}
+	}
+	if !patterns {
+		return ecs, nil
+	}
+
+	if g.Config().Api == nil {
+		return nil, errors.New("api not configured, can not expand patterns")
+	}
+	max := g.Config().Api.Max
+
+	ret := []cmodel.GraphInfoParam{}
+	seen := make(map[cmodel.GraphInfoParam]bool)
+	add := func(ec cmodel.GraphInfoParam) error {
+		if seen[ec] {
+			return nil
+		}
+		seen[ec] = true
+		ret = append(ret, ec)
+		if max > 0 && len(ret) > max {
+			return fmt.Errorf("too many endpoint_counters after expanding, max %d", max)
+		}
+		return nil
+	}
+
+	for _, ec := range ecs {
+		if !pattern.IsPattern(ec.Endpoint) && !pattern.IsPattern(ec.Counter) {
+			if err := add(ec); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		endpoints := []string{ec.Endpoint}
+		if pattern.IsPattern(ec.Endpoint) {
+			re, err := pattern.Compile(ec.Endpoint)
+			if err != nil {
+				return nil, fmt.Errorf("bad endpoint pattern %s: %v", ec.Endpoint, err)
+			}
+			// 多取一个, 判断是否被截断
+			found, err := Endpoints(ctx, strings.TrimSuffix(strings.TrimPrefix(re.String(), "^"), "$"), limitOf(max))
+			if err != nil {
+				return nil, err
+			}
+			if max > 0 && len(found) > max {
+				return nil, fmt.Errorf("too many endpoints match %s, max %d", ec.Endpoint, max)
+			}
+			endpoints = filter(found, re)
+		}
+
+		if !pattern.IsPattern(ec.Counter) {
+			for _, endpoint := range endpoints {
+				if err := add(cmodel.GraphInfoParam{Endpoint: endpoint, Counter: ec.Counter}); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		re, err := pattern.Compile(ec.Counter)
+		if err != nil {
+			return nil, fmt.Errorf("bad counter pattern %s: %v", ec.Counter, err)
+		}
+		counters, err := countersOf(ctx, endpoints, ec.Counter, re, max)
+		if err != nil {
+			return nil, err
+		}
+		for i, endpoint := range endpoints {
+			for _, counter := range counters[i] {
+				if err := add(cmodel.GraphInfoParam{Endpoint: endpoint, Counter: counter}); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// 同时查询counter的endpoint数
+const countersConcurrency = 8
+
+// countersOf 逐个endpoint查询匹配counter模式的counter, 返回值与endpoints一一对应
+func countersOf(ctx context.Context, endpoints []string, counter string, re *regexp.Regexp, max int) ([][]string, error) {
+	ret := make([][]string, len(endpoints))
+	errs := make([]error, len(endpoints))
+	sem := make(chan struct{}, countersConcurrency)
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, endpoint string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			found, err := Counters(ctx, []string{endpoint}, literalPrefix(counter), limitOf(max))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if max > 0 && len(found) > max {
+				errs[i] = fmt.Errorf("too many counters match %s on %s, max %d", counter, endpoint, max)
+				return
+			}
+			ret[i] = filter(found, re)
+		}(i, endpoint)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// limitOf 向dashboard查询时的limit: 比max多一个, 用来判断结果是否被截断; max<=0时不限制
+func limitOf(max int) int {
+	if max <= 0 {
+		return 0
+	}
+	return max + 1
+}
+
+func filter(items []string, re *regexp.Regexp) []string {
+	ret := []string{}
+	for _, item := range items {
+		if re.MatchString(item) {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
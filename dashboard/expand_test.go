@@ -0,0 +1,222 @@
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/g"
+)
+
+const testMax = 4
+
+// 假的dashboard索引: endpoint -> counters
+var (
+	index = map[string][]string{
+		"web-01": {"cpu.idle", "net.if.in.bytes/iface=eth0"},
+		"web-02": {"cpu.idle", "net.if.in.bytes/iface=eth1"},
+		"db-01":  {"cpu.idle", "disk.io.util/device=sda"},
+	}
+	indexLock = new(sync.Mutex)
+	delay     time.Duration
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+
+	srv := httptest.NewServer(http.HandlerFunc(serveDashboard))
+	dir, err := ioutil.TempDir("", "dashboard-test")
+	if err != nil {
+		panic(err)
+	}
+	cfg := fmt.Sprintf(`{
+		"http": {"enabled": false},
+		"graph": {"cluster": {"graph-00": "127.0.0.1:6070"}},
+		"api": {"dashboard": "%s", "max": %d}
+	}`, srv.URL, testMax)
+	cfgFile := filepath.Join(dir, "cfg.json")
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0644); err != nil {
+		panic(err)
+	}
+	g.ParseConfig(cfgFile)
+
+	code := m.Run()
+
+	srv.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	indexLock.Lock()
+	d := delay
+	indexLock.Unlock()
+	if d > 0 {
+		select {
+		case <-time.After(d):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	r.ParseForm()
+	limit, _ := strconv.Atoi(r.Form.Get("limit"))
+	var data interface{}
+	switch r.URL.Path {
+	case "/api/endpoints":
+		re := regexp.MustCompile(r.Form.Get("q"))
+		endpoints := []string{}
+		for endpoint := range index {
+			if re.MatchString(endpoint) {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+		sort.Strings(endpoints)
+		if limit > 0 && len(endpoints) > limit {
+			endpoints = endpoints[:limit]
+		}
+		data = endpoints
+	case "/api/counters":
+		var endpoints []string
+		json.Unmarshal([]byte(r.Form.Get("endpoints")), &endpoints)
+		items := [][]interface{}{}
+		seen := make(map[string]bool)
+		for _, endpoint := range endpoints {
+			for _, counter := range index[endpoint] {
+				if !seen[counter] && strings.Contains(counter, r.Form.Get("q")) {
+					seen[counter] = true
+					items = append(items, []interface{}{counter, "GAUGE", 60})
+				}
+			}
+		}
+		if limit > 0 && len(items) > limit {
+			items = items[:limit]
+		}
+		data = items
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "data": data})
+}
+
+func ecsString(ecs []cmodel.GraphInfoParam) string {
+	items := make([]string, 0, len(ecs))
+	for _, ec := range ecs {
+		items = append(items, ec.Endpoint+"#"+ec.Counter)
+	}
+	return strings.Join(items, ",")
+}
+
+func TestExpand(t *testing.T) {
+	cases := []struct {
+		name     string
+		ecs      []cmodel.GraphInfoParam
+		expected string
+	}{
+		{"no pattern", []cmodel.GraphInfoParam{{Endpoint: "nope", Counter: "cpu.idle"}}, "nope#cpu.idle"},
+		{"endpoint glob", []cmodel.GraphInfoParam{{Endpoint: "web-*", Counter: "cpu.idle"}}, "web-01#cpu.idle,web-02#cpu.idle"},
+		{"endpoint regex", []cmodel.GraphInfoParam{{Endpoint: "/db-\\d+/", Counter: "cpu.idle"}}, "db-01#cpu.idle"},
+		// counter在每个endpoint上分别展开, 不组合出web-01#...eth1
+		{"counter per endpoint", []cmodel.GraphInfoParam{{Endpoint: "web-*", Counter: "net.if.in.bytes/*"}},
+			"web-01#net.if.in.bytes/iface=eth0,web-02#net.if.in.bytes/iface=eth1"},
+		{"dedup", []cmodel.GraphInfoParam{{Endpoint: "web-01", Counter: "cpu.idle"}, {Endpoint: "web-0?", Counter: "cpu.idle"}},
+			"web-01#cpu.idle,web-02#cpu.idle"},
+		{"no match", []cmodel.GraphInfoParam{{Endpoint: "mq-*", Counter: "cpu.idle"}}, ""},
+	}
+	for _, c := range cases {
+		ecs, err := Expand(context.Background(), c.ecs)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got := ecsString(ecs); got != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestExpandMax(t *testing.T) {
+	indexLock.Lock()
+	for i := 0; i < testMax; i++ {
+		index[fmt.Sprintf("cache-%02d", i)] = []string{"cpu.idle"}
+	}
+	indexLock.Unlock()
+	defer func() {
+		indexLock.Lock()
+		for i := 0; i < testMax; i++ {
+			delete(index, fmt.Sprintf("cache-%02d", i))
+		}
+		indexLock.Unlock()
+	}()
+
+	// 正好max个endpoint时不报错
+	ecs, err := Expand(context.Background(), []cmodel.GraphInfoParam{{Endpoint: "cache-*", Counter: "cpu.idle"}})
+	if err != nil || len(ecs) != testMax {
+		t.Fatalf("expected %d endpoint_counters, got %d %v", testMax, len(ecs), err)
+	}
+
+	// dashboard返回的endpoint被截断时报错, 而不是静默地只查询一部分
+	if _, err := Expand(context.Background(), []cmodel.GraphInfoParam{{Endpoint: "*", Counter: "cpu.idle"}}); err == nil ||
+		!strings.Contains(err.Error(), "too many endpoints") {
+		t.Fatalf("expected too many endpoints, got %v", err)
+	}
+
+	// 展开的结果超过max
+	if _, err := Expand(context.Background(), []cmodel.GraphInfoParam{
+		{Endpoint: "cache-*", Counter: "cpu.idle"},
+		{Endpoint: "web-01", Counter: "cpu.idle"},
+	}); err == nil || !strings.Contains(err.Error(), "too many endpoint_counters") {
+		t.Fatalf("expected too many endpoint_counters, got %v", err)
+	}
+}
+
+func TestExpandContext(t *testing.T) {
+	indexLock.Lock()
+	delay = time.Second
+	indexLock.Unlock()
+	defer func() {
+		indexLock.Lock()
+		delay = 0
+		indexLock.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	if _, err := Expand(ctx, []cmodel.GraphInfoParam{{Endpoint: "web-*", Counter: "cpu.idle"}}); err == nil {
+		t.Fatal("expected error")
+	}
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected to follow the ctx deadline, took %v", elapsed)
+	}
+}
+
+func TestLiteralPrefix(t *testing.T) {
+	cases := map[string]string{
+		"net.if.in.bytes/*":    "net.if.in.bytes/",
+		"cpu.{idle,busy}":      "cpu.",
+		"/disk\\.io\\.util.*/": "disk.io.util",
+		"cpu.idle":             "cpu.idle",
+	}
+	for s, expected := range cases {
+		if got := literalPrefix(s); got != expected {
+			t.Errorf("literalPrefix(%s): expected %s, got %s", s, expected, got)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+)
+
+// Series 对齐后的一条曲线, Values[i]为第i个时间点上的值, 没有数据时为NaN
+type Series struct {
+	Endpoint string
+	Counter  string
+	Values   []float64
+}
+
+// Input 计算表达式所需的数据: 对齐后的时间点个数、步长, 以及每个曲线引用对应的曲线(引用中有通配符时可能有多条)
+type Input struct {
+	Points int
+	Step   int64
+	Lookup func(ref *RefNode) []*Series
+}
+
+// value 表达式的值, 是一个数字或一组曲线
+type value struct {
+	scalar bool
+	num    float64
+	series []*Series
+}
+
+// Eval 计算表达式, 返回的每条曲线都有Points个值; NaN参与运算的结果为NaN, 除以0的结果也为NaN.
+// 两组曲线运算时, 若一边只有一条曲线则与另一边的每条曲线分别运算, 否则按endpoint一一对应, 对应不上的曲线被丢弃
+func Eval(node Node, in *Input) ([]*Series, error) {
+	v, err := eval(node, in)
+	if err != nil {
+		return nil, err
+	}
+	if !v.scalar {
+		return v.series, nil
+	}
+
+	values := make([]float64, in.Points)
+	for i := range values {
+		values[i] = v.num
+	}
+	return []*Series{{Counter: node.String(), Values: values}}, nil
+}
+
+func eval(node Node, in *Input) (*value, error) {
+	switch n := node.(type) {
+	case *NumberNode:
+		return &value{scalar: true, num: n.Value}, nil
+	case *RefNode:
+		return &value{series: in.Lookup(n)}, nil
+	case *BinaryNode:
+		left, err := eval(n.Left, in)
+		if err != nil {
+			return nil, err
+		}
+		right, err := eval(n.Right, in)
+		if err != nil {
+			return nil, err
+		}
+		return binary(n.Op, left, right)
+	case *CallNode:
+		fn, ok := funcs[n.Fn]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %s", n.Fn)
+		}
+		args := make([]*value, 0, len(n.Args))
+		for _, arg := range n.Args {
+			v, err := eval(arg, in)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, v)
+		}
+		return fn.call(n, args, in)
+	}
+	return nil, fmt.Errorf("invalid expression %v", node)
+}
+
+func apply(op byte, a, b float64) float64 {
+	switch op {
+	case '+':
+		return a + b
+	case '-':
+		return a - b
+	case '*':
+		return a * b
+	case '/':
+		if b == 0 {
+			return math.NaN()
+		}
+		return a / b
+	}
+	return math.NaN()
+}
+
+func binary(op byte, left, right *value) (*value, error) {
+	if left.scalar && right.scalar {
+		return &value{scalar: true, num: apply(op, left.num, right.num)}, nil
+	}
+
+	if left.scalar || right.scalar {
+		ret := &value{series: make([]*Series, 0, len(left.series)+len(right.series))}
+		for _, s := range left.series {
+			ret.series = append(ret.series, combine(op, s, nil, right.num))
+		}
+		for _, s := range right.series {
+			ret.series = append(ret.series, combine(op, nil, s, left.num))
+		}
+		return ret, nil
+	}
+
+	ret := &value{series: []*Series{}}
+	switch {
+	case len(left.series) == 1:
+		for _, s := range right.series {
+			ret.series = append(ret.series, combine(op, left.series[0], s, 0))
+		}
+	case len(right.series) == 1:
+		for _, s := range left.series {
+			ret.series = append(ret.series, combine(op, s, right.series[0], 0))
+		}
+	default:
+		byEndpoint := make(map[string]*Series, len(right.series))
+		for _, s := range right.series {
+			if _, ok := byEndpoint[s.Endpoint]; ok {
+				return nil, fmt.Errorf("ambiguous series of endpoint %s", s.Endpoint)
+			}
+			byEndpoint[s.Endpoint] = s
+		}
+		for _, s := range left.series {
+			if r, ok := byEndpoint[s.Endpoint]; ok {
+				ret.series = append(ret.series, combine(op, s, r, 0))
+			}
+		}
+	}
+	return ret, nil
+}
+
+// combine 计算两条曲线的运算; left或right为nil时, 用数字num代替该边
+func combine(op byte, left, right *Series, num float64) *Series {
+	switch {
+	case right == nil:
+		ret := &Series{Endpoint: left.Endpoint, Counter: fmt.Sprintf("(%s %c %s)", left.Counter, op, formatNumber(num))}
+		ret.Values = make([]float64, len(left.Values))
+		for i, v := range left.Values {
+			ret.Values[i] = apply(op, v, num)
+		}
+		return ret
+	case left == nil:
+		ret := &Series{Endpoint: right.Endpoint, Counter: fmt.Sprintf("(%s %c %s)", formatNumber(num), op, right.Counter)}
+		ret.Values = make([]float64, len(right.Values))
+		for i, v := range right.Values {
+			ret.Values[i] = apply(op, num, v)
+		}
+		return ret
+	}
+
+	endpoint := left.Endpoint
+	if right.Endpoint != endpoint {
+		endpoint = "*"
+	}
+	ret := &Series{Endpoint: endpoint, Counter: fmt.Sprintf("(%s %c %s)", left.Counter, op, right.Counter)}
+	ret.Values = make([]float64, len(left.Values))
+	for i, v := range left.Values {
+		ret.Values[i] = apply(op, v, right.Values[i])
+	}
+	return ret
+}
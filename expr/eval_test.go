@@ -0,0 +1,123 @@
+package expr
+
+import (
+	"math"
+	"testing"
+)
+
+func equal(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.IsNaN(a[i]) != math.IsNaN(b[i]) || (!math.IsNaN(a[i]) && math.Abs(a[i]-b[i]) > 1e-9) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEval(t *testing.T) {
+	nan := math.NaN()
+	data := map[RefNode][]*Series{
+		{"host01", "used"}:  {{Endpoint: "host01", Counter: "used", Values: []float64{1, 2, nan}}},
+		{"host01", "total"}: {{Endpoint: "host01", Counter: "total", Values: []float64{4, 0, 4}}},
+		{"web-*", "bytes"}: {
+			{Endpoint: "web-01", Counter: "bytes", Values: []float64{0, 60, 30}},
+			{Endpoint: "web-02", Counter: "bytes", Values: []float64{10, 20, 30}},
+		},
+		{"web-*", "conns"}: {
+			{Endpoint: "web-02", Counter: "conns", Values: []float64{1, 2, 3}},
+			{Endpoint: "web-03", Counter: "conns", Values: []float64{1, 1, 1}},
+		},
+	}
+	in := &Input{Points: 3, Step: 60, Lookup: func(ref *RefNode) []*Series { return data[*ref] }}
+
+	cases := []struct {
+		src      string
+		expected map[string][]float64 // endpoint -> values
+	}{
+		// 除以0和NaN参与运算的结果为NaN
+		{"host01:used / host01:total * 100", map[string][]float64{"host01": {25, nan, nan}}},
+		{"1e2 - 1", map[string][]float64{"": {99, 99, 99}}},
+		// 计数器重置(增量为负)时rate为NaN
+		{"rate('web-*:bytes')", map[string][]float64{"web-01": {nan, 1, nan}, "web-02": {nan, 1.0 / 6, 1.0 / 6}}},
+		// 两组多条曲线按endpoint一一对应, 对应不上的被丢弃
+		{"'web-*:bytes' / 'web-*:conns'", map[string][]float64{"web-02": {10, 10, 10}}},
+		{"clamp('web-*:bytes', 10, 50)", map[string][]float64{"web-01": {10, 50, 30}, "web-02": {10, 20, 30}}},
+		{"topk(1, 'web-*:bytes')", map[string][]float64{"web-01": {0, 60, 30}}},
+	}
+	for _, c := range cases {
+		node, err := Parse(c.src)
+		if err != nil {
+			t.Fatalf("%s: %v", c.src, err)
+		}
+		ret, err := Eval(node, in)
+		if err != nil {
+			t.Errorf("%s: %v", c.src, err)
+			continue
+		}
+		got := make(map[string][]float64)
+		for _, s := range ret {
+			if len(s.Values) != in.Points {
+				t.Errorf("%s: expected %d points, got %d", c.src, in.Points, len(s.Values))
+			}
+			got[s.Endpoint] = s.Values
+		}
+		if len(got) != len(c.expected) {
+			t.Errorf("%s: expected %d series, got %d", c.src, len(c.expected), len(got))
+			continue
+		}
+		for endpoint, values := range c.expected {
+			if !equal(got[endpoint], values) {
+				t.Errorf("%s: %s expected %v, got %v", c.src, endpoint, values, got[endpoint])
+			}
+		}
+	}
+}
+
+// 单条曲线与多条曲线运算时逐条进行, endpoint不同时为*
+func TestEvalOneToMany(t *testing.T) {
+	data := map[RefNode][]*Series{
+		{"host01", "used"}: {{Endpoint: "host01", Counter: "used", Values: []float64{1, 2}}},
+		{"web-*", "conns"}: {
+			{Endpoint: "web-02", Counter: "conns", Values: []float64{1, 2}},
+			{Endpoint: "host01", Counter: "conns", Values: []float64{3, 4}},
+		},
+	}
+	in := &Input{Points: 2, Step: 60, Lookup: func(ref *RefNode) []*Series { return data[*ref] }}
+	node, err := Parse("host01:used + 'web-*:conns'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err := Eval(node, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret) != 2 {
+		t.Fatalf("expected 2 series, got %d", len(ret))
+	}
+	if ret[0].Endpoint != "*" || !equal(ret[0].Values, []float64{2, 4}) {
+		t.Errorf("unexpected %s %v", ret[0].Endpoint, ret[0].Values)
+	}
+	if ret[1].Endpoint != "host01" || !equal(ret[1].Values, []float64{4, 6}) {
+		t.Errorf("unexpected %s %v", ret[1].Endpoint, ret[1].Values)
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	data := map[RefNode][]*Series{
+		{"web-*", "a"}: {{Endpoint: "web-01", Values: []float64{1}}, {Endpoint: "web-01", Values: []float64{2}}},
+		{"web-*", "b"}: {{Endpoint: "web-01", Values: []float64{1}}, {Endpoint: "web-02", Values: []float64{2}}},
+	}
+	in := &Input{Points: 1, Step: 60, Lookup: func(ref *RefNode) []*Series { return data[*ref] }}
+	for _, src := range []string{"rate(1)", "scale('web-*:a', 'web-*:b')", "moving_avg('web-*:a', 0)", "'web-*:b' - 'web-*:a'"} {
+		node, err := Parse(src)
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		if _, err := Eval(node, in); err == nil {
+			t.Errorf("%s: expected error", src)
+		}
+	}
+}
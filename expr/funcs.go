@@ -0,0 +1,215 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/jianvhen/query/aggregate"
+)
+
+type function struct {
+	args int
+	call func(n *CallNode, args []*value, in *Input) (*value, error)
+}
+
+// funcs 支持的函数:
+//
+//	rate(x)            每秒的增长率, 用于计数器类的曲线; 增量为负(计数器重置)时为NaN
+//	derivative(x)      每秒的变化量, 可以为负
+//	moving_avg(x, n)   最近n个点(含当前点)的平均值, NaN不参与计算
+//	abs(x)             绝对值
+//	clamp(x, min, max) 把值限制在[min, max]之间
+//	scale(x, factor)   乘以factor
+//	topk(k, x)         平均值最大的k条曲线, 平均值为NaN的曲线排在最后
+var funcs = map[string]*function{
+	"rate":       {args: 1, call: rate},
+	"derivative": {args: 1, call: derivative},
+	"moving_avg": {args: 2, call: movingAvg},
+	"abs":        {args: 1, call: abs},
+	"clamp":      {args: 3, call: clamp},
+	"scale":      {args: 2, call: scale},
+	"topk":       {args: 2, call: topk},
+}
+
+func seriesArg(n *CallNode, args []*value, i int) ([]*Series, error) {
+	if args[i].scalar {
+		return nil, fmt.Errorf("%s: argument %d must be a series", n.Fn, i+1)
+	}
+	return args[i].series, nil
+}
+
+func numberArg(n *CallNode, args []*value, i int) (float64, error) {
+	if !args[i].scalar {
+		return 0, fmt.Errorf("%s: argument %d must be a number", n.Fn, i+1)
+	}
+	return args[i].num, nil
+}
+
+// intArg 参数必须是不小于min的整数
+func intArg(n *CallNode, args []*value, i int, min int) (int, error) {
+	num, err := numberArg(n, args, i)
+	if err != nil {
+		return 0, err
+	}
+	if num != math.Trunc(num) || num < float64(min) {
+		return 0, fmt.Errorf("%s: argument %d must be an integer >= %d", n.Fn, i+1, min)
+	}
+	return int(num), nil
+}
+
+// label 返回函数作用于曲线s之后的counter, 如 scale(cpu.idle, 2)
+func label(n *CallNode, s *Series) string {
+	args := []string{s.Counter}
+	for _, arg := range n.Args[1:] {
+		args = append(args, arg.String())
+	}
+	return fmt.Sprintf("%s(%s)", n.Fn, strings.Join(args, ", "))
+}
+
+// mapValues 对每个值调用f; x为数字时直接计算
+func mapValues(n *CallNode, x *value, f func(v float64) float64) *value {
+	if x.scalar {
+		return &value{scalar: true, num: f(x.num)}
+	}
+
+	ret := &value{series: make([]*Series, 0, len(x.series))}
+	for _, s := range x.series {
+		values := make([]float64, len(s.Values))
+		for i, v := range s.Values {
+			values[i] = f(v)
+		}
+		ret.series = append(ret.series, &Series{Endpoint: s.Endpoint, Counter: label(n, s), Values: values})
+	}
+	return ret
+}
+
+// mapSeries 对每条曲线调用f
+func mapSeries(n *CallNode, series []*Series, f func(values []float64) []float64) *value {
+	ret := &value{series: make([]*Series, 0, len(series))}
+	for _, s := range series {
+		ret.series = append(ret.series, &Series{Endpoint: s.Endpoint, Counter: label(n, s), Values: f(s.Values)})
+	}
+	return ret
+}
+
+// delta 计算每个点与前一个有效点之间每秒的变化量, 中间的NaN被跳过; 第一个有效点为NaN
+func delta(values []float64, step int64, nonNegative bool) []float64 {
+	ret := make([]float64, len(values))
+	prev := -1
+	for i, v := range values {
+		ret[i] = math.NaN()
+		if math.IsNaN(v) {
+			continue
+		}
+		if prev >= 0 && step > 0 {
+			d := (v - values[prev]) / float64(int64(i-prev)*step)
+			if d >= 0 || !nonNegative {
+				ret[i] = d
+			}
+		}
+		prev = i
+	}
+	return ret
+}
+
+func rate(n *CallNode, args []*value, in *Input) (*value, error) {
+	series, err := seriesArg(n, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return mapSeries(n, series, func(values []float64) []float64 { return delta(values, in.Step, true) }), nil
+}
+
+func derivative(n *CallNode, args []*value, in *Input) (*value, error) {
+	series, err := seriesArg(n, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return mapSeries(n, series, func(values []float64) []float64 { return delta(values, in.Step, false) }), nil
+}
+
+func movingAvg(n *CallNode, args []*value, in *Input) (*value, error) {
+	series, err := seriesArg(n, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	window, err := intArg(n, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return mapSeries(n, series, func(values []float64) []float64 {
+		ret := make([]float64, len(values))
+		for i := range values {
+			start := i - window + 1
+			if start < 0 {
+				start = 0
+			}
+			ret[i] = aggregate.Avg(values[start : i+1])
+		}
+		return ret
+	}), nil
+}
+
+func abs(n *CallNode, args []*value, in *Input) (*value, error) {
+	return mapValues(n, args[0], math.Abs), nil
+}
+
+func clamp(n *CallNode, args []*value, in *Input) (*value, error) {
+	min, err := numberArg(n, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	max, err := numberArg(n, args, 2)
+	if err != nil {
+		return nil, err
+	}
+	if min > max {
+		return nil, fmt.Errorf("%s: min %s > max %s", n.Fn, formatNumber(min), formatNumber(max))
+	}
+
+	return mapValues(n, args[0], func(v float64) float64 {
+		if math.IsNaN(v) {
+			return v
+		}
+		return math.Max(min, math.Min(max, v))
+	}), nil
+}
+
+func scale(n *CallNode, args []*value, in *Input) (*value, error) {
+	factor, err := numberArg(n, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return mapValues(n, args[0], func(v float64) float64 { return v * factor }), nil
+}
+
+func topk(n *CallNode, args []*value, in *Input) (*value, error) {
+	k, err := intArg(n, args, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	series, err := seriesArg(n, args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	avgs := make(map[*Series]float64, len(series))
+	for _, s := range series {
+		avgs[s] = aggregate.Avg(s.Values)
+	}
+	sorted := append([]*Series{}, series...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := avgs[sorted[i]], avgs[sorted[j]]
+		if math.IsNaN(b) {
+			return !math.IsNaN(a)
+		}
+		return a > b
+	})
+	if k < len(sorted) {
+		sorted = sorted[:k]
+	}
+	return &value{series: sorted}, nil
+}
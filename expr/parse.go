@@ -0,0 +1,366 @@
+// Package expr 解析并计算曲线上的四则运算和函数表达式, 如
+//
+//	host01:disk.used / host01:disk.total * 100
+//	rate(host01:net.if.in.bytes)
+//	topk(3, 'web-*:cpu.busy')
+//
+// 曲线引用的格式为 endpoint:counter, 省略endpoint时使用请求中默认的endpoint;
+// counter中含有 / = , * 等字符(如tag、通配符、正则)时需要用单引号或双引号括起来
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Node 表达式语法树的节点
+type Node interface {
+	String() string
+}
+
+type NumberNode struct {
+	Value float64
+}
+
+// RefNode 曲线引用, Endpoint为空时使用默认的endpoint; endpoint和counter可以含有通配符或/正则/
+type RefNode struct {
+	Endpoint string
+	Counter  string
+}
+
+type BinaryNode struct {
+	Op    byte
+	Left  Node
+	Right Node
+}
+
+type CallNode struct {
+	Fn   string
+	Args []Node
+}
+
+func (this *NumberNode) String() string {
+	return formatNumber(this.Value)
+}
+
+func (this *RefNode) String() string {
+	if this.Endpoint == "" {
+		return this.Counter
+	}
+	return this.Endpoint + ":" + this.Counter
+}
+
+func (this *BinaryNode) String() string {
+	return fmt.Sprintf("(%s %c %s)", this.Left, this.Op, this.Right)
+}
+
+func (this *CallNode) String() string {
+	args := make([]string, 0, len(this.Args))
+	for _, arg := range this.Args {
+		args = append(args, arg.String())
+	}
+	return fmt.Sprintf("%s(%s)", this.Fn, strings.Join(args, ", "))
+}
+
+// Parse 解析表达式
+func Parse(s string) (Node, error) {
+	p := &parser{lex: &lexer{src: s}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	node, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return node, nil
+}
+
+// Refs 返回表达式中的全部曲线引用, 按出现的顺序
+func Refs(node Node) []*RefNode {
+	switch n := node.(type) {
+	case *RefNode:
+		return []*RefNode{n}
+	case *BinaryNode:
+		return append(Refs(n.Left), Refs(n.Right)...)
+	case *CallNode:
+		var ret []*RefNode
+		for _, arg := range n.Args {
+			ret = append(ret, Refs(arg)...)
+		}
+		return ret
+	}
+	return nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokRef
+	tokIdent
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	pos  int
+	text string
+	num  float64
+	ref  *RefNode
+}
+
+func (this token) String() string {
+	if this.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(this.text)
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.'
+}
+
+// endpoint中允许出现'-', 如 web-01; counter和函数名中的'-'视为减号
+func isEndpointChar(c byte) bool {
+	return isWordChar(c) || c == '-'
+}
+
+func (this *lexer) scan(valid func(byte) bool) string {
+	start := this.pos
+	for this.pos < len(this.src) && valid(this.src[this.pos]) {
+		this.pos++
+	}
+	return this.src[start:this.pos]
+}
+
+func (this *lexer) skipSpace() {
+	for this.pos < len(this.src) && strings.IndexByte(" \t\r\n", this.src[this.pos]) >= 0 {
+		this.pos++
+	}
+}
+
+func (this *lexer) next() (token, error) {
+	this.skipSpace()
+	start := this.pos
+	if this.pos >= len(this.src) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+
+	c := this.src[this.pos]
+	switch {
+	case strings.IndexByte("+-*/", c) >= 0:
+		this.pos++
+		return token{kind: tokOp, pos: start, text: string(c)}, nil
+	case c == '(':
+		this.pos++
+		return token{kind: tokLParen, pos: start, text: "("}, nil
+	case c == ')':
+		this.pos++
+		return token{kind: tokRParen, pos: start, text: ")"}, nil
+	case c == ',':
+		this.pos++
+		return token{kind: tokComma, pos: start, text: ","}, nil
+	case c == '\'' || c == '"':
+		end := strings.IndexByte(this.src[this.pos+1:], c)
+		if end < 0 {
+			return token{}, fmt.Errorf("unterminated quote at %d", start)
+		}
+		text := this.src[this.pos+1 : this.pos+1+end]
+		this.pos += end + 2
+		ref := &RefNode{Counter: text}
+		if i := strings.IndexByte(text, ':'); i >= 0 {
+			ref = &RefNode{Endpoint: text[:i], Counter: text[i+1:]}
+		}
+		if ref.Counter == "" {
+			return token{}, fmt.Errorf("empty counter at %d", start)
+		}
+		return token{kind: tokRef, pos: start, text: this.src[start:this.pos], ref: ref}, nil
+	case isWordChar(c):
+		// endpoint:counter
+		endpoint := this.scan(isEndpointChar)
+		if this.pos < len(this.src) && this.src[this.pos] == ':' {
+			this.pos++
+			counter := this.scan(isWordChar)
+			if counter == "" {
+				return token{}, fmt.Errorf("empty counter at %d", start)
+			}
+			return token{kind: tokRef, pos: start, text: this.src[start:this.pos], ref: &RefNode{Endpoint: endpoint, Counter: counter}}, nil
+		}
+
+		this.pos = start
+		word := this.scan(isWordChar)
+		if c >= '0' && c <= '9' || c == '.' {
+			// 指数中的符号, 如 1e-5、2.5E+3
+			if last := word[len(word)-1]; (last == 'e' || last == 'E') && this.pos+1 < len(this.src) &&
+				(this.src[this.pos] == '-' || this.src[this.pos] == '+') && this.src[this.pos+1] >= '0' && this.src[this.pos+1] <= '9' {
+				this.pos++
+				this.scan(isWordChar)
+				word = this.src[start:this.pos]
+			}
+			num, err := strconv.ParseFloat(word, 64)
+			if err != nil {
+				return token{}, fmt.Errorf("invalid number %q at %d", word, start)
+			}
+			return token{kind: tokNumber, pos: start, text: word, num: num}, nil
+		}
+
+		// 后面紧跟'('的是函数名, 否则是省略了endpoint的counter
+		this.skipSpace()
+		if this.pos < len(this.src) && this.src[this.pos] == '(' {
+			return token{kind: tokIdent, pos: start, text: word}, nil
+		}
+		return token{kind: tokRef, pos: start, text: word, ref: &RefNode{Counter: word}}, nil
+	}
+	return token{}, fmt.Errorf("unexpected character %q at %d", c, start)
+}
+
+// parser 递归下降:
+//
+//	expr    = term {("+" | "-") term}
+//	term    = unary {("*" | "/") unary}
+//	unary   = "-" unary | primary
+//	primary = number | ref | ident "(" [expr {"," expr}] ")" | "(" expr ")"
+type parser struct {
+	lex *lexer
+	tok token
+}
+
+func (this *parser) next() error {
+	tok, err := this.lex.next()
+	if err != nil {
+		return err
+	}
+	this.tok = tok
+	return nil
+}
+
+func (this *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at %d", fmt.Sprintf(format, args...), this.tok.pos)
+}
+
+func (this *parser) parseExpr() (Node, error) {
+	left, err := this.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for this.tok.kind == tokOp && (this.tok.text == "+" || this.tok.text == "-") {
+		op := this.tok.text[0]
+		if err := this.next(); err != nil {
+			return nil, err
+		}
+		right, err := this.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryNode{Op: op, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (this *parser) parseTerm() (Node, error) {
+	left, err := this.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for this.tok.kind == tokOp && (this.tok.text == "*" || this.tok.text == "/") {
+		op := this.tok.text[0]
+		if err := this.next(); err != nil {
+			return nil, err
+		}
+		right, err := this.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryNode{Op: op, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (this *parser) parseUnary() (Node, error) {
+	if this.tok.kind == tokOp && this.tok.text == "-" {
+		if err := this.next(); err != nil {
+			return nil, err
+		}
+		node, err := this.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if num, ok := node.(*NumberNode); ok {
+			return &NumberNode{Value: -num.Value}, nil
+		}
+		return &BinaryNode{Op: '*', Left: &NumberNode{Value: -1}, Right: node}, nil
+	}
+	return this.parsePrimary()
+}
+
+func (this *parser) parsePrimary() (Node, error) {
+	tok := this.tok
+	switch tok.kind {
+	case tokNumber:
+		return &NumberNode{Value: tok.num}, this.next()
+	case tokRef:
+		return tok.ref, this.next()
+	case tokLParen:
+		if err := this.next(); err != nil {
+			return nil, err
+		}
+		node, err := this.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if this.tok.kind != tokRParen {
+			return nil, this.errorf("expected \")\", got %s", this.tok)
+		}
+		return node, this.next()
+	case tokIdent:
+		if _, ok := funcs[tok.text]; !ok {
+			return nil, this.errorf("unknown function %s", tok.text)
+		}
+		// 跳过函数名和'('
+		if err := this.next(); err != nil {
+			return nil, err
+		}
+		if err := this.next(); err != nil {
+			return nil, err
+		}
+
+		call := &CallNode{Fn: tok.text}
+		for this.tok.kind != tokRParen {
+			if len(call.Args) > 0 {
+				if this.tok.kind != tokComma {
+					return nil, this.errorf("expected \",\" or \")\", got %s", this.tok)
+				}
+				if err := this.next(); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := this.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			call.Args = append(call.Args, arg)
+		}
+		if n := funcs[call.Fn].args; len(call.Args) != n {
+			return nil, this.errorf("%s expects %d arguments, got %d", call.Fn, n, len(call.Args))
+		}
+		return call, this.next()
+	}
+	return nil, this.errorf("unexpected %s", tok)
+}
+
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
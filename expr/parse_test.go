@@ -0,0 +1,83 @@
+package expr
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected string
+	}{
+		{"1", "1"},
+		{"1.5e3", "1500"},
+		{"1e-5", "1e-05"},
+		{"2.5E+3 * x", "(2500 * x)"},
+		{".5", "0.5"},
+		{"-2", "-2"},
+		{"- cpu.idle", "(-1 * cpu.idle)"},
+		{"1 + 2 * 3", "(1 + (2 * 3))"},
+		{"(1 + 2) * 3", "((1 + 2) * 3)"},
+		{"1 - 2 - 3", "((1 - 2) - 3)"},
+		{"disk.used / disk.total * 100", "((disk.used / disk.total) * 100)"},
+		{"host01:cpu.idle - host02:cpu.idle", "(host01:cpu.idle - host02:cpu.idle)"},
+		{"web-01:cpu.idle", "web-01:cpu.idle"},
+		{"cpu.idle-1", "(cpu.idle - 1)"},
+		{"rate('web-*:net.if.in.bytes/iface=eth0') * 8", "(rate(web-*:net.if.in.bytes/iface=eth0) * 8)"},
+		{`"net.if.in.bytes/iface=eth0"`, "net.if.in.bytes/iface=eth0"},
+		{"topk(3, 'web-*:cpu.busy')", "topk(3, web-*:cpu.busy)"},
+		{"clamp(x, 0, 1e2)", "clamp(x, 0, 100)"},
+		{"moving_avg ( x , 5 )", "moving_avg(x, 5)"},
+	}
+	for _, c := range cases {
+		node, err := Parse(c.src)
+		if err != nil {
+			t.Errorf("%s: %v", c.src, err)
+			continue
+		}
+		if got := node.String(); got != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.src, c.expected, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 2",
+		"host01:",
+		"'host01:'",
+		"'unterminated",
+		"unknown(x)",
+		"rate(x, y)",
+		"rate(x y)",
+		"1e",
+		"1e-",
+		"5xx.count",
+		"x % 2",
+	}
+	for _, src := range cases {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+func TestRefs(t *testing.T) {
+	node, err := Parse("rate(host01:a) / b + topk(2, 'web-*:c')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := Refs(node)
+	expected := []RefNode{{"host01", "a"}, {"", "b"}, {"web-*", "c"}}
+	if len(refs) != len(expected) {
+		t.Fatalf("expected %d refs, got %d", len(expected), len(refs))
+	}
+	for i, ref := range refs {
+		if *ref != expected[i] {
+			t.Errorf("ref %d: expected %+v, got %+v", i, expected[i], *ref)
+		}
+	}
+}
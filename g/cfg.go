@@ -2,24 +2,98 @@ package g
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"sync"
 
 	"github.com/toolkits/file"
+
+	"github.com/jianvhen/query/htpasswd"
+	"github.com/jianvhen/query/pattern"
 )
 
 type HttpConfig struct {
-	Enabled bool   `json:"enabled"`
-	Listen  string `json:"listen"`
+	Enabled     bool   `json:"enabled"`
+	Listen      string `json:"listen"`
+	ReloadToken string `json:"reloadToken"`
 }
 
 type GraphConfig struct {
-	ConnTimeout int32             `json:"connTimeout"`
-	CallTimeout int32             `json:"callTimeout"`
-	MaxConns    int32             `json:"maxConns"`
-	MaxIdle     int32             `json:"maxIdle"`
-	Replicas    int32             `json:"replicas"`
-	Cluster     map[string]string `json:"cluster"`
+	ConnTimeout             int32             `json:"connTimeout"`
+	CallTimeout             int32             `json:"callTimeout"`
+	MaxConns                int32             `json:"maxConns"`
+	MaxIdle                 int32             `json:"maxIdle"`
+	Replicas                int32             `json:"replicas"`
+	MaxConcurrentPerNode    int32             `json:"maxConcurrentPerNode"`
+	MaxConcurrentPerRequest int32             `json:"maxConcurrentPerRequest"`
+	MaxRequestTimeout       int32             `json:"maxRequestTimeout"`
+	MaxStreamPoints         int64             `json:"maxStreamPoints"`
+	Cluster                 map[string]string `json:"cluster"`
+	Migrating               *MigratingConfig  `json:"migrating"`
+	Breaker                 *BreakerConfig    `json:"breaker"`
+	Cache                   *CacheConfig      `json:"cache"`
+}
+
+// 历史数据和最新数据的缓存, ttl和lastTtl的单位是秒
+type CacheConfig struct {
+	Enabled  bool `json:"enabled"`
+	MaxItems int  `json:"maxItems"`
+	TTL      int  `json:"ttl"`
+	LastTTL  int  `json:"lastTtl"`
+}
+
+// 每个graph节点的熔断器: window秒内调用数不少于minRequests, 且失败(出错或超时)比例达到errorRate时熔断,
+// 熔断openTimeout毫秒后放行一个探测调用
+type BreakerConfig struct {
+	Enabled     bool    `json:"enabled"`
+	Window      int32   `json:"window"`
+	MinRequests int32   `json:"minRequests"`
+	ErrorRate   float64 `json:"errorRate"`
+	OpenTimeout int32   `json:"openTimeout"`
+}
+
+// 迁移graph集群期间, transfer同时向新旧两个集群写数据, query同时读两个集群并合并结果
+type MigratingConfig struct {
+	Enabled    bool              `json:"enabled"`
+	OldCluster map[string]string `json:"oldCluster"`
+	NewCluster map[string]string `json:"newCluster"`
+}
+
+// 存活检测: 按心跳counter的最新上报时间判断endpoint是否存活, threshold的单位是秒;
+// groups按endpoint的模式(通配符或/正则/)设置各组的threshold, 按顺序匹配第一个
+type AliveConfig struct {
+	Counter   string        `json:"counter"`
+	Threshold int           `json:"threshold"`
+	Groups    []*AliveGroup `json:"groups"`
+}
+
+type AliveGroup struct {
+	Pattern   string `json:"pattern"`
+	Threshold int    `json:"threshold"`
+}
+
+// 认证与授权: 开启后除public中的路由外, 所有请求都需要通过tokens、hmacKeys或htpasswd之一的认证;
+// hmacMaxSkew为签名时间与服务器时间的最大偏差, 单位是秒; maxBodyBytes为认证时读取的请求body的上限, 超过时返回413
+type AuthConfig struct {
+	Enabled      bool             `json:"enabled"`
+	Public       []string         `json:"public"`
+	Tokens       []*AuthPrincipal `json:"tokens"`
+	HmacKeys     []*AuthPrincipal `json:"hmacKeys"`
+	HmacMaxSkew  int              `json:"hmacMaxSkew"`
+	Htpasswd     string           `json:"htpasswd"`
+	Users        []*AuthPrincipal `json:"users"`
+	MaxBodyBytes int64            `json:"maxBodyBytes"`
+}
+
+// 一个调用方: tokens中secret为静态token, hmacKeys中name为key id、secret为签名密钥, users中name为htpasswd中的用户名;
+// routes为可以访问的路由, 以/结尾时包括其下的所有路径; endpoints为可以读取的endpoint(通配符或/正则/); 为空时不限制
+type AuthPrincipal struct {
+	Name      string   `json:"name"`
+	Secret    string   `json:"secret"`
+	Routes    []string `json:"routes"`
+	Endpoints []string `json:"endpoints"`
 }
 
 type ApiConfig struct {
@@ -33,6 +107,8 @@ type GlobalConfig struct {
 	Http  *HttpConfig  `json:"http"`
 	Graph *GraphConfig `json:"graph"`
 	Api   *ApiConfig   `json:"api"`
+	Alive *AliveConfig `json:"alive"`
+	Auth  *AuthConfig  `json:"auth"`
 }
 
 var (
@@ -58,21 +134,160 @@ func ParseConfig(cfg string) {
 
 	ConfigFile = cfg
 
+	c, err := loadConfig(cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// set config
+	configLock.Lock()
+	defer configLock.Unlock()
+	config = c
+
+	log.Println("g.ParseConfig ok, file", cfg)
+}
+
+// ReloadConfig 重新读取配置文件, 校验通过后才替换当前配置; 校验失败时保留原配置
+func ReloadConfig() error {
+	c, err := loadConfig(ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	configLock.Lock()
+	old := config
+	config = c
+	configLock.Unlock()
+
+	if old != nil && old.Http.Listen != c.Http.Listen {
+		log.Println("g.ReloadConfig warning, http.listen changed, restart required to take effect")
+	}
+	log.Println("g.ReloadConfig ok, file", ConfigFile)
+	return nil
+}
+
+func loadConfig(cfg string) (*GlobalConfig, error) {
 	configContent, err := file.ToTrimString(cfg)
 	if err != nil {
-		log.Fatalln("read config file", cfg, "error:", err.Error())
+		return nil, fmt.Errorf("read config file %s error: %s", cfg, err.Error())
 	}
 
 	var c GlobalConfig
 	err = json.Unmarshal([]byte(configContent), &c)
 	if err != nil {
-		log.Fatalln("parse config file", cfg, "error:", err.Error())
+		return nil, fmt.Errorf("parse config file %s error: %s", cfg, err.Error())
 	}
 
-	// set config
-	configLock.Lock()
-	defer configLock.Unlock()
-	config = &c
+	err = checkConfig(&c)
+	if err != nil {
+		return nil, fmt.Errorf("check config file %s error: %s", cfg, err.Error())
+	}
 
-	log.Println("g.ParseConfig ok, file", cfg)
+	return &c, nil
+}
+
+func checkConfig(c *GlobalConfig) error {
+	if c.Http == nil {
+		return errors.New("http not configured")
+	}
+
+	if c.Graph == nil || len(c.Graph.Cluster) == 0 {
+		return errors.New("graph.cluster is empty")
+	}
+	if err := checkCluster("graph.cluster", c.Graph.Cluster); err != nil {
+		return err
+	}
+
+	if m := c.Graph.Migrating; m != nil && m.Enabled {
+		if len(m.OldCluster) == 0 || len(m.NewCluster) == 0 {
+			return errors.New("graph.migrating: oldCluster and newCluster are required")
+		}
+		if err := checkCluster("graph.migrating.oldCluster", m.OldCluster); err != nil {
+			return err
+		}
+		if err := checkCluster("graph.migrating.newCluster", m.NewCluster); err != nil {
+			return err
+		}
+	}
+
+	if a := c.Auth; a != nil && a.Enabled {
+		if err := checkAuth(a); err != nil {
+			return err
+		}
+	}
+
+	if c.Alive != nil {
+		if err := checkAlive(c.Alive); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkAlive(a *AliveConfig) error {
+	for i, group := range a.Groups {
+		if group == nil {
+			continue
+		}
+		if group.Threshold <= 0 {
+			return fmt.Errorf("alive.groups[%d]: invalid threshold of group %s", i, group.Pattern)
+		}
+		if _, err := pattern.Compile(group.Pattern); err != nil {
+			return fmt.Errorf("alive.groups[%d]: bad group pattern %s: %v", i, group.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// checkAuth 与auth.New一样编译endpoint规则、读取htpasswd文件, 不能加载的配置在启动和热加载时就被拒绝
+func checkAuth(a *AuthConfig) error {
+	if len(a.Tokens) == 0 && len(a.HmacKeys) == 0 && a.Htpasswd == "" {
+		return errors.New("auth: one of tokens, hmacKeys and htpasswd is required")
+	}
+	for name, principals := range map[string][]*AuthPrincipal{"tokens": a.Tokens, "hmacKeys": a.HmacKeys} {
+		for i, p := range principals {
+			if p == nil || p.Name == "" || p.Secret == "" {
+				return fmt.Errorf("auth.%s[%d]: name and secret are required", name, i)
+			}
+			if err := checkEndpointRules(p); err != nil {
+				return fmt.Errorf("auth.%s[%d]: %v", name, i, err)
+			}
+		}
+	}
+	for i, p := range a.Users {
+		if p == nil || p.Name == "" {
+			return fmt.Errorf("auth.users[%d]: name is required", i)
+		}
+		if err := checkEndpointRules(p); err != nil {
+			return fmt.Errorf("auth.users[%d]: %v", i, err)
+		}
+	}
+	if a.Htpasswd != "" {
+		if !file.IsExist(a.Htpasswd) {
+			return fmt.Errorf("auth.htpasswd: %s not found", a.Htpasswd)
+		}
+		if _, err := htpasswd.Load(a.Htpasswd); err != nil {
+			return fmt.Errorf("auth.htpasswd: %v", err)
+		}
+	}
+	return nil
+}
+
+func checkEndpointRules(p *AuthPrincipal) error {
+	for _, endpoint := range p.Endpoints {
+		if _, err := pattern.Compile(endpoint); err != nil {
+			return fmt.Errorf("bad endpoint pattern %s of %s: %v", endpoint, p.Name, err)
+		}
+	}
+	return nil
+}
+
+func checkCluster(name string, cluster map[string]string) error {
+	for node, addr := range cluster {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("%s.%s: bad address %q", name, node, addr)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,53 @@
+package g
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	goodHtpasswd, badHtpasswd := filepath.Join(dir, "good"), filepath.Join(dir, "bad")
+	ioutil.WriteFile(goodHtpasswd, []byte("alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0644)
+	ioutil.WriteFile(badHtpasswd, []byte("alice\n"), 0644)
+
+	base := `"http": {"enabled": false}, "graph": {"cluster": {"graph-00": "127.0.0.1:6070"}}`
+	cases := []struct {
+		name string
+		cfg  string
+		err  string
+	}{
+		{"ok", base, ""},
+		{"no http", `"graph": {"cluster": {"graph-00": "127.0.0.1:6070"}}`, "http not configured"},
+		{"bad address", `"http": {}, "graph": {"cluster": {"graph-00": "127.0.0.1"}}`, "bad address"},
+		{"alive groups", base + `, "alive": {"groups": [{"pattern": "web-*", "threshold": 60}, {"pattern": "/db-\\d+/", "threshold": 300}]}`, ""},
+		{"bad alive pattern", base + `, "alive": {"groups": [{"pattern": "/web-(/", "threshold": 60}]}`, "alive.groups[0]: bad group pattern"},
+		{"bad alive threshold", base + `, "alive": {"groups": [{"pattern": "web-*"}]}`, "alive.groups[0]: invalid threshold"},
+		{"auth without credentials", base + `, "auth": {"enabled": true}`, "one of tokens, hmacKeys and htpasswd is required"},
+		{"auth", base + `, "auth": {"enabled": true, "tokens": [{"name": "ops", "secret": "s", "endpoints": ["web-*", "/^db\\d+$/"]}], "htpasswd": "` + goodHtpasswd + `"}`, ""},
+		{"bad token endpoint", base + `, "auth": {"enabled": true, "tokens": [{"name": "ops", "secret": "s", "endpoints": ["/web-(/"]}]}`, "auth.tokens[0]: bad endpoint pattern"},
+		{"bad user endpoint", base + `, "auth": {"enabled": true, "htpasswd": "` + goodHtpasswd + `", "users": [{"name": "alice", "endpoints": ["/web-(/"]}]}`, "auth.users[0]: bad endpoint pattern"},
+		{"bad htpasswd", base + `, "auth": {"enabled": true, "htpasswd": "` + badHtpasswd + `"}`, "bad htpasswd line"},
+	}
+	for _, c := range cases {
+		var cfg GlobalConfig
+		if err := json.Unmarshal([]byte("{"+c.cfg+"}"), &cfg); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		err := checkConfig(&cfg)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: expected %q, got %v", c.name, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package graph
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+	spool "github.com/toolkits/pool/simple_conn_pool"
+
+	"github.com/jianvhen/query/g"
+)
+
+const (
+	defaultMaxConcurrentPerNode    = 8
+	defaultMaxConcurrentPerRequest = 64
+)
+
+// 每个graph节点上所有请求共享的并发槽位, 容量为maxConcurrentPerNode; 调用发出前取得, rpc返回后归还
+var (
+	nodeSlots     = make(map[string]chan struct{})
+	nodeSlotsLock = new(sync.Mutex)
+)
+
+// slotsOf 返回addr的并发槽位; maxConcurrentPerNode变更后新的调用使用新的槽位, 已取得旧槽位的调用归还到旧槽位
+func slotsOf(addr string) chan struct{} {
+	size := int(g.Config().Graph.MaxConcurrentPerNode)
+	if size <= 0 {
+		size = defaultMaxConcurrentPerNode
+	}
+
+	nodeSlotsLock.Lock()
+	defer nodeSlotsLock.Unlock()
+	slots, found := nodeSlots[addr]
+	if !found || cap(slots) != size {
+		slots = make(chan struct{}, size)
+		nodeSlots[addr] = slots
+	}
+	return slots
+}
+
+// pruneNodeSlots 删除已经不在集群中的节点的槽位
+func pruneNodeSlots(addrs map[string]bool) {
+	nodeSlotsLock.Lock()
+	defer nodeSlotsLock.Unlock()
+	for addr := range nodeSlots {
+		if !addrs[addr] {
+			delete(nodeSlots, addr)
+		}
+	}
+}
+
+// QueryMany 批量查询历史数据
+// 按一致性哈希选出的graph节点对请求分组, 各节点之间并发执行, 互不阻塞;
+// 返回的结果、错误与params一一对应, 顺序与请求一致
+func QueryMany(ctx context.Context, params []cmodel.GraphQueryParam) ([]*cmodel.GraphQueryResponse, []error) {
+	return querySegments(ctx, params, nil)
+}
+
+// querySegments 与QueryMany相同; segSteps与params一一对应, 为分段查询中各段所在rra的步长,
+// 同一曲线的各段按它分开缓存. segSteps为nil或其中为0的查询不是分段查询
+func querySegments(ctx context.Context, params []cmodel.GraphQueryParam, segSteps []int64) ([]*cmodel.GraphQueryResponse, []error) {
+	if cfg := cacheConfig(); cfg != nil {
+		return cachedQueryMany(ctx, params, segSteps, cfg)
+	}
+	return queryManyNoCache(ctx, params)
+}
+
+func queryManyNoCache(ctx context.Context, params []cmodel.GraphQueryParam) ([]*cmodel.GraphQueryResponse, []error) {
+	if m := migratingState(); m != nil {
+		return queryManyMigrating(ctx, params, m)
+	}
+	return queryMany(ctx, params, selectAddr)
+}
+
+func queryMany(ctx context.Context, params []cmodel.GraphQueryParam, selector addrSelector) ([]*cmodel.GraphQueryResponse, []error) {
+	replies, errs := callMany(ctx, "Graph.Query", selector, len(params),
+		func(i int) (string, string) { return params[i].Endpoint, params[i].Counter },
+		func(i int) interface{} { return params[i] },
+		func() interface{} { return &cmodel.GraphQueryResponse{} },
+	)
+
+	resps := make([]*cmodel.GraphQueryResponse, len(params))
+	for i, reply := range replies {
+		if reply == nil {
+			continue
+		}
+		resp := reply.(*cmodel.GraphQueryResponse)
+		if errs[i] == nil {
+			fixQueryResponse(params[i], resp)
+		}
+		resps[i] = resp
+	}
+	return resps, errs
+}
+
+// InfoMany 批量查询rrd文件信息, 与Info的结果一致
+func InfoMany(ctx context.Context, params []cmodel.GraphInfoParam) ([]*cmodel.GraphFullyInfo, []error) {
+	replies, errs := callMany(ctx, "Graph.Info", selectAddr, len(params),
+		func(i int) (string, string) { return params[i].Endpoint, params[i].Counter },
+		func(i int) interface{} { return params[i] },
+		func() interface{} { return &cmodel.GraphInfoResp{} },
+	)
+
+	infos := make([]*cmodel.GraphFullyInfo, len(params))
+	for i, reply := range replies {
+		if reply == nil || errs[i] != nil {
+			continue
+		}
+		resp := reply.(*cmodel.GraphInfoResp)
+		addr, _ := Addr(params[i].Endpoint, params[i].Counter)
+		infos[i] = &cmodel.GraphFullyInfo{
+			Endpoint:  params[i].Endpoint,
+			Counter:   params[i].Counter,
+			ConsolFun: resp.ConsolFun,
+			Step:      resp.Step,
+			Filename:  resp.Filename,
+			Addr:      addr,
+		}
+	}
+	return infos, errs
+}
+
+// LastMany 批量查询最新上报的数据点
+func LastMany(ctx context.Context, params []cmodel.GraphLastParam) ([]*cmodel.GraphLastResp, []error) {
+	if cfg := cacheConfig(); cfg != nil {
+		return cachedLastMany(ctx, params, cfg)
+	}
+	return lastMany(ctx, "Graph.Last", params)
+}
+
+// LastRawMany 批量查询最新上报的原始数据点
+func LastRawMany(ctx context.Context, params []cmodel.GraphLastParam) ([]*cmodel.GraphLastResp, []error) {
+	return lastMany(ctx, "Graph.LastRaw", params)
+}
+
+func lastMany(ctx context.Context, method string, params []cmodel.GraphLastParam) ([]*cmodel.GraphLastResp, []error) {
+	replies, errs := callMany(ctx, method, selectAddr, len(params),
+		func(i int) (string, string) { return params[i].Endpoint, params[i].Counter },
+		func(i int) interface{} { return params[i] },
+		func() interface{} { return &cmodel.GraphLastResp{} },
+	)
+
+	resps := make([]*cmodel.GraphLastResp, len(params))
+	for i, reply := range replies {
+		if reply == nil {
+			continue
+		}
+		resps[i] = reply.(*cmodel.GraphLastResp)
+	}
+	return resps, errs
+}
+
+// Addr 返回endpoint/counter所在的graph节点地址
+func Addr(endpoint, counter string) (string, error) {
+	clusterLock.RLock()
+	defer clusterLock.RUnlock()
+	return selectAddr(endpoint, counter)
+}
+
+// callMany 按selector选出的graph节点对n个调用分组, 每组只占用一个连接, 以pipeline的方式发出rpc调用;
+// 返回的replies/errs与下标一一对应
+func callMany(ctx context.Context, method string, selector addrSelector, n int, key func(i int) (string, string),
+	args func(i int) interface{}, newReply func() interface{}) ([]interface{}, []error) {
+	replies := make([]interface{}, n)
+	errs := make([]error, n)
+	// 每个下标只会被deliver一次, 不同下标之间不需要加锁
+	callManyFunc(ctx, method, selector, n, key, args, newReply, func(i int, reply interface{}, err error) {
+		replies[i] = reply
+		errs[i] = err
+	})
+	return replies, errs
+}
+
+// callManyFunc 与callMany相同, 但每个调用结束时立即调用deliver, 而不是等全部调用结束;
+// deliver在各节点的goroutine中并发执行; deliver阻塞时该节点暂停发出新的调用
+func callManyFunc(ctx context.Context, method string, selector addrSelector, n int, key func(i int) (string, string),
+	args func(i int) interface{}, newReply func() interface{}, deliver func(i int, reply interface{}, err error)) {
+	groups := make(map[string][]int)
+	var failed []int
+	var failedErrs []error
+	clusterLock.RLock()
+	for i := 0; i < n; i++ {
+		endpoint, counter := key(i)
+		addr, err := selector(endpoint, counter)
+		if err != nil {
+			failed = append(failed, i)
+			failedErrs = append(failedErrs, err)
+			continue
+		}
+		groups[addr] = append(groups[addr], i)
+	}
+	clusterLock.RUnlock()
+
+	for j, i := range failed {
+		deliver(i, nil, failedErrs[j])
+	}
+	if len(groups) == 0 {
+		return
+	}
+
+	depth := fanoutPerNode(len(groups))
+	done := make(chan struct{}, len(groups))
+	for addr, idxs := range groups {
+		go func(addr string, idxs []int) {
+			pipeline(ctx, addr, method, depth, idxs, args, newReply, deliver)
+			done <- struct{}{}
+		}(addr, idxs)
+	}
+	for i := 0; i < len(groups); i++ {
+		<-done
+	}
+}
+
+// pipeline 在同一个连接上并发发出一组rpc调用, 同时在途(含已返回但还没有deliver)的调用数不超过depth,
+// 且每个调用都要先取得节点的共享槽位, 所有请求在该节点上在途的调用数不超过maxConcurrentPerNode;
+// 超过CallTimeout没有任何调用返回(包括等待槽位的时间), 则认为该节点超时, 剩余的调用全部失败.
+// 熔断器半开时只发出第一个调用作为探测, 其余的调用按熔断返回CircuitOpenError
+func pipeline(ctx context.Context, addr string, method string, depth int, idxs []int, args func(i int) interface{},
+	newReply func() interface{}, deliver func(i int, reply interface{}, err error)) {
+	fail := func(err error) {
+		for _, i := range idxs {
+			deliver(i, nil, err)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		fail(ctxError(addr, ctx))
+		return
+	}
+
+	clusterLock.RLock()
+	pool, done, probe, err := acquire(addr)
+	clusterLock.RUnlock()
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer done()
+
+	if probe && len(idxs) > 1 {
+		for _, i := range idxs[1:] {
+			deliver(i, nil, &CircuitOpenError{Addr: addr})
+		}
+		idxs = idxs[:1]
+	}
+
+	conn, err := pool.Fetch()
+	if err != nil {
+		recordCall(addr, true)
+		fail(newCallError(addr, err.Error()))
+		return
+	}
+
+	rpcConn := conn.(spool.RpcClient)
+	if rpcConn.Closed() {
+		recordCall(addr, true)
+		forceClose(addr, pool, conn)
+		fail(newCallError(addr, "conn closed"))
+		return
+	}
+
+	type ChResult struct {
+		Idx   int
+		Err   error
+		Reply interface{}
+		Start time.Time
+	}
+
+	ch := make(chan *ChResult, len(idxs))
+	stop := make(chan struct{})
+	sem := make(chan struct{}, depth)
+	slots := slotsOf(addr)
+	var sent int32 // 已经发出、还没有返回的调用数
+	go func() {
+		for _, i := range idxs {
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				return
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-stop:
+				return
+			}
+			atomic.AddInt32(&sent, 1)
+			go func(i int) {
+				start := time.Now()
+				reply := newReply()
+				err := rpcConn.Call(method, args(i), reply)
+				<-slots
+				ch <- &ChResult{Idx: i, Err: err, Reply: reply, Start: start}
+			}(i)
+		}
+	}()
+
+	timeout := time.Duration(g.Config().Graph.CallTimeout) * time.Millisecond
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	pending := make(map[int]bool, len(idxs))
+	for _, i := range idxs {
+		pending[i] = true
+	}
+	failed := false
+	for len(pending) > 0 {
+		waitStart := time.Now()
+		select {
+		case <-timer.C:
+			close(stop)
+			forceClose(addr, pool, conn)
+			// 节点超时只记录一次, 且只在有调用已经发出时记录; 还在等待槽位、没有发出的调用不计入节点的超时和熔断
+			if atomic.LoadInt32(&sent) > 0 {
+				statCall(addr, waitStart, nil, true)
+			}
+			err := callTimeoutError(addr, pool)
+			for i := range pending {
+				deliver(i, nil, err)
+			}
+			return
+		case <-ctx.Done():
+			// 请求被取消或超过请求的deadline: 不再发出剩余的调用, 关闭连接中断在途的调用, 不计入节点的失败
+			close(stop)
+			forceClose(addr, pool, conn)
+			err := ctxError(addr, ctx)
+			for i := range pending {
+				deliver(i, nil, err)
+			}
+			return
+		case r := <-ch:
+			<-sem
+			atomic.AddInt32(&sent, -1)
+			statCall(addr, r.Start, r.Err, false)
+			delete(pending, r.Idx)
+			var err error
+			if r.Err != nil {
+				failed = true
+				err = callFailedError(addr, pool, r.Err)
+			}
+			deliver(r.Idx, r.Reply, err)
+
+			// deliver可能因为调用方输出慢而阻塞, 返回之后再重新计算超时
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(timeout)
+		}
+	}
+
+	if failed {
+		forceClose(addr, pool, conn)
+	} else {
+		pool.Release(conn)
+	}
+}
+
+// fanoutPerNode 单个请求在每个节点上的并发数(请求内的扇出): 不超过maxConcurrentPerNode,
+// 且所有节点的总和不超过maxConcurrentPerRequest(每个节点至少1个); 多个请求共享的节点上限由slotsOf保证
+func fanoutPerNode(nodes int) int {
+	cfg := g.Config().Graph
+
+	perNode := int(cfg.MaxConcurrentPerNode)
+	if perNode <= 0 {
+		perNode = defaultMaxConcurrentPerNode
+	}
+	perRequest := int(cfg.MaxConcurrentPerRequest)
+	if perRequest <= 0 {
+		perRequest = defaultMaxConcurrentPerRequest
+	}
+
+	n := perRequest / nodes
+	if n > perNode {
+		n = perNode
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
@@ -0,0 +1,193 @@
+package graph
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jianvhen/query/g"
+)
+
+// 熔断器的状态
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+const (
+	defaultBreakerWindow      = 10
+	defaultBreakerMinRequests = 20
+	defaultBreakerErrorRate   = 0.5
+	defaultBreakerOpenTimeout = 5000
+)
+
+// CircuitOpenError graph节点被熔断时, 调用直接返回该错误, 不再等待CallTimeout
+type CircuitOpenError struct {
+	Addr string
+}
+
+func (this *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s, circuit open", this.Addr)
+}
+
+// 每个graph地址一个熔断器
+// 统计窗口内失败(出错或超时)的比例超过阈值后熔断, 熔断openTimeout之后进入半开状态, 只放行一个探测调用;
+// 探测成功则恢复, 失败则继续熔断
+type breaker struct {
+	sync.Mutex
+	addr        string
+	state       string
+	windowStart time.Time
+	total       int32
+	failures    int32
+	openedAt    time.Time
+	probeAt     time.Time
+}
+
+var (
+	breakers     = make(map[string]*breaker)
+	breakersLock = new(sync.Mutex)
+)
+
+func breakerOf(addr string) *breaker {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+
+	b, found := breakers[addr]
+	if !found {
+		b = &breaker{addr: addr, state: CircuitClosed, windowStart: time.Now()}
+		breakers[addr] = b
+	}
+	return b
+}
+
+// pruneBreakers 删除已经不在集群中的地址的熔断器
+func pruneBreakers(addrs map[string]bool) {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	for addr := range breakers {
+		if !addrs[addr] {
+			delete(breakers, addr)
+		}
+	}
+}
+
+// CircuitState 返回addr的熔断器状态
+func CircuitState(addr string) string {
+	if cfg := g.Config().Graph.Breaker; cfg == nil || !cfg.Enabled {
+		return CircuitClosed
+	}
+
+	b := breakerOf(addr)
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
+
+// allowCall 判断是否允许向addr发起调用; probe为true时熔断器处于半开状态, 只能发出一个探测调用
+func allowCall(addr string) (probe bool, err error) {
+	cfg := g.Config().Graph.Breaker
+	if cfg == nil || !cfg.Enabled {
+		return false, nil
+	}
+	return breakerOf(addr).allow(cfg)
+}
+
+// recordCall 记录一次调用的结果
+func recordCall(addr string, failed bool) {
+	cfg := g.Config().Graph.Breaker
+	if cfg == nil || !cfg.Enabled {
+		return
+	}
+	breakerOf(addr).record(cfg, failed)
+}
+
+// allow 判断是否放行调用; 放行半开状态的探测调用时probe为true
+func (this *breaker) allow(cfg *g.BreakerConfig) (probe bool, err error) {
+	this.Lock()
+	defer this.Unlock()
+
+	now := time.Now()
+	openTimeout := time.Duration(cfg.OpenTimeout) * time.Millisecond
+	if openTimeout <= 0 {
+		openTimeout = defaultBreakerOpenTimeout * time.Millisecond
+	}
+	switch this.state {
+	case CircuitOpen:
+		if now.Sub(this.openedAt) < openTimeout {
+			return false, &CircuitOpenError{Addr: this.addr}
+		}
+		this.state = CircuitHalfOpen
+		this.probeAt = now
+		return true, nil
+	case CircuitHalfOpen:
+		// 探测调用还没有结果; 超过openTimeout仍没有结果, 则认为探测丢失, 再放行一个
+		if now.Sub(this.probeAt) < openTimeout {
+			return false, &CircuitOpenError{Addr: this.addr}
+		}
+		this.probeAt = now
+		return true, nil
+	}
+	return false, nil
+}
+
+func (this *breaker) record(cfg *g.BreakerConfig, failed bool) {
+	this.Lock()
+	defer this.Unlock()
+
+	now := time.Now()
+	switch this.state {
+	case CircuitOpen:
+		// 熔断之前发出的调用, 忽略
+		return
+	case CircuitHalfOpen:
+		if failed {
+			this.open(now)
+		} else {
+			log.Println("graph.breaker closed:", this.addr)
+			this.state = CircuitClosed
+			this.reset(now)
+		}
+		return
+	}
+
+	window := time.Duration(cfg.Window) * time.Second
+	if window <= 0 {
+		window = defaultBreakerWindow * time.Second
+	}
+	if now.Sub(this.windowStart) > window {
+		this.reset(now)
+	}
+
+	this.total++
+	if failed {
+		this.failures++
+	}
+
+	minRequests := cfg.MinRequests
+	if minRequests <= 0 {
+		minRequests = defaultBreakerMinRequests
+	}
+	errorRate := cfg.ErrorRate
+	if errorRate <= 0 {
+		errorRate = defaultBreakerErrorRate
+	}
+	if this.total >= minRequests && float64(this.failures)/float64(this.total) >= errorRate {
+		this.open(now)
+	}
+}
+
+func (this *breaker) open(now time.Time) {
+	log.Printf("graph.breaker open: %s, failures: %d/%d", this.addr, this.failures, this.total)
+	this.state = CircuitOpen
+	this.openedAt = now
+	this.reset(now)
+}
+
+func (this *breaker) reset(now time.Time) {
+	this.windowStart = now
+	this.total = 0
+	this.failures = 0
+}
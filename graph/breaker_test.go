@@ -0,0 +1,171 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/g"
+	"github.com/jianvhen/query/proc"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+	cfg := &g.BreakerConfig{Enabled: true, Window: 10, MinRequests: 4, ErrorRate: 0.5, OpenTimeout: 50}
+	b := &breaker{addr: "graph-test", state: CircuitClosed, windowStart: time.Now()}
+
+	// 调用数不足minRequests时不熔断
+	for i := 0; i < 3; i++ {
+		b.record(cfg, true)
+	}
+	if _, err := b.allow(cfg); b.state != CircuitClosed || err != nil {
+		t.Fatalf("expected closed below minRequests, got %s", b.state)
+	}
+
+	// 失败比例达到errorRate后熔断, 调用直接返回CircuitOpenError
+	b.record(cfg, false)
+	if b.state != CircuitOpen {
+		t.Fatalf("expected open, got %s", b.state)
+	}
+	if _, err := b.allow(cfg); !isCircuitOpen(err) {
+		t.Fatal("expected CircuitOpenError while open")
+	}
+	// 熔断之前发出的调用的结果被忽略
+	b.record(cfg, false)
+	if b.state != CircuitOpen {
+		t.Fatalf("expected open, got %s", b.state)
+	}
+
+	// openTimeout之后半开, 只放行一个探测调用; 探测失败继续熔断
+	time.Sleep(60 * time.Millisecond)
+	if probe, err := b.allow(cfg); err != nil || !probe || b.state != CircuitHalfOpen {
+		t.Fatalf("expected half-open probe, got %s %v", b.state, err)
+	}
+	if _, err := b.allow(cfg); err == nil {
+		t.Fatal("expected only one probe while half-open")
+	}
+	b.record(cfg, true)
+	if b.state != CircuitOpen {
+		t.Fatalf("expected open after failed probe, got %s", b.state)
+	}
+
+	// 探测成功则恢复, 统计重新开始
+	time.Sleep(60 * time.Millisecond)
+	if _, err := b.allow(cfg); err != nil {
+		t.Fatal(err)
+	}
+	b.record(cfg, false)
+	if b.state != CircuitClosed || b.total != 0 || b.failures != 0 {
+		t.Fatalf("expected closed with reset window, got %s %d/%d", b.state, b.failures, b.total)
+	}
+}
+
+func isCircuitOpen(err error) bool {
+	_, ok := err.(*CircuitOpenError)
+	return ok
+}
+
+func TestBreakerWindow(t *testing.T) {
+	cfg := &g.BreakerConfig{Enabled: true, Window: 1, MinRequests: 2, ErrorRate: 0.5}
+	b := &breaker{addr: "graph-test", state: CircuitClosed, windowStart: time.Now().Add(-2 * time.Second)}
+	b.total, b.failures = 10, 1
+
+	// 窗口过期后重新统计, 之前的成功调用不再稀释失败比例
+	b.record(cfg, true)
+	b.record(cfg, true)
+	if b.state != CircuitOpen {
+		t.Fatalf("expected open, got %s", b.state)
+	}
+}
+
+func TestPruneBreakers(t *testing.T) {
+	breakerOf("graph-a")
+	breakerOf("graph-b")
+	pruneBreakers(map[string]bool{"graph-a": true})
+
+	breakersLock.Lock()
+	_, foundA := breakers["graph-a"]
+	_, foundB := breakers["graph-b"]
+	breakersLock.Unlock()
+	if !foundA || foundB {
+		t.Fatalf("expected only graph-a left, got %v %v", foundA, foundB)
+	}
+}
+
+func queryParams(n int) []cmodel.GraphQueryParam {
+	params := make([]cmodel.GraphQueryParam, n)
+	for i := range params {
+		params[i] = cmodel.GraphQueryParam{Endpoint: fmt.Sprintf("host%02d", i), Counter: "cpu.idle", ConsolFun: "AVERAGE", Start: 60, End: 180}
+	}
+	return params
+}
+
+func TestPipelineHalfOpenProbe(t *testing.T) {
+	fakeGraph.Reset()
+	defer withGraphConfig(t, "breaker", `{"enabled": true, "openTimeout": 50}`)()
+	defer pruneBreakers(map[string]bool{})
+
+	b := breakerOf(fakeGraph.Addr)
+	b.Lock()
+	b.open(time.Now().Add(-time.Second))
+	b.Unlock()
+
+	// 半开时一组调用中只发出一个探测调用, 其余的按熔断返回
+	_, errs := QueryMany(context.Background(), queryParams(5))
+	if n := fakeGraph.Calls("Graph.Query"); n != 1 {
+		t.Fatalf("expected 1 probe call, got %d", n)
+	}
+	if errs[0] != nil {
+		t.Fatalf("unexpected probe error: %v", errs[0])
+	}
+	for i, err := range errs[1:] {
+		if !isCircuitOpen(err) {
+			t.Fatalf("call %d: expected CircuitOpenError, got %v", i+1, err)
+		}
+	}
+
+	// 探测成功后恢复
+	if state := CircuitState(fakeGraph.Addr); state != CircuitClosed {
+		t.Fatalf("expected closed after probe, got %s", state)
+	}
+	_, errs = QueryMany(context.Background(), queryParams(5))
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("call %d: unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestPipelineTimeoutStats(t *testing.T) {
+	fakeGraph.Reset()
+	// 等fakeGraph上还在等待的调用结束, 不影响之后统计在途调用数的测试
+	defer time.Sleep(300 * time.Millisecond)
+	defer fakeGraph.SetLatency(0)
+	defer withGraphConfig(t, "callTimeout", `100`)()
+	defer withGraphConfig(t, "breaker", `{"enabled": true, "minRequests": 100}`)()
+	defer pruneBreakers(map[string]bool{})
+
+	// 每个节点同时只发出testMaxConcurrentPerNode个调用, 节点超时时其余的调用还没有发出
+	fakeGraph.SetLatency(300 * time.Millisecond)
+	before := proc.GraphCallTimeoutCnt.Get()[fakeGraph.Addr]
+	_, errs := QueryMany(context.Background(), queryParams(6))
+	for i, err := range errs {
+		if status, _ := ErrorStatus(err); status != StatusTimeout {
+			t.Fatalf("call %d: expected timeout, got %v", i, err)
+		}
+	}
+
+	// 一次节点超时只记录一次
+	if n := proc.GraphCallTimeoutCnt.Get()[fakeGraph.Addr] - before; n != 1 {
+		t.Fatalf("expected 1 timeout, got %d", n)
+	}
+	b := breakerOf(fakeGraph.Addr)
+	b.Lock()
+	total, failures := b.total, b.failures
+	b.Unlock()
+	if total != 1 || failures != 1 {
+		t.Fatalf("expected 1 failure of 1 call, got %d/%d", failures, total)
+	}
+}
@@ -0,0 +1,349 @@
+package graph
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/g"
+	"github.com/jianvhen/query/proc"
+)
+
+const (
+	defaultCacheMaxItems = 100000
+	defaultCacheTTL      = 600
+	defaultCacheLastTTL  = 10
+)
+
+// 历史数据和最新数据的缓存
+// 历史数据按endpoint/counter/cf缓存已经结束的rrd步长(最新的两个点可能还会变化), 分段查询的各段另按所在rra的步长分开缓存,
+// 查询的时间范围落在缓存中的部分直接从缓存中截取, 只向graph查询缓存之后的部分
+var (
+	historyCache = newLruCache()
+	lastCache    = newLruCache()
+)
+
+type historyKey struct {
+	Endpoint string
+	Counter  string
+	CF       string
+	SegStep  int64 // 分段查询中该段所在rra的步长, 不是分段查询时为0
+}
+
+type historyEntry struct {
+	resp      *cmodel.GraphQueryResponse // 只包含[start, closedEnd]之间的数据点
+	start     int64
+	closedEnd int64
+	age       int64 // 第一次查询时start距当前的时间
+	tailable  bool  // 增量查询返回的step与缓存不一致时, 不再做增量查询
+}
+
+// covers 判断从start开始的查询能否使用缓存: graph按起点距当前的时间选择rra, 起点越早分辨率越低;
+// 起点不早于缓存的起点, 且距当前的时间不小于缓存查询时的距离, 缓存的分辨率就不会低于直接查询graph
+func (this *historyEntry) covers(start, now int64) bool {
+	return start >= this.start && start <= this.closedEnd && now-start >= this.age
+}
+
+func cacheConfig() *g.CacheConfig {
+	cfg := g.Config().Graph.Cache
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	return cfg
+}
+
+// PurgeCache 清空缓存(包括分段查询使用的步长); endpoint不为空时只清除该endpoint的缓存, 返回清除的条数
+func PurgeCache(endpoint string) int {
+	n := historyCache.purge(func(key interface{}) bool {
+		return endpoint == "" || key.(historyKey).Endpoint == endpoint
+	})
+	n += lastCache.purge(func(key interface{}) bool {
+		return endpoint == "" || key.(cmodel.GraphLastParam).Endpoint == endpoint
+	})
+	n += stepCache.purge(func(key interface{}) bool {
+		return endpoint == "" || key.(cmodel.GraphInfoParam).Endpoint == endpoint
+	})
+	return n
+}
+
+// cachedQueryMany 先查缓存, 只向graph查询未命中的部分; 结果与queryManyNoCache一致
+func cachedQueryMany(ctx context.Context, params []cmodel.GraphQueryParam, segSteps []int64, cfg *g.CacheConfig) ([]*cmodel.GraphQueryResponse, []error) {
+	resps := make([]*cmodel.GraphQueryResponse, len(params))
+	errs := make([]error, len(params))
+	keys := make([]historyKey, len(params))
+	for i, para := range params {
+		keys[i] = historyKey{Endpoint: para.Endpoint, Counter: para.Counter, CF: para.ConsolFun}
+		if segSteps != nil {
+			keys[i].SegStep = segSteps[i]
+		}
+	}
+
+	now := time.Now().Unix()
+	fetches := []cmodel.GraphQueryParam{}
+	fetchIdxs := []int{}
+	entries := []*historyEntry{} // 增量查询时为缓存项, 否则为nil
+	tailables := []bool{}        // 重新查询全部时, 结果能否再做增量查询
+	for i, para := range params {
+		var e *historyEntry
+		if v, found := historyCache.get(keys[i]); found && v.(*historyEntry).covers(para.Start, now) {
+			e = v.(*historyEntry)
+		}
+		if e == nil {
+			proc.HistoryCacheMissCnt.Incr()
+			fetches = append(fetches, para)
+			fetchIdxs = append(fetchIdxs, i)
+			entries = append(entries, nil)
+			tailables = append(tailables, true)
+			continue
+		}
+
+		proc.HistoryCacheHitCnt.Incr()
+		if para.End <= e.closedEnd {
+			resps[i] = sliceQueryResponse(e.resp, para.Start, para.End)
+			continue
+		}
+		tailable := e.tailable
+		if tailable {
+			para.Start = e.closedEnd + 1
+		} else {
+			e = nil
+		}
+		fetches = append(fetches, para)
+		fetchIdxs = append(fetchIdxs, i)
+		entries = append(entries, e)
+		tailables = append(tailables, tailable)
+	}
+
+	if len(fetches) == 0 {
+		return resps, errs
+	}
+
+	// 增量查询的step与缓存不一致时, 重新查询全部
+	refetches := []cmodel.GraphQueryParam{}
+	refetchIdxs := []int{}
+
+	fresps, ferrs := queryManyNoCache(ctx, fetches)
+	for k, i := range fetchIdxs {
+		resp, err := fresps[k], ferrs[k]
+		if err != nil || resp == nil {
+			resps[i], errs[i] = resp, err
+			continue
+		}
+
+		e := entries[k]
+		if e == nil {
+			resps[i] = resp
+			cacheHistory(keys[i], params[i], resp, params[i].Start, now-params[i].Start, tailables[k], cfg)
+			continue
+		}
+		if len(resp.Values) > 0 && resp.Step != e.resp.Step {
+			refetches = append(refetches, params[i])
+			refetchIdxs = append(refetchIdxs, i)
+			continue
+		}
+
+		// 缓存项不再修改, 拼接时生成新的缓存项
+		merged := *e.resp
+		merged.Values = make([]*cmodel.RRDData, 0, len(e.resp.Values)+len(resp.Values))
+		merged.Values = append(merged.Values, e.resp.Values...)
+		merged.Values = append(merged.Values, copyValuesAfter(resp.Values, e.closedEnd)...)
+		resps[i] = sliceQueryResponse(&merged, params[i].Start, params[i].End)
+		cacheHistory(keys[i], params[i], &merged, e.start, e.age, true, cfg)
+	}
+
+	if len(refetches) > 0 {
+		fresps, ferrs = queryManyNoCache(ctx, refetches)
+		for k, i := range refetchIdxs {
+			resps[i], errs[i] = fresps[k], ferrs[k]
+			if ferrs[k] == nil && fresps[k] != nil {
+				cacheHistory(keys[i], params[i], fresps[k], params[i].Start, now-params[i].Start, false, cfg)
+			}
+		}
+	}
+
+	return resps, errs
+}
+
+// cacheHistory 缓存resp中[start, para.End]之间已经结束的数据点, 缓存的是数据点的副本
+func cacheHistory(key historyKey, para cmodel.GraphQueryParam, resp *cmodel.GraphQueryResponse, start, age int64, tailable bool, cfg *g.CacheConfig) {
+	if resp.Step <= 0 {
+		return
+	}
+
+	// 最新的两个点可能还会变化, 不缓存
+	step := int64(resp.Step)
+	closedEnd := time.Now().Unix() - 2*step
+	closedEnd -= closedEnd % step
+	if closedEnd > para.End {
+		closedEnd = para.End
+	}
+	if closedEnd < start {
+		return
+	}
+
+	entry := &historyEntry{resp: sliceQueryResponse(resp, start, closedEnd), start: start, closedEnd: closedEnd, age: age, tailable: tailable}
+	historyCache.set(key, entry, cacheTTL(cfg.TTL, defaultCacheTTL), cacheMaxItems(cfg))
+}
+
+// cachedLastMany 先查缓存, 只向graph查询未命中的部分
+func cachedLastMany(ctx context.Context, params []cmodel.GraphLastParam, cfg *g.CacheConfig) ([]*cmodel.GraphLastResp, []error) {
+	resps := make([]*cmodel.GraphLastResp, len(params))
+	errs := make([]error, len(params))
+
+	fetches := []cmodel.GraphLastParam{}
+	fetchIdxs := []int{}
+	for i, para := range params {
+		if v, found := lastCache.get(para); found {
+			proc.LastCacheHitCnt.Incr()
+			resps[i] = copyLastResp(v.(*cmodel.GraphLastResp))
+			continue
+		}
+		proc.LastCacheMissCnt.Incr()
+		fetches = append(fetches, para)
+		fetchIdxs = append(fetchIdxs, i)
+	}
+
+	if len(fetches) == 0 {
+		return resps, errs
+	}
+
+	fresps, ferrs := lastMany(ctx, "Graph.Last", fetches)
+	for k, i := range fetchIdxs {
+		resps[i], errs[i] = fresps[k], ferrs[k]
+		if ferrs[k] == nil && fresps[k] != nil {
+			lastCache.set(params[i], copyLastResp(fresps[k]), cacheTTL(cfg.LastTTL, defaultCacheLastTTL), cacheMaxItems(cfg))
+		}
+	}
+	return resps, errs
+}
+
+// sliceQueryResponse 返回resp中[start, end]之间数据点的副本, 不与resp共享数据点
+func sliceQueryResponse(resp *cmodel.GraphQueryResponse, start, end int64) *cmodel.GraphQueryResponse {
+	cp := *resp
+	cp.Values = []*cmodel.RRDData{}
+	for _, v := range resp.Values {
+		if v != nil && v.Timestamp >= start && v.Timestamp <= end {
+			value := *v
+			cp.Values = append(cp.Values, &value)
+		}
+	}
+	return &cp
+}
+
+// copyValuesAfter 返回values中时间戳大于after的数据点的副本
+func copyValuesAfter(values []*cmodel.RRDData, after int64) []*cmodel.RRDData {
+	ret := make([]*cmodel.RRDData, 0, len(values))
+	for _, v := range values {
+		if v != nil && v.Timestamp > after {
+			value := *v
+			ret = append(ret, &value)
+		}
+	}
+	return ret
+}
+
+func copyLastResp(resp *cmodel.GraphLastResp) *cmodel.GraphLastResp {
+	cp := *resp
+	if resp.Value != nil {
+		value := *resp.Value
+		cp.Value = &value
+	}
+	return &cp
+}
+
+func cacheTTL(ttl int, def int) time.Duration {
+	if ttl <= 0 {
+		ttl = def
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func cacheMaxItems(cfg *g.CacheConfig) int {
+	if cfg.MaxItems <= 0 {
+		return defaultCacheMaxItems
+	}
+	return cfg.MaxItems
+}
+
+// 带过期时间的LRU缓存
+type lruCache struct {
+	sync.Mutex
+	ll    *list.List
+	items map[interface{}]*list.Element
+}
+
+type lruItem struct {
+	key      interface{}
+	value    interface{}
+	expireAt time.Time
+}
+
+func newLruCache() *lruCache {
+	return &lruCache{ll: list.New(), items: make(map[interface{}]*list.Element)}
+}
+
+func (this *lruCache) get(key interface{}) (interface{}, bool) {
+	this.Lock()
+	defer this.Unlock()
+
+	e, found := this.items[key]
+	if !found {
+		return nil, false
+	}
+	item := e.Value.(*lruItem)
+	if time.Now().After(item.expireAt) {
+		this.ll.Remove(e)
+		delete(this.items, key)
+		return nil, false
+	}
+	this.ll.MoveToFront(e)
+	return item.value, true
+}
+
+func (this *lruCache) set(key, value interface{}, ttl time.Duration, maxItems int) {
+	this.Lock()
+	defer this.Unlock()
+
+	item := &lruItem{key: key, value: value, expireAt: time.Now().Add(ttl)}
+	if e, found := this.items[key]; found {
+		e.Value = item
+		this.ll.MoveToFront(e)
+	} else {
+		this.items[key] = this.ll.PushFront(item)
+	}
+
+	for this.ll.Len() > maxItems {
+		e := this.ll.Back()
+		this.ll.Remove(e)
+		delete(this.items, e.Value.(*lruItem).key)
+	}
+}
+
+func (this *lruCache) purge(match func(key interface{}) bool) int {
+	this.Lock()
+	defer this.Unlock()
+
+	n := 0
+	for key, e := range this.items {
+		if match(key) {
+			this.ll.Remove(e)
+			delete(this.items, key)
+			n++
+		}
+	}
+	return n
+}
+
+// CacheSize 返回历史数据和最新数据缓存的条数
+func CacheSize() (int, int) {
+	return historyCache.len(), lastCache.len()
+}
+
+func (this *lruCache) len() int {
+	this.Lock()
+	defer this.Unlock()
+	return this.ll.Len()
+}
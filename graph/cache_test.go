@@ -0,0 +1,153 @@
+package graph
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/g"
+)
+
+func TestCachedQueryMany(t *testing.T) {
+	fakeGraph.Reset()
+	historyCache.purge(func(key interface{}) bool { return true })
+	cfg := &g.CacheConfig{Enabled: true}
+
+	now := time.Now().Unix()
+	now -= now % 60
+	start := now - 3600
+	s := &cmodel.GraphQueryResponse{Endpoint: "host01", Counter: "cpu.idle", DsType: "GAUGE", Step: 60}
+	for ts := start; ts <= now; ts += 60 {
+		s.Values = append(s.Values, &cmodel.RRDData{Timestamp: ts, Value: cmodel.JsonFloat(ts - start)})
+	}
+	fakeGraph.AddSeries(s)
+
+	query := func(start, end int64) *cmodel.GraphQueryResponse {
+		resps, errs := cachedQueryMany(context.Background(), []cmodel.GraphQueryParam{
+			{Endpoint: "host01", Counter: "cpu.idle", ConsolFun: "AVERAGE", Start: start, End: end},
+		}, nil, cfg)
+		if errs[0] != nil {
+			t.Fatal(errs[0])
+		}
+		return resps[0]
+	}
+	expect := func(resp *cmodel.GraphQueryResponse, start, end int64, calls int) {
+		t.Helper()
+		n := int((end-start)/60) + 1
+		if len(resp.Values) != n || resp.Values[0].Timestamp != start || resp.Values[n-1].Timestamp != end {
+			t.Fatalf("expected %d points in [%d, %d], got %d", n, start, end, len(resp.Values))
+		}
+		if got := fakeGraph.Calls("Graph.Query"); got != calls {
+			t.Fatalf("expected %d calls, got %d", calls, got)
+		}
+	}
+
+	expect(query(start, now), start, now, 1)
+
+	// 同样的范围只查询最新的未结束部分
+	expect(query(start, now), start, now, 2)
+
+	// 结束时间不同的查询直接从缓存中截取, 不与缓存共享数据点
+	resp := query(start, start+1200)
+	expect(resp, start, start+1200, 2)
+	resp.Values[1].Value = -1
+	if resp := query(start, start+1200); resp.Values[1].Value != 60 {
+		t.Fatalf("cached point modified: %v", resp.Values[1].Value)
+	}
+
+	// 起点离当前更近时graph可能使用更高的分辨率, 不使用缓存
+	expect(query(now-600, now), now-600, now, 3)
+
+	// 起点早于缓存时不使用缓存
+	expect(query(start-3600, now), start, now, 4)
+}
+
+func TestCachedQueryManyStepChange(t *testing.T) {
+	fakeGraph.Reset()
+	historyCache.purge(func(key interface{}) bool { return true })
+	cfg := &g.CacheConfig{Enabled: true}
+
+	// 起点距当前超过2小时的查询使用300秒的归档, 增量查询最近的部分时得到60秒的step
+	now := time.Now().Unix()
+	now -= now % 300
+	start := now - 3*3600
+	fine := &cmodel.GraphQueryResponse{Endpoint: "host01", Counter: "cpu.idle", DsType: "GAUGE", Step: 60}
+	coarse := &cmodel.GraphQueryResponse{Endpoint: "host01", Counter: "cpu.idle", DsType: "GAUGE", Step: 300}
+	for ts := start; ts <= now; ts += 60 {
+		fine.Values = append(fine.Values, &cmodel.RRDData{Timestamp: ts, Value: 1})
+		if ts%300 == 0 {
+			coarse.Values = append(coarse.Values, &cmodel.RRDData{Timestamp: ts, Value: 1})
+		}
+	}
+	fakeGraph.AddSeries(fine)
+	fakeGraph.AddCoarseSeries(2*3600, coarse)
+
+	query := func(calls int) {
+		t.Helper()
+		resps, errs := cachedQueryMany(context.Background(), []cmodel.GraphQueryParam{
+			{Endpoint: "host01", Counter: "cpu.idle", ConsolFun: "AVERAGE", Start: start, End: now},
+		}, nil, cfg)
+		if errs[0] != nil {
+			t.Fatal(errs[0])
+		}
+		if resps[0].Step != 300 || len(resps[0].Values) != len(coarse.Values) {
+			t.Fatalf("expected %d points of step 300, got %d points of step %d", len(coarse.Values), len(resps[0].Values), resps[0].Step)
+		}
+		if got := fakeGraph.Calls("Graph.Query"); got != calls {
+			t.Fatalf("expected %d calls, got %d", calls, got)
+		}
+	}
+
+	query(1)
+	// 增量查询的step不一致, 重新查询全部
+	query(3)
+	// 之后不再做增量查询, 每次只查询一次
+	query(4)
+	query(5)
+	query(6)
+}
+
+func TestHistoryEntryCovers(t *testing.T) {
+	e := &historyEntry{start: 1000, closedEnd: 5000, age: 3000}
+	cases := []struct {
+		start, now int64
+		expected   bool
+	}{
+		{1000, 4000, true},
+		{1600, 4600, true}, // 滑动的时间窗口
+		{1600, 4000, false},
+		{900, 4000, false},
+		{5060, 9000, false},
+	}
+	for _, c := range cases {
+		if got := e.covers(c.start, c.now); got != c.expected {
+			t.Errorf("covers(%d, %d): expected %v, got %v", c.start, c.now, c.expected, got)
+		}
+	}
+}
+
+func TestCachedLastMany(t *testing.T) {
+	fakeGraph.Reset()
+	lastCache.purge(func(key interface{}) bool { return true })
+	cfg := &g.CacheConfig{Enabled: true}
+	fakeGraph.SetLast("host01", "cpu.idle", &cmodel.RRDData{Timestamp: 60, Value: 1})
+
+	params := []cmodel.GraphLastParam{{Endpoint: "host01", Counter: "cpu.idle"}}
+	resps, errs := cachedLastMany(context.Background(), params, cfg)
+	if errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	resps[0].Value.Value = -1
+
+	resps, _ = cachedLastMany(context.Background(), params, cfg)
+	if resps[0].Value.Value != 1 {
+		t.Fatalf("cached value modified: %v", resps[0].Value.Value)
+	}
+	resps[0].Value.Value = -2
+	resps, _ = cachedLastMany(context.Background(), params, cfg)
+	if resps[0].Value.Value != 1 || fakeGraph.Calls("Graph.Last") != 1 {
+		t.Fatalf("unexpected cached value: %v, calls: %d", resps[0].Value.Value, fakeGraph.Calls("Graph.Last"))
+	}
+}
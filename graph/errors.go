@@ -0,0 +1,65 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+
+	spool "github.com/toolkits/pool/simple_conn_pool"
+)
+
+// 单个endpoint/counter的查询状态
+const (
+	StatusOk           = "ok"
+	StatusNotFound     = "not_found"
+	StatusTimeout      = "timeout"
+	StatusBackendError = "backend_error"
+	StatusCircuitOpen  = "circuit_open"
+)
+
+// CallError 调用graph节点失败(超时、rpc出错、取不到连接等)时返回的错误, 带有节点地址
+type CallError struct {
+	Addr    string
+	Timeout bool
+	Msg     string
+}
+
+func (this *CallError) Error() string {
+	return this.Msg
+}
+
+func newCallError(addr string, msg string) *CallError {
+	return &CallError{Addr: addr, Msg: msg}
+}
+
+func callTimeoutError(addr string, pool *spool.ConnPool) *CallError {
+	return &CallError{Addr: addr, Timeout: true, Msg: fmt.Sprintf("%s, call timeout. proc: %s", addr, pool.Proc())}
+}
+
+func callFailedError(addr string, pool *spool.ConnPool, err error) *CallError {
+	return &CallError{Addr: addr, Msg: fmt.Sprintf("%s, call failed, err %v. proc: %s", addr, err, pool.Proc())}
+}
+
+// ctxError 请求被取消或超过请求的deadline时返回的错误; 超过deadline视为超时
+func ctxError(addr string, ctx context.Context) *CallError {
+	return &CallError{Addr: addr, Timeout: ctx.Err() == context.DeadlineExceeded, Msg: fmt.Sprintf("%s, %v", addr, ctx.Err())}
+}
+
+// ErrorStatus 返回查询错误对应的状态和graph节点地址, err为nil时返回StatusOk;
+// 错误中没有节点地址时, addr为空
+func ErrorStatus(err error) (status string, addr string) {
+	switch e := err.(type) {
+	case nil:
+		return StatusOk, ""
+	case *CallError:
+		if e.Timeout {
+			return StatusTimeout, e.Addr
+		}
+		return StatusBackendError, e.Addr
+	case *CircuitOpenError:
+		return StatusCircuitOpen, e.Addr
+	}
+	if err == context.DeadlineExceeded {
+		return StatusTimeout, ""
+	}
+	return StatusBackendError, ""
+}
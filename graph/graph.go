@@ -1,10 +1,14 @@
 package graph
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	cmodel "github.com/open-falcon/common/model"
@@ -14,6 +18,7 @@ import (
 	spool "github.com/toolkits/pool/simple_conn_pool"
 
 	"github.com/jianvhen/query/g"
+	"github.com/jianvhen/query/proc"
 )
 
 // 连接池
@@ -28,255 +33,400 @@ var (
 	GraphNodeRing *rings.ConsistentHashNodeRing
 )
 
+// 与GraphNodeRing配套的节点列表, 以及每个地址上的在途调用
+// 由clusterLock保护, 热加载配置时与连接池一起替换
+var (
+	graphCluster map[string]string
+	inflight     = make(map[string]*sync.WaitGroup)
+	clusterLock  = new(sync.RWMutex)
+	reloadLock   = new(sync.Mutex)
+)
+
 func Start() {
 	initNodeRings()
 	initConnPools()
 	log.Println("graph.Start ok")
 }
 
-func QueryOne(para cmodel.GraphQueryParam) (resp *cmodel.GraphQueryResponse, err error) {
-	start, end := para.Start, para.End
-	endpoint, counter := para.Endpoint, para.Counter
-
-	pool, addr, err := selectPool(endpoint, counter)
-	if err != nil {
-		return nil, err
+// QueryOne 查询一个counter的历史数据; ctx结束时放弃等待, 关闭连接以中断在途的rpc调用.
+// 时间范围跨越graph的多个rra时, 按rra的边界分段查询, 每段使用能覆盖它的最高分辨率, 见planSegments
+func QueryOne(ctx context.Context, para cmodel.GraphQueryParam) (*PlannedResponse, error) {
+	segs := plan(ctx, para)
+	if len(segs) > 1 {
+		return queryPlanned(ctx, para, segs)
 	}
 
-	conn, err := pool.Fetch()
+	resp, err := queryOne(ctx, para)
 	if err != nil {
 		return nil, err
 	}
+	return &PlannedResponse{GraphQueryResponse: resp, Segments: segs}, nil
+}
 
-	rpcConn := conn.(spool.RpcClient)
-	if rpcConn.Closed() {
-		pool.ForceClose(conn)
-		return nil, errors.New("conn closed")
+func queryOne(ctx context.Context, para cmodel.GraphQueryParam) (*cmodel.GraphQueryResponse, error) {
+	// 迁移期间需要同时读新旧两个集群, 开启缓存时需要先查缓存, 都走批量查询的逻辑
+	if migratingState() != nil || cacheConfig() != nil {
+		resps, errs := QueryMany(ctx, []cmodel.GraphQueryParam{para})
+		return resps[0], errs[0]
 	}
 
-	type ChResult struct {
-		Err  error
-		Resp *cmodel.GraphQueryResponse
+	resp := &cmodel.GraphQueryResponse{}
+	if _, err := callOne(ctx, "Graph.Query", para.Endpoint, para.Counter, para, resp); err != nil {
+		return nil, err
 	}
+	fixQueryResponse(para, resp)
+	return resp, nil
+}
 
-	ch := make(chan *ChResult, 1)
-	go func() {
-		resp := &cmodel.GraphQueryResponse{}
-		err := rpcConn.Call("Graph.Query", para, resp)
-		ch <- &ChResult{Err: err, Resp: resp}
-	}()
+// TODO query不该做这些事情, 说明graph没做好
+func fixQueryResponse(para cmodel.GraphQueryParam, resp *cmodel.GraphQueryResponse) {
+	if len(resp.Values) < 1 {
+		return
+	}
 
-	select {
-	case <-time.After(time.Duration(g.Config().Graph.CallTimeout) * time.Millisecond):
-		pool.ForceClose(conn)
-		return nil, fmt.Errorf("%s, call timeout. proc: %s", addr, pool.Proc())
-	case r := <-ch:
-		if r.Err != nil {
-			pool.ForceClose(conn)
-			return r.Resp, fmt.Errorf("%s, call failed, err %v. proc: %s", addr, r.Err, pool.Proc())
+	start, end := para.Start, para.End
+	fixed := []*cmodel.RRDData{}
+	for _, v := range resp.Values {
+		if v == nil || !(v.Timestamp >= start && v.Timestamp <= end) {
+			continue
+		}
+		//FIXME: 查询数据的时候，把所有的负值都过滤掉，因为transfer之前在设置最小值的时候为U
+		if (resp.DsType == "DERIVE" || resp.DsType == "COUNTER") && v.Value < 0 {
+			fixed = append(fixed, &cmodel.RRDData{Timestamp: v.Timestamp, Value: cmodel.JsonFloat(math.NaN())})
 		} else {
-			pool.Release(conn)
-
-			if len(r.Resp.Values) < 1 {
-				return r.Resp, nil
-			}
-
-			// TODO query不该做这些事情, 说明graph没做好
-			fixed := []*cmodel.RRDData{}
-			for _, v := range r.Resp.Values {
-				if v == nil || !(v.Timestamp >= start && v.Timestamp <= end) {
-					continue
-				}
-				//FIXME: 查询数据的时候，把所有的负值都过滤掉，因为transfer之前在设置最小值的时候为U
-				if (r.Resp.DsType == "DERIVE" || r.Resp.DsType == "COUNTER") && v.Value < 0 {
-					fixed = append(fixed, &cmodel.RRDData{Timestamp: v.Timestamp, Value: cmodel.JsonFloat(math.NaN())})
-				} else {
-					fixed = append(fixed, v)
-				}
-			}
-			r.Resp.Values = fixed
+			fixed = append(fixed, v)
 		}
-		return r.Resp, nil
 	}
+	resp.Values = fixed
 }
 
-func Info(para cmodel.GraphInfoParam) (resp *cmodel.GraphFullyInfo, err error) {
-	endpoint, counter := para.Endpoint, para.Counter
-
-	pool, addr, err := selectPool(endpoint, counter)
+func Info(ctx context.Context, para cmodel.GraphInfoParam) (*cmodel.GraphFullyInfo, error) {
+	resp := &cmodel.GraphInfoResp{}
+	addr, err := callOne(ctx, "Graph.Info", para.Endpoint, para.Counter, para, resp)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := pool.Fetch()
-	if err != nil {
-		return nil, err
+	fullyInfo := cmodel.GraphFullyInfo{
+		Endpoint:  para.Endpoint,
+		Counter:   para.Counter,
+		ConsolFun: resp.ConsolFun,
+		Step:      resp.Step,
+		Filename:  resp.Filename,
+		Addr:      addr,
 	}
+	return &fullyInfo, nil
+}
 
-	rpcConn := conn.(spool.RpcClient)
-	if rpcConn.Closed() {
-		pool.ForceClose(conn)
-		return nil, errors.New("conn closed")
+func Last(ctx context.Context, para cmodel.GraphLastParam) (*cmodel.GraphLastResp, error) {
+	if cfg := cacheConfig(); cfg != nil {
+		resps, errs := cachedLastMany(ctx, []cmodel.GraphLastParam{para}, cfg)
+		return resps[0], errs[0]
 	}
 
-	type ChResult struct {
-		Err  error
-		Resp *cmodel.GraphInfoResp
+	resp := &cmodel.GraphLastResp{}
+	if _, err := callOne(ctx, "Graph.Last", para.Endpoint, para.Counter, para, resp); err != nil {
+		return nil, err
 	}
-	ch := make(chan *ChResult, 1)
-	go func() {
-		resp := &cmodel.GraphInfoResp{}
-		err := rpcConn.Call("Graph.Info", para, resp)
-		ch <- &ChResult{Err: err, Resp: resp}
-	}()
+	return resp, nil
+}
 
-	select {
-	case <-time.After(time.Duration(g.Config().Graph.CallTimeout) * time.Millisecond):
-		pool.ForceClose(conn)
-		return nil, fmt.Errorf("%s, call timeout. proc: %s", addr, pool.Proc())
-	case r := <-ch:
-		if r.Err != nil {
-			pool.ForceClose(conn)
-			return nil, fmt.Errorf("%s, call failed, err %v. proc: %s", addr, r.Err, pool.Proc())
-		} else {
-			pool.Release(conn)
-			fullyInfo := cmodel.GraphFullyInfo{
-				Endpoint:  endpoint,
-				Counter:   counter,
-				ConsolFun: r.Resp.ConsolFun,
-				Step:      r.Resp.Step,
-				Filename:  r.Resp.Filename,
-				Addr:      addr,
-			}
-			return &fullyInfo, nil
-		}
+func LastRaw(ctx context.Context, para cmodel.GraphLastParam) (*cmodel.GraphLastResp, error) {
+	resp := &cmodel.GraphLastResp{}
+	if _, err := callOne(ctx, "Graph.LastRaw", para.Endpoint, para.Counter, para, resp); err != nil {
+		return nil, err
 	}
+	return resp, nil
 }
 
-func Last(para cmodel.GraphLastParam) (r *cmodel.GraphLastResp, err error) {
-	endpoint, counter := para.Endpoint, para.Counter
+// callOne 向endpoint/counter所在的graph节点发出一次rpc调用, 返回节点地址;
+// 超过CallTimeout或ctx结束时关闭连接, 在途的rpc调用随之返回, 不会遗留goroutine
+func callOne(ctx context.Context, method, endpoint, counter string, args, reply interface{}) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 
-	pool, addr, err := selectPool(endpoint, counter)
+	pool, addr, done, err := selectPool(endpoint, counter)
 	if err != nil {
-		return nil, err
+		return addr, err
 	}
+	defer done()
+
+	slots := slotsOf(addr)
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return addr, ctxError(addr, ctx)
+	}
+	defer func() { <-slots }()
 
 	conn, err := pool.Fetch()
 	if err != nil {
-		return nil, err
+		recordCall(addr, true)
+		return addr, newCallError(addr, err.Error())
 	}
 
 	rpcConn := conn.(spool.RpcClient)
 	if rpcConn.Closed() {
-		pool.ForceClose(conn)
-		return nil, errors.New("conn closed")
+		recordCall(addr, true)
+		forceClose(addr, pool, conn)
+		return addr, newCallError(addr, "conn closed")
 	}
 
-	type ChResult struct {
-		Err  error
-		Resp *cmodel.GraphLastResp
-	}
-	ch := make(chan *ChResult, 1)
+	start := time.Now()
+	ch := make(chan error, 1)
 	go func() {
-		resp := &cmodel.GraphLastResp{}
-		err := rpcConn.Call("Graph.Last", para, resp)
-		ch <- &ChResult{Err: err, Resp: resp}
+		ch <- rpcConn.Call(method, args, reply)
 	}()
 
+	timer := time.NewTimer(time.Duration(g.Config().Graph.CallTimeout) * time.Millisecond)
+	defer timer.Stop()
+
 	select {
-	case <-time.After(time.Duration(g.Config().Graph.CallTimeout) * time.Millisecond):
-		pool.ForceClose(conn)
-		return nil, fmt.Errorf("%s, call timeout. proc: %s", addr, pool.Proc())
-	case r := <-ch:
-		if r.Err != nil {
-			pool.ForceClose(conn)
-			return r.Resp, fmt.Errorf("%s, call failed, err %v. proc: %s", addr, r.Err, pool.Proc())
-		} else {
-			pool.Release(conn)
-			return r.Resp, nil
+	case <-timer.C:
+		statCall(addr, start, nil, true)
+		forceClose(addr, pool, conn)
+		return addr, callTimeoutError(addr, pool)
+	case <-ctx.Done():
+		// 请求被取消或超过请求的deadline, 不计入节点的失败
+		forceClose(addr, pool, conn)
+		return addr, ctxError(addr, ctx)
+	case err := <-ch:
+		statCall(addr, start, err, false)
+		if err != nil {
+			forceClose(addr, pool, conn)
+			return addr, callFailedError(addr, pool, err)
 		}
+		pool.Release(conn)
+		return addr, nil
 	}
 }
 
-func LastRaw(para cmodel.GraphLastParam) (r *cmodel.GraphLastResp, err error) {
-	endpoint, counter := para.Endpoint, para.Counter
+func selectPool(endpoint, counter string) (rpool *spool.ConnPool, raddr string, rdone func(), rerr error) {
+	clusterLock.RLock()
+	defer clusterLock.RUnlock()
 
-	pool, addr, err := selectPool(endpoint, counter)
+	addr, err := selectAddr(endpoint, counter)
 	if err != nil {
-		return nil, err
+		return nil, addr, nil, err
 	}
 
-	conn, err := pool.Fetch()
+	pool, done, _, err := acquire(addr)
 	if err != nil {
-		return nil, err
+		return nil, addr, nil, err
 	}
 
-	rpcConn := conn.(spool.RpcClient)
-	if rpcConn.Closed() {
-		pool.ForceClose(conn)
-		return nil, errors.New("conn closed")
-	}
+	return pool, addr, done, nil
+}
 
-	type ChResult struct {
-		Err  error
-		Resp *cmodel.GraphLastResp
-	}
-	ch := make(chan *ChResult, 1)
-	go func() {
-		resp := &cmodel.GraphLastResp{}
-		err := rpcConn.Call("Graph.LastRaw", para, resp)
-		ch <- &ChResult{Err: err, Resp: resp}
-	}()
+// 根据endpoint/counter选出graph节点地址
+type addrSelector func(endpoint, counter string) (string, error)
 
-	select {
-	case <-time.After(time.Duration(g.Config().Graph.CallTimeout) * time.Millisecond):
-		pool.ForceClose(conn)
-		return nil, fmt.Errorf("%s, call timeout. proc: %s", addr, pool.Proc())
-	case r := <-ch:
-		if r.Err != nil {
-			pool.ForceClose(conn)
-			return r.Resp, fmt.Errorf("%s, call failed, err %v. proc: %s", addr, r.Err, pool.Proc())
-		} else {
-			pool.Release(conn)
-			return r.Resp, nil
-		}
-	}
+// selectAddr 返回endpoint/counter所在的graph节点地址, 调用方须持有clusterLock
+func selectAddr(endpoint, counter string) (string, error) {
+	return ringAddr(GraphNodeRing, graphCluster, endpoint, counter)
 }
 
-func selectPool(endpoint, counter string) (rpool *spool.ConnPool, raddr string, rerr error) {
+func ringAddr(ring *rings.ConsistentHashNodeRing, cluster map[string]string, endpoint, counter string) (string, error) {
 	pkey := cutils.PK2(endpoint, counter)
-	node, err := GraphNodeRing.GetNode(pkey)
+	node, err := ring.GetNode(pkey)
 	if err != nil {
-		return nil, "", err
+		return "", err
 	}
 
-	addr, found := g.Config().Graph.Cluster[node]
+	addr, found := cluster[node]
 	if !found {
-		return nil, "", errors.New("node not found")
+		return "", errors.New("node not found")
 	}
 
+	return addr, nil
+}
+
+// acquire 取得addr对应的连接池, 并登记一次在途调用; 调用结束后须执行返回的done.
+// probe为true时熔断器处于半开状态, 只能发出一个探测调用. 调用方须持有clusterLock的读锁
+func acquire(addr string) (*spool.ConnPool, func(), bool, error) {
 	pool, found := GraphConnPools.Get(addr)
 	if !found {
-		return nil, addr, errors.New("addr not found")
+		return nil, nil, false, errors.New("addr not found")
+	}
+
+	probe, err := allowCall(addr)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	wg, found := inflight[addr]
+	if !found {
+		return nil, nil, false, errors.New("addr not found")
+	}
+	wg.Add(1)
+
+	return pool, wg.Done, probe, nil
+}
+
+// Reload 按最新的配置重建一致性哈希环: 为新增的地址创建连接池,
+// 被移除地址的连接池, 等其上的在途调用全部结束后再关闭
+func Reload() {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	cfg := g.Config()
+	ring := rings.NewConsistentHashNodesRing(cfg.Graph.Replicas, cutils.KeysOfMap(cfg.Graph.Cluster))
+
+	mig := newMigrating(cfg.Graph)
+
+	addrs := make(map[string]bool)
+	added := []string{}
+	for _, addr := range graphAddrs(cfg.Graph) {
+		addrs[addr] = true
+		if _, found := GraphConnPools.Get(addr); !found {
+			added = append(added, addr)
+		}
+	}
+	pools := spool.CreateSafeRpcConnPools(cfg.Graph.MaxConns, cfg.Graph.MaxIdle,
+		cfg.Graph.ConnTimeout, cfg.Graph.CallTimeout, added)
+
+	type removedPool struct {
+		pool *spool.ConnPool
+		wg   *sync.WaitGroup
+	}
+	removed := make(map[string]*removedPool)
+
+	clusterLock.Lock()
+	GraphConnPools.Lock()
+	for addr, pool := range pools.M {
+		GraphConnPools.M[addr] = pool
+		inflight[addr] = new(sync.WaitGroup)
+	}
+	for addr, pool := range GraphConnPools.M {
+		if addrs[addr] {
+			continue
+		}
+		delete(GraphConnPools.M, addr)
+		removed[addr] = &removedPool{pool: pool, wg: inflight[addr]}
+		delete(inflight, addr)
+	}
+	GraphConnPools.Unlock()
+	GraphNodeRing = ring
+	graphCluster = copyCluster(cfg.Graph.Cluster)
+	migrating = mig
+	clusterLock.Unlock()
+	pruneNodeSlots(addrs)
+	pruneBreakers(addrs)
+
+	for addr, r := range removed {
+		go func(addr string, r *removedPool) {
+			r.wg.Wait()
+			r.pool.Destroy()
+			proc.GraphConnForceCloseCnt.Delete(addr)
+			log.Println("graph.Reload, conn pool closed:", addr)
+		}(addr, r)
+	}
+
+	log.Printf("graph.Reload ok, nodes: %d, added: %v, removed: %d", len(cfg.Graph.Cluster), added, len(removed))
+}
+
+// statCall 记录一次rpc调用的延迟和结果
+func statCall(addr string, start time.Time, err error, timeout bool) {
+	proc.GraphCallLatency.Observe(addr, time.Since(start).Seconds())
+	if timeout {
+		proc.GraphCallTimeoutCnt.Incr(addr)
+	} else if err != nil {
+		proc.GraphCallErrorCnt.Incr(addr)
 	}
+	recordCall(addr, timeout || err != nil)
+}
+
+func forceClose(addr string, pool *spool.ConnPool, conn spool.NConn) {
+	proc.GraphConnForceCloseCnt.Incr(addr)
+	pool.ForceClose(conn)
+}
+
+// ProcConnPools 返回各连接池及其熔断器的状态
+func ProcConnPools() []string {
+	GraphConnPools.RLock()
+	defer GraphConnPools.RUnlock()
 
-	return pool, addr, nil
+	procs := []string{}
+	for addr, pool := range GraphConnPools.M {
+		procs = append(procs, fmt.Sprintf("%s,circuit:%s", pool.Proc(), CircuitState(addr)))
+	}
+	return procs
+}
+
+// PoolStat 连接池的状态: Active为正在使用的连接数, Idle为空闲连接数, ForceClosed为被强制关闭的连接数, Circuit为熔断器状态
+type PoolStat struct {
+	Addr        string
+	Active      int
+	Idle        int
+	ForceClosed int64
+	Circuit     string
+}
+
+func PoolStats() []*PoolStat {
+	GraphConnPools.RLock()
+	defer GraphConnPools.RUnlock()
+
+	forceClosed := proc.GraphConnForceCloseCnt.Get()
+	ret := make([]*PoolStat, 0, len(GraphConnPools.M))
+	for addr, pool := range GraphConnPools.M {
+		// Proc的格式为 Name:%s,Cnt:%d,active:%d,all:%d,free:%d
+		kv := make(map[string]int)
+		for _, item := range strings.Split(pool.Proc(), ",") {
+			pair := strings.SplitN(item, ":", 2)
+			if len(pair) != 2 {
+				continue
+			}
+			if v, err := strconv.Atoi(pair[1]); err == nil {
+				kv[pair[0]] = v
+			}
+		}
+		ret = append(ret, &PoolStat{Addr: addr, Active: kv["all"] - kv["free"], Idle: kv["free"],
+			ForceClosed: forceClosed[addr], Circuit: CircuitState(addr)})
+	}
+	return ret
 }
 
 // internal functions
 func initConnPools() {
 	cfg := g.Config()
 
-	// TODO 为了得到Slice,这里做的太复杂了
-	graphInstances := nset.NewSafeSet()
-	for _, address := range cfg.Graph.Cluster {
-		graphInstances.Add(address)
-	}
 	GraphConnPools = spool.CreateSafeRpcConnPools(cfg.Graph.MaxConns, cfg.Graph.MaxIdle,
-		cfg.Graph.ConnTimeout, cfg.Graph.CallTimeout, graphInstances.ToSlice())
+		cfg.Graph.ConnTimeout, cfg.Graph.CallTimeout, graphAddrs(cfg.Graph))
+	for addr := range GraphConnPools.M {
+		inflight[addr] = new(sync.WaitGroup)
+	}
 }
 
 func initNodeRings() {
 	cfg := g.Config()
 	GraphNodeRing = rings.NewConsistentHashNodesRing(cfg.Graph.Replicas, cutils.KeysOfMap(cfg.Graph.Cluster))
+	graphCluster = copyCluster(cfg.Graph.Cluster)
+	migrating = newMigrating(cfg.Graph)
+}
+
+// graphAddrs 返回需要建立连接池的全部graph地址, 包括迁移中的新旧集群
+func graphAddrs(cfg *g.GraphConfig) []string {
+	// TODO 为了得到Slice,这里做的太复杂了
+	graphInstances := nset.NewSafeSet()
+	for _, address := range cfg.Cluster {
+		graphInstances.Add(address)
+	}
+	if cfg.Migrating != nil && cfg.Migrating.Enabled {
+		for _, address := range cfg.Migrating.OldCluster {
+			graphInstances.Add(address)
+		}
+		for _, address := range cfg.Migrating.NewCluster {
+			graphInstances.Add(address)
+		}
+	}
+	return graphInstances.ToSlice()
+}
+
+func copyCluster(cluster map[string]string) map[string]string {
+	ret := make(map[string]string, len(cluster))
+	for node, addr := range cluster {
+		ret[node] = addr
+	}
+	return ret
 }
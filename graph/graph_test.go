@@ -0,0 +1,127 @@
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/g"
+	"github.com/jianvhen/query/graph/graphtest"
+)
+
+const testMaxConcurrentPerNode = 2
+
+var fakeGraph *graphtest.Server
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+
+	fakeGraph = graphtest.NewServer()
+
+	dir, err := ioutil.TempDir("", "graph-test")
+	if err != nil {
+		panic(err)
+	}
+	cfg := fmt.Sprintf(`{
+		"http": {"enabled": false},
+		"graph": {
+			"connTimeout": 1000,
+			"callTimeout": 2000,
+			"maxConns": 32,
+			"maxIdle": 32,
+			"replicas": 500,
+			"maxConcurrentPerNode": %d,
+			"cluster": {"graph-00": "%s"}
+		}
+	}`, testMaxConcurrentPerNode, fakeGraph.Addr)
+	cfgFile := filepath.Join(dir, "cfg.json")
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0644); err != nil {
+		panic(err)
+	}
+
+	g.ParseConfig(cfgFile)
+	Start()
+
+	code := m.Run()
+
+	fakeGraph.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// withGraphConfig 把测试配置中graph下的key替换为raw并热加载, 返回恢复原配置的函数
+func withGraphConfig(t *testing.T, key, raw string) func() {
+	orig, err := ioutil.ReadFile(g.ConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(orig, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg["graph"][key] = json.RawMessage(raw)
+	bs, _ := json.Marshal(cfg)
+	if err := ioutil.WriteFile(g.ConfigFile, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		ioutil.WriteFile(g.ConfigFile, orig, 0644)
+		if err := g.ReloadConfig(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNodeSlotsShared(t *testing.T) {
+	fakeGraph.Reset()
+	fakeGraph.SetLatency(20 * time.Millisecond)
+	defer fakeGraph.SetLatency(0)
+
+	params := make([]cmodel.GraphQueryParam, 6)
+	for i := range params {
+		params[i] = cmodel.GraphQueryParam{Endpoint: fmt.Sprintf("host%02d", i), Counter: "cpu.idle", ConsolFun: "AVERAGE", End: 60}
+	}
+
+	// 多个请求并发查询同一个节点, 节点上在途的调用数之和不超过maxConcurrentPerNode
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs := QueryMany(context.Background(), params)
+			for _, err := range errs {
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := Info(context.Background(), cmodel.GraphInfoParam{Endpoint: "host01", Counter: "cpu.idle"}); err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+
+	if n := fakeGraph.Calls("Graph.Query"); n != 24 {
+		t.Fatalf("expected 24 calls, got %d", n)
+	}
+	if n := fakeGraph.MaxInFlight(); n > testMaxConcurrentPerNode {
+		t.Fatalf("expected at most %d calls in flight, got %d", testMaxConcurrentPerNode, n)
+	}
+}
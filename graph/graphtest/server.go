@@ -0,0 +1,313 @@
+// Package graphtest 提供进程内的graph rpc服务, 用于测试:
+// 实现Graph.Query、Graph.Info、Graph.Last、Graph.LastRaw, 数据来自预置的曲线,
+// 可以注入延迟、错误和断开连接
+package graphtest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+)
+
+type key struct {
+	Endpoint string
+	Counter  string
+}
+
+// coarseSeries 分辨率更低的归档, 起点距当前超过span秒的查询使用它
+type coarseSeries struct {
+	span   int64
+	series *cmodel.GraphQueryResponse
+}
+
+type Server struct {
+	Addr string
+
+	sync.Mutex
+	listener net.Listener
+	series   map[key]*cmodel.GraphQueryResponse
+	coarse   map[key]*coarseSeries
+	lasts    map[key]*cmodel.RRDData
+	raws     map[key]*cmodel.RRDData
+	latency  time.Duration
+	errs     map[string]error
+	drops    int
+	conns    map[net.Conn]bool
+	calls    map[string]int
+	inflight int
+	peak     int
+}
+
+// NewServer 在127.0.0.1的随机端口上启动graph rpc服务, 用完后须调用Close
+func NewServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("graphtest: failed to listen on a port: %v", err))
+	}
+
+	this := &Server{Addr: l.Addr().String(), listener: l, conns: make(map[net.Conn]bool)}
+	this.Reset()
+
+	rs := rpc.NewServer()
+	if err := rs.RegisterName("Graph", &Graph{server: this}); err != nil {
+		panic(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			this.Lock()
+			this.conns[conn] = true
+			this.Unlock()
+
+			go func() {
+				rs.ServeConn(conn)
+				this.Lock()
+				delete(this.conns, conn)
+				this.Unlock()
+			}()
+		}
+	}()
+	return this
+}
+
+// Close 停止服务并断开所有连接
+func (this *Server) Close() {
+	this.listener.Close()
+	this.closeConns()
+}
+
+// Reset 清空预置的数据、注入的故障和调用计数
+func (this *Server) Reset() {
+	this.Lock()
+	defer this.Unlock()
+
+	this.series = make(map[key]*cmodel.GraphQueryResponse)
+	this.coarse = make(map[key]*coarseSeries)
+	this.lasts = make(map[key]*cmodel.RRDData)
+	this.raws = make(map[key]*cmodel.RRDData)
+	this.latency = 0
+	this.errs = make(map[string]error)
+	this.drops = 0
+	this.calls = make(map[string]int)
+	this.peak = this.inflight
+}
+
+// AddSeries 预置曲线; Graph.Query返回[start, end]之间的数据点,
+// 没有通过SetLast/SetLastRaw预置最新值时, Graph.Last/Graph.LastRaw返回曲线中最后一个有效的数据点
+func (this *Server) AddSeries(series ...*cmodel.GraphQueryResponse) {
+	this.Lock()
+	defer this.Unlock()
+	for _, s := range series {
+		this.series[key{s.Endpoint, s.Counter}] = s
+	}
+}
+
+// AddCoarseSeries 为曲线预置分辨率更低的归档: 与graph按起点选择rra一样,
+// Graph.Query的起点距当前超过span秒时返回series中的数据点和它的step
+func (this *Server) AddCoarseSeries(span int64, series *cmodel.GraphQueryResponse) {
+	this.Lock()
+	defer this.Unlock()
+	this.coarse[key{series.Endpoint, series.Counter}] = &coarseSeries{span: span, series: series}
+}
+
+func (this *Server) SetLast(endpoint, counter string, v *cmodel.RRDData) {
+	this.Lock()
+	defer this.Unlock()
+	this.lasts[key{endpoint, counter}] = v
+}
+
+func (this *Server) SetLastRaw(endpoint, counter string, v *cmodel.RRDData) {
+	this.Lock()
+	defer this.Unlock()
+	this.raws[key{endpoint, counter}] = v
+}
+
+// SetLatency 每次调用在返回前等待d
+func (this *Server) SetLatency(d time.Duration) {
+	this.Lock()
+	defer this.Unlock()
+	this.latency = d
+}
+
+// SetError 使method(如Graph.Query)的调用返回err, err为nil时恢复正常
+func (this *Server) SetError(method string, err error) {
+	this.Lock()
+	defer this.Unlock()
+	if err == nil {
+		delete(this.errs, method)
+	} else {
+		this.errs[method] = err
+	}
+}
+
+// DropConnections 接下来的n次调用不返回结果, 直接断开所有连接
+func (this *Server) DropConnections(n int) {
+	this.Lock()
+	defer this.Unlock()
+	this.drops = n
+}
+
+// Calls 返回method收到的调用次数
+func (this *Server) Calls(method string) int {
+	this.Lock()
+	defer this.Unlock()
+	return this.calls[method]
+}
+
+// MaxInFlight 返回Reset之后同时在处理的调用数的最大值
+func (this *Server) MaxInFlight() int {
+	this.Lock()
+	defer this.Unlock()
+	return this.peak
+}
+
+func (this *Server) closeConns() {
+	this.Lock()
+	conns := make([]net.Conn, 0, len(this.conns))
+	for conn := range this.conns {
+		conns = append(conns, conn)
+	}
+	this.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// begin 记录一次调用, 并按注入的故障等待、断开连接或返回错误; 调用返回时须执行end
+func (this *Server) begin(method string) error {
+	this.Lock()
+	this.calls[method]++
+	this.inflight++
+	if this.inflight > this.peak {
+		this.peak = this.inflight
+	}
+	latency, err := this.latency, this.errs[method]
+	drop := this.drops > 0
+	if drop {
+		this.drops--
+	}
+	this.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if drop {
+		this.closeConns()
+		return errors.New("connection dropped")
+	}
+	return err
+}
+
+func (this *Server) end() {
+	this.Lock()
+	defer this.Unlock()
+	this.inflight--
+}
+
+func (this *Server) lastOf(values map[key]*cmodel.RRDData, endpoint, counter string) *cmodel.RRDData {
+	this.Lock()
+	defer this.Unlock()
+
+	k := key{endpoint, counter}
+	if v, found := values[k]; found {
+		return v
+	}
+	s, found := this.series[k]
+	if !found {
+		return nil
+	}
+	for i := len(s.Values) - 1; i >= 0; i-- {
+		if v := s.Values[i]; v != nil && !math.IsNaN(float64(v.Value)) {
+			return v
+		}
+	}
+	return nil
+}
+
+// Graph graph rpc服务的实现, 方法与falcon graph一致
+type Graph struct {
+	server *Server
+}
+
+func (this *Graph) Query(param cmodel.GraphQueryParam, resp *cmodel.GraphQueryResponse) error {
+	defer this.server.end()
+	if err := this.server.begin("Graph.Query"); err != nil {
+		return err
+	}
+
+	resp.Endpoint = param.Endpoint
+	resp.Counter = param.Counter
+	resp.Values = []*cmodel.RRDData{}
+
+	this.server.Lock()
+	defer this.server.Unlock()
+
+	s, found := this.server.series[key{param.Endpoint, param.Counter}]
+	if !found {
+		return nil
+	}
+	if c, found := this.server.coarse[key{param.Endpoint, param.Counter}]; found && time.Now().Unix()-param.Start > c.span {
+		s = c.series
+	}
+	resp.DsType = s.DsType
+	resp.Step = s.Step
+	for _, v := range s.Values {
+		if v.Timestamp >= param.Start && v.Timestamp <= param.End {
+			resp.Values = append(resp.Values, &cmodel.RRDData{Timestamp: v.Timestamp, Value: v.Value})
+		}
+	}
+	return nil
+}
+
+func (this *Graph) Info(param cmodel.GraphInfoParam, resp *cmodel.GraphInfoResp) error {
+	defer this.server.end()
+	if err := this.server.begin("Graph.Info"); err != nil {
+		return err
+	}
+
+	this.server.Lock()
+	defer this.server.Unlock()
+
+	resp.ConsolFun = "AVERAGE"
+	resp.Step = 60
+	if s, found := this.server.series[key{param.Endpoint, param.Counter}]; found {
+		resp.Step = s.Step
+	}
+	resp.Filename = fmt.Sprintf("%s/%s_%s_%d.rrd", param.Endpoint, param.Counter, resp.ConsolFun, resp.Step)
+	return nil
+}
+
+func (this *Graph) Last(param cmodel.GraphLastParam, resp *cmodel.GraphLastResp) error {
+	defer this.server.end()
+	if err := this.server.begin("Graph.Last"); err != nil {
+		return err
+	}
+
+	resp.Endpoint = param.Endpoint
+	resp.Counter = param.Counter
+	resp.Value = this.server.lastOf(this.server.lasts, param.Endpoint, param.Counter)
+	return nil
+}
+
+func (this *Graph) LastRaw(param cmodel.GraphLastParam, resp *cmodel.GraphLastResp) error {
+	defer this.server.end()
+	if err := this.server.begin("Graph.LastRaw"); err != nil {
+		return err
+	}
+
+	resp.Endpoint = param.Endpoint
+	resp.Counter = param.Counter
+	resp.Value = this.server.lastOf(this.server.raws, param.Endpoint, param.Counter)
+	return nil
+}
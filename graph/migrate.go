@@ -0,0 +1,130 @@
+package graph
+
+import (
+	"context"
+	"math"
+	"sort"
+
+	cmodel "github.com/open-falcon/common/model"
+	cutils "github.com/open-falcon/common/utils"
+	rings "github.com/toolkits/consistent/rings"
+
+	"github.com/jianvhen/query/g"
+)
+
+// 迁移期间新旧两个集群的一致性哈希环, 未开启迁移时为nil; 由clusterLock保护
+var migrating *migratingRings
+
+type migratingRings struct {
+	oldRing    *rings.ConsistentHashNodeRing
+	oldCluster map[string]string
+	newRing    *rings.ConsistentHashNodeRing
+	newCluster map[string]string
+}
+
+func newMigrating(cfg *g.GraphConfig) *migratingRings {
+	if cfg.Migrating == nil || !cfg.Migrating.Enabled {
+		return nil
+	}
+	return &migratingRings{
+		oldRing:    rings.NewConsistentHashNodesRing(cfg.Replicas, cutils.KeysOfMap(cfg.Migrating.OldCluster)),
+		oldCluster: copyCluster(cfg.Migrating.OldCluster),
+		newRing:    rings.NewConsistentHashNodesRing(cfg.Replicas, cutils.KeysOfMap(cfg.Migrating.NewCluster)),
+		newCluster: copyCluster(cfg.Migrating.NewCluster),
+	}
+}
+
+func migratingState() *migratingRings {
+	clusterLock.RLock()
+	defer clusterLock.RUnlock()
+	return migrating
+}
+
+func (this *migratingRings) selectOld(endpoint, counter string) (string, error) {
+	return ringAddr(this.oldRing, this.oldCluster, endpoint, counter)
+}
+
+func (this *migratingRings) selectNew(endpoint, counter string) (string, error) {
+	return ringAddr(this.newRing, this.newCluster, endpoint, counter)
+}
+
+// queryManyMigrating 同时从新旧集群读取数据, 按时间戳合并;
+// 只要有一个集群查询成功就返回合并后的结果, 两边都失败时返回旧集群的错误
+func queryManyMigrating(ctx context.Context, params []cmodel.GraphQueryParam, m *migratingRings) ([]*cmodel.GraphQueryResponse, []error) {
+	type ChResult struct {
+		Resps []*cmodel.GraphQueryResponse
+		Errs  []error
+	}
+
+	oldCh := make(chan *ChResult, 1)
+	go func() {
+		resps, errs := queryMany(ctx, params, m.selectOld)
+		oldCh <- &ChResult{Resps: resps, Errs: errs}
+	}()
+
+	// 新旧集群中由同一个地址负责的counter, 只需要查询一次
+	newParams := []cmodel.GraphQueryParam{}
+	newIdxs := []int{}
+	for i, para := range params {
+		oldAddr, err1 := m.selectOld(para.Endpoint, para.Counter)
+		newAddr, err2 := m.selectNew(para.Endpoint, para.Counter)
+		if err1 == nil && err2 == nil && oldAddr == newAddr {
+			continue
+		}
+		newParams = append(newParams, para)
+		newIdxs = append(newIdxs, i)
+	}
+	newResps, newErrs := queryMany(ctx, newParams, m.selectNew)
+
+	old := <-oldCh
+	resps, errs := old.Resps, old.Errs
+	for k, i := range newIdxs {
+		if newErrs[k] != nil {
+			continue
+		}
+		if errs[i] != nil {
+			resps[i], errs[i] = newResps[k], nil
+			continue
+		}
+		resps[i] = mergeQueryResponse(resps[i], newResps[k])
+	}
+
+	return resps, errs
+}
+
+// mergeQueryResponse 按时间戳合并两个集群返回的数据点, 同一时间戳优先取非NaN的值, 都有值时以旧集群为准
+func mergeQueryResponse(oldResp, newResp *cmodel.GraphQueryResponse) *cmodel.GraphQueryResponse {
+	if oldResp == nil {
+		return newResp
+	}
+	if newResp == nil {
+		return oldResp
+	}
+
+	points := make(map[int64]*cmodel.RRDData, len(oldResp.Values))
+	for _, v := range oldResp.Values {
+		points[v.Timestamp] = v
+	}
+	for _, v := range newResp.Values {
+		p, found := points[v.Timestamp]
+		if !found || (math.IsNaN(float64(p.Value)) && !math.IsNaN(float64(v.Value))) {
+			points[v.Timestamp] = v
+		}
+	}
+
+	values := make([]*cmodel.RRDData, 0, len(points))
+	for _, v := range points {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Timestamp < values[j].Timestamp })
+
+	merged := *oldResp
+	if merged.DsType == "" {
+		merged.DsType = newResp.DsType
+	}
+	if merged.Step == 0 {
+		merged.Step = newResp.Step
+	}
+	merged.Values = values
+	return &merged
+}
@@ -0,0 +1,45 @@
+package graph
+
+import (
+	"math"
+	"testing"
+
+	cmodel "github.com/open-falcon/common/model"
+)
+
+func points(values ...float64) []*cmodel.RRDData {
+	ret := make([]*cmodel.RRDData, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		ret = append(ret, &cmodel.RRDData{Timestamp: int64(values[i]), Value: cmodel.JsonFloat(values[i+1])})
+	}
+	return ret
+}
+
+func TestMergeQueryResponse(t *testing.T) {
+	nan := math.NaN()
+	oldResp := &cmodel.GraphQueryResponse{Endpoint: "host01", Counter: "cpu.idle", Values: points(60, 1, 120, nan, 180, 3)}
+	newResp := &cmodel.GraphQueryResponse{Endpoint: "host01", Counter: "cpu.idle", DsType: "GAUGE", Step: 60,
+		Values: points(120, 20, 180, 30, 240, 40)}
+
+	merged := mergeQueryResponse(oldResp, newResp)
+	// 旧集群的NaN由新集群的值补上, 都有值时以旧集群为准, 只在新集群中的点追加在后面
+	expected := []float64{1, 20, 3, 40}
+	if len(merged.Values) != len(expected) {
+		t.Fatalf("expected %d points, got %d", len(expected), len(merged.Values))
+	}
+	for i, v := range merged.Values {
+		if v.Timestamp != int64(60*(i+1)) || float64(v.Value) != expected[i] {
+			t.Fatalf("point %d: %d %v", i, v.Timestamp, v.Value)
+		}
+	}
+	if merged.DsType != "GAUGE" || merged.Step != 60 {
+		t.Fatalf("dstype and step should come from the new cluster: %+v", merged)
+	}
+	if len(oldResp.Values) != 3 {
+		t.Fatal("old response should not be modified")
+	}
+
+	if mergeQueryResponse(nil, newResp) != newResp || mergeQueryResponse(oldResp, nil) != oldResp {
+		t.Fatal("a missing side should return the other one")
+	}
+}
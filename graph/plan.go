@@ -0,0 +1,221 @@
+package graph
+
+import (
+	"context"
+	"log"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+)
+
+// rra rrd文件中的一个归档: 每个点由steps个基础步长的数据归约而成, 保存rows个点
+type rra struct {
+	steps int64
+	rows  int64
+}
+
+// falcon graph创建rrd文件时使用的归档, 按cf区分, 按分辨率从高到低排列; MAX、MIN没有基础步长的归档
+var rras = map[string][]rra{
+	"AVERAGE": {{1, 720}, {5, 576}, {20, 504}, {180, 766}, {720, 730}},
+	"MAX":     {{5, 576}, {20, 504}, {180, 766}, {720, 730}},
+	"MIN":     {{5, 576}, {20, 504}, {180, 766}, {720, 730}},
+}
+
+// minStep falcon支持的最小基础步长(秒, transfer拒绝步长更小的数据), 用于没有缓存步长时估计rra覆盖的时间范围
+const minStep = 30
+
+// counter的基础步长几乎不会变化, 缓存Graph.Info取得的步长, 分段查询时不必每次都调用Graph.Info
+const stepCacheTTL = time.Hour
+
+var stepCache = newLruCache()
+
+// Segment 分段查询中的一段, step为该段所在rra的步长(秒)
+type Segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Step  int64 `json:"step"`
+}
+
+// PlannedResponse 按rra分段查询后拼接的历史数据, segments按时间先后排列;
+// 拼接后的step为最新一段的步长, 更早的数据点间隔以segments为准; 没有取得counter的步长时segments为空
+type PlannedResponse struct {
+	*cmodel.GraphQueryResponse
+	Segments []*Segment `json:"segments,omitempty"`
+}
+
+// planSegments 按cf的各rra覆盖的时间范围(以now为终点)把[start, end]切分成若干段, 每段落在能覆盖它的分辨率最高的rra中;
+// rrdtool按查询的起始时间选择rra, 跨越多个rra的查询整段都会使用最粗的分辨率.
+// 为避免rra的边界对齐到它的步长后覆盖不到段的起点, 每个rra少算一行, 段的边界再向后对齐到该rra的步长,
+// 使边界在该rra的一个步长内保持不变, 各段的缓存可以重复使用; cf没有对应的rra时返回nil
+func planSegments(cf string, step, now, start, end int64) []*Segment {
+	archives := rras[cf]
+	if len(archives) == 0 {
+		return nil
+	}
+
+	segs := []*Segment{}
+	upper := end
+	for i, a := range archives {
+		lower := now - step*a.steps*(a.rows-1)
+		if r := lower % (step * a.steps); r != 0 {
+			lower += step*a.steps - r
+		}
+		if i == len(archives)-1 || lower <= start {
+			lower = start
+		}
+		if lower <= upper {
+			segs = append(segs, &Segment{Start: lower, End: upper, Step: step * a.steps})
+		}
+		if lower <= start {
+			break
+		}
+		if lower-1 < upper {
+			upper = lower - 1
+		}
+	}
+
+	// 按时间先后排列
+	for i, j := 0, len(segs)-1; i < j; i, j = i+1, j-1 {
+		segs[i], segs[j] = segs[j], segs[i]
+	}
+	return segs
+}
+
+// needPlan 判断查询是否需要分段: 按基础步长step, 起点落在cf分辨率最高的rra中时整段都能取到最高分辨率, 不需要分段.
+// 没有缓存counter的步长时step为minStep, 实际的步长更大时该rra覆盖的范围更长, 结论不变
+func needPlan(para cmodel.GraphQueryParam, step, now int64) bool {
+	archives := rras[para.ConsolFun]
+	if para.Start > para.End || len(archives) == 0 {
+		return false
+	}
+	a := archives[0]
+	return now-step*a.steps*(a.rows-1) > para.Start
+}
+
+// planMany 批量取得需要分段的查询的步长(先查stepCache)并切分; 不需要分段或Graph.Info失败的查询对应nil
+func planMany(ctx context.Context, params []cmodel.GraphQueryParam) [][]*Segment {
+	segs := make([][]*Segment, len(params))
+	now := time.Now().Unix()
+	infoParams := []cmodel.GraphInfoParam{}
+	infoIdxs := []int{}
+	for i, para := range params {
+		key := cmodel.GraphInfoParam{Endpoint: para.Endpoint, Counter: para.Counter}
+		step := int64(minStep)
+		v, cached := stepCache.get(key)
+		if cached {
+			step = v.(int64)
+		}
+		if !needPlan(para, step, now) {
+			continue
+		}
+		if cached {
+			segs[i] = planSegments(para.ConsolFun, step, now, para.Start, para.End)
+			continue
+		}
+		infoParams = append(infoParams, key)
+		infoIdxs = append(infoIdxs, i)
+	}
+	if len(infoParams) == 0 {
+		return segs
+	}
+
+	infos, errs := InfoMany(ctx, infoParams)
+	for k, i := range infoIdxs {
+		if errs[k] != nil {
+			log.Printf("graph.plan fail, query without splitting, %v", errs[k])
+			continue
+		}
+		if infos[k] == nil || infos[k].Step <= 0 {
+			continue
+		}
+		step := int64(infos[k].Step)
+		stepCache.set(infoParams[k], step, stepCacheTTL, defaultCacheMaxItems)
+		segs[i] = planSegments(params[i].ConsolFun, step, now, params[i].Start, params[i].End)
+	}
+	return segs
+}
+
+// QueryManyPlanned 与QueryMany相同, 但和QueryOne一样按rra的边界分段查询, 每条曲线的各段按时间先后拼接;
+// 所有曲线的所有段在同一批中查询, 任何一段失败时该曲线返回该段的错误
+func QueryManyPlanned(ctx context.Context, params []cmodel.GraphQueryParam) ([]*cmodel.GraphQueryResponse, []error) {
+	segs := planMany(ctx, params)
+	subs := []cmodel.GraphQueryParam{}
+	segSteps := []int64{}
+	offsets := make([]int, len(params)) // 每条曲线的第一段在subs中的下标
+	for i, para := range params {
+		offsets[i] = len(subs)
+		if len(segs[i]) <= 1 {
+			subs = append(subs, para)
+			segSteps = append(segSteps, 0)
+			continue
+		}
+		subs = append(subs, segmentParams(para, segs[i])...)
+		segSteps = append(segSteps, stepsOf(segs[i])...)
+	}
+
+	subResps, subErrs := querySegments(ctx, subs, segSteps)
+	resps := make([]*cmodel.GraphQueryResponse, len(params))
+	errs := make([]error, len(params))
+	for i, para := range params {
+		k := offsets[i]
+		if len(segs[i]) <= 1 {
+			resps[i], errs[i] = subResps[k], subErrs[k]
+			continue
+		}
+		n := len(segs[i])
+		joined, err := joinSegments(para, segs[i], subResps[k:k+n], subErrs[k:k+n])
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		resps[i] = joined.GraphQueryResponse
+	}
+	return resps, errs
+}
+
+// plan 取得counter的基础步长并切分查询; 不需要分段或Graph.Info失败时返回nil
+func plan(ctx context.Context, para cmodel.GraphQueryParam) []*Segment {
+	return planMany(ctx, []cmodel.GraphQueryParam{para})[0]
+}
+
+func segmentParams(para cmodel.GraphQueryParam, segs []*Segment) []cmodel.GraphQueryParam {
+	params := make([]cmodel.GraphQueryParam, len(segs))
+	for i, seg := range segs {
+		params[i] = para
+		params[i].Start, params[i].End = seg.Start, seg.End
+	}
+	return params
+}
+
+func stepsOf(segs []*Segment) []int64 {
+	steps := make([]int64, len(segs))
+	for i, seg := range segs {
+		steps[i] = seg.Step
+	}
+	return steps
+}
+
+// queryPlanned 分段查询并按时间先后拼接; 任何一段失败时返回该段的错误
+func queryPlanned(ctx context.Context, para cmodel.GraphQueryParam, segs []*Segment) (*PlannedResponse, error) {
+	resps, errs := querySegments(ctx, segmentParams(para, segs), stepsOf(segs))
+	return joinSegments(para, segs, resps, errs)
+}
+
+// joinSegments 按时间先后拼接各段的查询结果, resps、errs与segs一一对应
+func joinSegments(para cmodel.GraphQueryParam, segs []*Segment, resps []*cmodel.GraphQueryResponse, errs []error) (*PlannedResponse, error) {
+	joined := &cmodel.GraphQueryResponse{Endpoint: para.Endpoint, Counter: para.Counter, Values: []*cmodel.RRDData{}}
+	for i, resp := range resps {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if resp == nil {
+			continue
+		}
+		if resp.DsType != "" {
+			joined.DsType = resp.DsType
+		}
+		joined.Values = append(joined.Values, resp.Values...)
+	}
+	joined.Step = int(segs[len(segs)-1].Step)
+	return &PlannedResponse{GraphQueryResponse: joined, Segments: segs}, nil
+}
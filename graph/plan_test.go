@@ -0,0 +1,211 @@
+package graph
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+)
+
+func TestPlanSegments(t *testing.T) {
+	const now = 43200 * 2315 // 对齐到所有rra的步长
+	const day = 86400
+	cases := []struct {
+		cf         string
+		step       int64
+		start, end int64
+		expected   []Segment
+	}{
+		// 最近1小时落在第一个rra中
+		{"AVERAGE", 60, now - 3600, now, []Segment{{now - 3600, now, 60}}},
+		// 3天跨越前三个rra: 60秒(约12小时)、300秒(约2天)、1200秒(约7天)
+		{"AVERAGE", 60, now - 3*day, now, []Segment{
+			{now - 3*day, now - 60*5*575 - 1, 1200},
+			{now - 60*5*575, now - 60*719 - 1, 300},
+			{now - 60*719, now, 60},
+		}},
+		// 步长越大, 每个rra覆盖的时间越长
+		{"AVERAGE", 300, now - 3*day, now, []Segment{{now - 3*day, now - 300*719 - 1, 1500}, {now - 300*719, now, 300}}},
+		// 结束时间早于第一个rra时不查询它
+		{"AVERAGE", 60, now - 3*day, now - day, []Segment{{now - 3*day, now - 60*5*575 - 1, 1200}, {now - 60*5*575, now - day, 300}}},
+		// 早于最后一个rra的部分也落在最后一个rra中
+		{"AVERAGE", 60, 0, now, []Segment{
+			{0, now - 60*180*765 - 1, 43200},
+			{now - 60*180*765, now - 60*20*503 - 1, 10800},
+			{now - 60*20*503, now - 60*5*575 - 1, 1200},
+			{now - 60*5*575, now - 60*719 - 1, 300},
+			{now - 60*719, now, 60},
+		}},
+		// MAX、MIN没有基础步长的rra
+		{"MAX", 60, now - 3600, now, []Segment{{now - 3600, now, 300}}},
+		{"MIN", 60, now - 3*day, now, []Segment{{now - 3*day, now - 60*5*575 - 1, 1200}, {now - 60*5*575, now, 300}}},
+	}
+	for i, c := range cases {
+		segs := planSegments(c.cf, c.step, now, c.start, c.end)
+		if len(segs) != len(c.expected) {
+			t.Fatalf("case %d: expected %d segments, got %d: %+v", i, len(c.expected), len(segs), segs)
+		}
+		for j, seg := range segs {
+			if *seg != c.expected[j] {
+				t.Errorf("case %d: segment %d expected %+v, got %+v", i, j, c.expected[j], *seg)
+			}
+		}
+	}
+
+	// 边界向后对齐到所在rra的步长, 在一个步长内不随now变化
+	for _, n := range []int64{now + 1, now + 30, now + 60} {
+		segs := planSegments("AVERAGE", 60, n, now-3*day, n)
+		if len(segs) != 3 || segs[1].Start != now-60*5*575+300 || segs[2].Start != now-60*719+60 {
+			t.Errorf("now %d: unexpected segments %+v %+v %+v", n, *segs[0], *segs[1], *segs[2])
+		}
+	}
+
+	if segs := planSegments("LAST", 60, now, now-3*day, now); segs != nil {
+		t.Errorf("unexpected segments for unknown cf: %+v", segs)
+	}
+}
+
+func TestNeedPlan(t *testing.T) {
+	now := int64(100000000)
+	cases := []struct {
+		para     cmodel.GraphQueryParam
+		step     int64
+		expected bool
+	}{
+		{cmodel.GraphQueryParam{ConsolFun: "AVERAGE", Start: now - 60*719, End: now}, 60, false},
+		{cmodel.GraphQueryParam{ConsolFun: "AVERAGE", Start: now - 60*719 - 1, End: now}, 60, true},
+		// 步长更小时第一个rra覆盖的范围更短
+		{cmodel.GraphQueryParam{ConsolFun: "AVERAGE", Start: now - 60*719, End: now}, 30, true},
+		{cmodel.GraphQueryParam{ConsolFun: "AVERAGE", Start: now - 30*719, End: now}, minStep, false},
+		{cmodel.GraphQueryParam{ConsolFun: "MAX", Start: now - 86400, End: now}, 60, false},
+		{cmodel.GraphQueryParam{ConsolFun: "MAX", Start: now - 86400, End: now}, minStep, true},
+		{cmodel.GraphQueryParam{ConsolFun: "MAX", Start: now - 3*86400, End: now}, 60, true},
+		{cmodel.GraphQueryParam{ConsolFun: "AVERAGE", Start: now, End: now - 86400}, 60, false},
+		{cmodel.GraphQueryParam{ConsolFun: "LAST", Start: 0, End: now}, 60, false},
+	}
+	for i, c := range cases {
+		if got := needPlan(c.para, c.step, now); got != c.expected {
+			t.Errorf("case %d: expected %v, got %v", i, c.expected, got)
+		}
+	}
+}
+
+func TestPlanManyCachedStep(t *testing.T) {
+	fakeGraph.Reset()
+	PurgeCache("")
+	now := time.Now().Unix()
+	para := cmodel.GraphQueryParam{Endpoint: "host01", Counter: "cpu.idle", ConsolFun: "AVERAGE", Start: now - 3*3600, End: now}
+
+	// 按最小步长30秒, 3小时落在第一个rra中
+	if segs := planMany(context.Background(), []cmodel.GraphQueryParam{para}); segs[0] != nil {
+		t.Fatalf("unexpected segments: %+v", segs[0])
+	}
+	// 缓存的步长为10秒时第一个rra只覆盖约2小时
+	stepCache.set(cmodel.GraphInfoParam{Endpoint: "host01", Counter: "cpu.idle"}, int64(10), stepCacheTTL, defaultCacheMaxItems)
+	segs := planMany(context.Background(), []cmodel.GraphQueryParam{para})
+	if len(segs[0]) != 2 || segs[0][1].Step != 10 {
+		t.Fatalf("expected 2 segments, got %+v", segs[0])
+	}
+	if n := fakeGraph.Calls("Graph.Info"); n != 0 {
+		t.Fatalf("expected no calls to Graph.Info, got %d", n)
+	}
+}
+
+func TestQueryManyPlanned(t *testing.T) {
+	fakeGraph.Reset()
+	PurgeCache("")
+	now := time.Now().Unix()
+	start := now - 86400
+	s := &cmodel.GraphQueryResponse{Endpoint: "host01", Counter: "cpu.idle", DsType: "GAUGE", Step: 60}
+	for ts := start - start%60; ts <= now; ts += 60 {
+		s.Values = append(s.Values, &cmodel.RRDData{Timestamp: ts, Value: 1})
+	}
+	fakeGraph.AddSeries(s)
+
+	count := func(start, end int64) int {
+		n := 0
+		for _, v := range s.Values {
+			if v.Timestamp >= start && v.Timestamp <= end {
+				n++
+			}
+		}
+		return n
+	}
+
+	params := []cmodel.GraphQueryParam{
+		{Endpoint: "host01", Counter: "cpu.idle", ConsolFun: "AVERAGE", Start: start, End: now},
+		{Endpoint: "host01", Counter: "cpu.idle", ConsolFun: "AVERAGE", Start: now - 3600, End: now},
+	}
+	resps, errs := QueryManyPlanned(context.Background(), params)
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("unexpected errors: %v %v", errs[0], errs[1])
+	}
+	// 第一个查询分两段, 拼接后与整段查询的数据点相同
+	if len(resps[0].Values) != count(start, now) || resps[0].Step != 60 || len(resps[1].Values) != count(now-3600, now) {
+		t.Fatalf("unexpected responses: %d points at step %d, %d points", len(resps[0].Values), resps[0].Step, len(resps[1].Values))
+	}
+	for i := 1; i < len(resps[0].Values); i++ {
+		if resps[0].Values[i].Timestamp <= resps[0].Values[i-1].Timestamp {
+			t.Fatalf("values out of order at %d", i)
+		}
+	}
+	if q, i := fakeGraph.Calls("Graph.Query"), fakeGraph.Calls("Graph.Info"); q != 3 || i != 1 {
+		t.Fatalf("expected 3 calls to Graph.Query and 1 to Graph.Info, got %d and %d", q, i)
+	}
+
+	// 任何一段失败时整条曲线失败
+	fakeGraph.SetError("Graph.Query", context.DeadlineExceeded)
+	defer fakeGraph.SetError("Graph.Query", nil)
+	resps, errs = QueryManyPlanned(context.Background(), params[:1])
+	if errs[0] == nil || resps[0] != nil {
+		t.Fatalf("expected error, got %+v", resps[0])
+	}
+	if n := fakeGraph.Calls("Graph.Info"); n != 1 {
+		t.Fatalf("expected cached step, got %d calls to Graph.Info", n)
+	}
+}
+
+func TestQueryManyPlannedCached(t *testing.T) {
+	fakeGraph.Reset()
+	PurgeCache("")
+	defer withGraphConfig(t, "cache", `{"enabled": true}`)()
+
+	now := time.Now().Unix()
+	start := now - 3*86400
+	s := &cmodel.GraphQueryResponse{Endpoint: "host01", Counter: "cpu.idle", DsType: "GAUGE", Step: 60}
+	for ts := start - start%60; ts <= now; ts += 60 {
+		s.Values = append(s.Values, &cmodel.RRDData{Timestamp: ts, Value: 1})
+	}
+	fakeGraph.AddSeries(s)
+
+	n := 0
+	for _, v := range s.Values {
+		if v.Timestamp >= start {
+			n++
+		}
+	}
+
+	params := []cmodel.GraphQueryParam{{Endpoint: "host01", Counter: "cpu.idle", ConsolFun: "AVERAGE", Start: start, End: now}}
+	query := func() {
+		t.Helper()
+		resps, errs := QueryManyPlanned(context.Background(), params)
+		if errs[0] != nil {
+			t.Fatal(errs[0])
+		}
+		if len(resps[0].Values) != n {
+			t.Fatalf("expected %d points, got %d", n, len(resps[0].Values))
+		}
+	}
+
+	// 3天分为三段
+	query()
+	if n := fakeGraph.Calls("Graph.Query"); n != 3 {
+		t.Fatalf("expected 3 calls, got %d", n)
+	}
+	// 各段分开缓存, 重复查询时只查询最新一段未结束的部分
+	query()
+	if n := fakeGraph.Calls("Graph.Query"); n != 4 {
+		t.Fatalf("expected 4 calls, got %d", n)
+	}
+}
@@ -0,0 +1,157 @@
+package graph
+
+import (
+	"context"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/g"
+)
+
+// QueryStream 批量查询历史数据, 每个调用返回时立即以params中的下标调用fn, 不等待全部调用返回, 结果的顺序与请求无关;
+// fn在调用方的goroutine中串行执行. fn阻塞时(如客户端读取慢)各节点暂停发出新的调用, 每个节点上已返回但还没有交给fn的结果不超过该节点的并发数加1.
+// fn返回错误时停止查询并返回该错误; 请求被取消或超过deadline时, 没有交给fn的结果被丢弃, 返回ctx.Err()
+func QueryStream(ctx context.Context, params []cmodel.GraphQueryParam, fn func(i int, resp *cmodel.GraphQueryResponse, err error) error) error {
+	return queryStream(ctx, params, nil, fn)
+}
+
+// queryStream 与QueryStream相同, segSteps的含义见querySegments
+func queryStream(ctx context.Context, params []cmodel.GraphQueryParam, segSteps []int64, fn func(i int, resp *cmodel.GraphQueryResponse, err error) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// 缓存和集群迁移都需要拿到完整的结果, 按批调用QueryMany
+	if cacheConfig() != nil || migratingState() != nil {
+		return queryStreamBatches(ctx, params, segSteps, fn)
+	}
+
+	type result struct {
+		idx   int
+		reply interface{}
+		err   error
+	}
+	results := make(chan *result)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		callManyFunc(ctx, "Graph.Query", selectAddr, len(params),
+			func(i int) (string, string) { return params[i].Endpoint, params[i].Counter },
+			func(i int) interface{} { return params[i] },
+			func() interface{} { return &cmodel.GraphQueryResponse{} },
+			func(i int, reply interface{}, err error) {
+				select {
+				case results <- &result{idx: i, reply: reply, err: err}:
+				case <-ctx.Done():
+				}
+			},
+		)
+	}()
+
+	delivered := 0
+	for {
+		select {
+		case r := <-results:
+			var resp *cmodel.GraphQueryResponse
+			if r.reply != nil {
+				resp = r.reply.(*cmodel.GraphQueryResponse)
+				if r.err == nil {
+					fixQueryResponse(params[r.idx], resp)
+				}
+			}
+			delivered++
+			if err := fn(r.idx, resp, r.err); err != nil {
+				cancel()
+				<-finished
+				return err
+			}
+		case <-finished:
+			if delivered < len(params) {
+				return ctx.Err()
+			}
+			return nil
+		}
+	}
+}
+
+func queryStreamBatches(ctx context.Context, params []cmodel.GraphQueryParam, segSteps []int64, fn func(i int, resp *cmodel.GraphQueryResponse, err error) error) error {
+	size := int(g.Config().Graph.MaxConcurrentPerRequest)
+	if size <= 0 {
+		size = defaultMaxConcurrentPerRequest
+	}
+
+	for start := 0; start < len(params); start += size {
+		end := start + size
+		if end > len(params) {
+			end = len(params)
+		}
+
+		var steps []int64
+		if segSteps != nil {
+			steps = segSteps[start:end]
+		}
+		resps, errs := querySegments(ctx, params[start:end], steps)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for i, resp := range resps {
+			if err := fn(start+i, resp, errs[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// QueryStreamPlanned 与QueryStream相同, 但和QueryManyPlanned一样按rra的边界分段查询;
+// 一条曲线的各段都返回后才拼接并以该曲线的下标调用fn, 任何一段失败时以该段的错误调用fn
+func QueryStreamPlanned(ctx context.Context, params []cmodel.GraphQueryParam, fn func(i int, resp *cmodel.GraphQueryResponse, err error) error) error {
+	segs := planMany(ctx, params)
+	subs := []cmodel.GraphQueryParam{}
+	segSteps := []int64{}
+	owners := []int{}                   // subs中每一段所属曲线的下标
+	offsets := make([]int, len(params)) // 每条曲线的第一段在subs中的下标
+	for i, para := range params {
+		offsets[i] = len(subs)
+		if len(segs[i]) <= 1 {
+			subs = append(subs, para)
+			segSteps = append(segSteps, 0)
+			owners = append(owners, i)
+			continue
+		}
+		for k, sub := range segmentParams(para, segs[i]) {
+			subs = append(subs, sub)
+			segSteps = append(segSteps, segs[i][k].Step)
+			owners = append(owners, i)
+		}
+	}
+
+	// 分段的曲线在所有段返回之前暂存已经返回的段
+	parts := make(map[int][]*cmodel.GraphQueryResponse)
+	partErrs := make(map[int][]error)
+	remaining := make(map[int]int)
+	return queryStream(ctx, subs, segSteps, func(k int, resp *cmodel.GraphQueryResponse, err error) error {
+		i := owners[k]
+		n := len(segs[i])
+		if n <= 1 {
+			return fn(i, resp, err)
+		}
+		if _, found := remaining[i]; !found {
+			parts[i] = make([]*cmodel.GraphQueryResponse, n)
+			partErrs[i] = make([]error, n)
+			remaining[i] = n
+		}
+		parts[i][k-offsets[i]], partErrs[i][k-offsets[i]] = resp, err
+		remaining[i]--
+		if remaining[i] > 0 {
+			return nil
+		}
+
+		joined, err := joinSegments(params[i], segs[i], parts[i], partErrs[i])
+		delete(parts, i)
+		delete(partErrs, i)
+		if err != nil {
+			return fn(i, nil, err)
+		}
+		return fn(i, joined.GraphQueryResponse, nil)
+	})
+}
@@ -0,0 +1,140 @@
+// Package htpasswd 读取apache htpasswd文件并校验密码; 只依赖标准库, 供配置检查和认证共用
+package htpasswd
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Load 读取htpasswd文件, 返回用户名到密码hash的映射; 有格式不正确的行时返回错误.
+// 支持 htpasswd -m 生成的 $apr1$ 和 htpasswd -s 生成的 {SHA}, 其他格式(如bcrypt)的用户被忽略
+func Load(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read htpasswd %s: %v", filename, err)
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("bad htpasswd line: %s", line)
+		}
+		user, hash := line[:i], line[i+1:]
+		if !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			log.Printf("htpasswd.Load warning, unsupported hash of user %s, use htpasswd -m or -s", user)
+			continue
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read htpasswd %s: %v", filename, err)
+	}
+	return users, nil
+}
+
+// Check 判断password与Load返回的hash是否一致
+func Check(hash, password string) bool {
+	var expected string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.SplitN(hash[len("$apr1$"):], "$", 2)
+		if len(parts) != 2 {
+			return false
+		}
+		expected = apr1(password, parts[0])
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+}
+
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 apache的md5 crypt
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw, sl := []byte(password), []byte(salt)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write(sl)
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(magic))
+	h.Write(sl)
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(altSum)
+		} else {
+			h.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 == 1 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write(sl)
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 == 1 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	buf := make([]byte, 0, 22)
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			buf = append(buf, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(final[0], final[6], final[12], 4)
+	encode(final[1], final[7], final[13], 4)
+	encode(final[2], final[8], final[14], 4)
+	encode(final[3], final[9], final[15], 4)
+	encode(final[4], final[10], final[5], 4)
+	encode(0, 0, final[11], 2)
+	return magic + salt + "$" + string(buf)
+}
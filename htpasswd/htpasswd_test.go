@@ -0,0 +1,54 @@
+package htpasswd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	cases := []struct {
+		hash     string
+		password string
+		expected bool
+	}{
+		{"$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", "secret", true},
+		{"$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", "wrong", false},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "Secret", false},
+		{"$2y$05$abcdefghijklmnopqrstuv", "secret", false},
+		{"$apr1$nosalt", "secret", false},
+	}
+	for _, c := range cases {
+		if got := Check(c.hash, c.password); got != c.expected {
+			t.Errorf("%s %s: expected %v, got %v", c.hash, c.password, c.expected, got)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "htpasswd")
+
+	ioutil.WriteFile(filename, []byte("# comment\nalice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n\ncarol:$2y$05$abcdefghijklmnopqrstuv\n"), 0644)
+	users, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users["alice"] == "" {
+		t.Fatalf("unexpected users: %v", users)
+	}
+
+	ioutil.WriteFile(filename, []byte("alice\n"), 0644)
+	if _, err := Load(filename); err == nil {
+		t.Fatal("expected error for bad line")
+	}
+	if _, err := Load(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
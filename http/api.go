@@ -1,43 +1,64 @@
 package http
 
 import (
-	"bytes"
-	"github.com/jianvhen/query/g"
+	"encoding/json"
 	"io/ioutil"
 	"log"
 	"net/http"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/g"
+	"github.com/jianvhen/query/service"
 )
 
-func postByJson(rw http.ResponseWriter, req *http.Request, url string) {
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(req.Body)
-	s := buf.String()
-	reqPost, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte(s)))
-	if err != nil {
-		log.Println("Error =", err.Error())
+// /api/info和/api/history与/graph/info、/graph/history相同, 在进程内查询
+func queryInfo(rw http.ResponseWriter, req *http.Request) {
+	var body []cmodel.GraphInfoParam
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		StdRender(rw, "", err)
+		return
 	}
-	reqPost.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(reqPost)
+	ctx, cancel, err := requestContext(req)
 	if err != nil {
-		log.Println("Error =", err.Error())
+		StdRender(rw, "", err)
+		return
 	}
-	defer resp.Body.Close()
+	defer cancel()
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	rw.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	rw.Write(body)
-}
+	if envelopeRequested(req) {
+		items, err := service.InfoItems(ctx, body)
+		StdRender(rw, service.Envelope{Items: items}, err)
+		return
+	}
 
-func queryInfo(rw http.ResponseWriter, req *http.Request) {
-	url := g.Config().Api.Query + "/graph/info"
-	postByJson(rw, req, url)
+	data, err := service.Info(ctx, body)
+	StdRender(rw, data, err)
 }
 
 func queryHistory(rw http.ResponseWriter, req *http.Request) {
-	url := g.Config().Api.Query + "/graph/history"
-	postByJson(rw, req, url)
+	var body GraphHistoryParam
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		StdRender(rw, "", err)
+		return
+	}
+
+	ctx, cancel, err := requestContext(req)
+	if err != nil {
+		StdRender(rw, "", err)
+		return
+	}
+	defer cancel()
+
+	if envelopeRequested(req) {
+		items, err := service.HistoryItems(ctx, &body)
+		StdRender(rw, service.Envelope{Items: items}, err)
+		return
+	}
+
+	data, err := service.History(ctx, &body)
+	StdRender(rw, data, err)
 }
 
 func getRequest(rw http.ResponseWriter, url string) {
@@ -59,6 +80,9 @@ func getRequest(rw http.ResponseWriter, url string) {
 }
 
 func dashboardEndpoints(rw http.ResponseWriter, req *http.Request) {
+	if denyRestricted(rw, req) {
+		return
+	}
 	url := g.Config().Api.Dashboard + req.URL.RequestURI()
 	getRequest(rw, url)
 }
@@ -78,11 +102,17 @@ func postByForm(rw http.ResponseWriter, req *http.Request, url string) {
 }
 
 func dashboardCounters(rw http.ResponseWriter, req *http.Request) {
+	if denyRestricted(rw, req) {
+		return
+	}
 	url := g.Config().Api.Dashboard + "/api/counters"
 	postByForm(rw, req, url)
 }
 
 func dashboardChart(rw http.ResponseWriter, req *http.Request) {
+	if denyRestricted(rw, req) {
+		return
+	}
 	url := g.Config().Api.Dashboard + "/chart"
 	postByForm(rw, req, url)
 }
@@ -0,0 +1,242 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/jianvhen/query/auth"
+	"github.com/jianvhen/query/g"
+	"github.com/jianvhen/query/pattern"
+)
+
+// 认证时读取的请求body的默认上限, 见auth.maxBodyBytes
+const defaultAuthMaxBodyBytes = 4 << 20
+
+// withAuth 按auth配置认证请求: 没有凭证或凭证不正确时返回401, 不能访问路由或请求中指定的endpoint时返回403;
+// 通过后把调用方放入请求的context, service查询graph时再逐个检查展开后的endpoint. 每次判断都记录日志.
+// hmac签名和endpoint检查都要读取body, 先按maxBodyBytes读入内存, 超过时返回413
+func withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authn, err := auth.Current()
+		if err != nil {
+			log.Printf("auth deny, route: %s, remote: %s, status: 500, err: %v", r.URL.Path, r.RemoteAddr, err)
+			renderStatus(w, http.StatusInternalServerError, "auth not available")
+			return
+		}
+		if authn == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route := cleanPath(r.URL.Path)
+		if authn.Public(route) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var limit int64
+		if cfg := g.Config().Auth; cfg != nil {
+			limit = cfg.MaxBodyBytes
+		}
+		if err := bufferBody(r, limit); err != nil {
+			code := http.StatusBadRequest
+			if err == errBodyTooLarge {
+				code = http.StatusRequestEntityTooLarge
+			}
+			log.Printf("auth deny, route: %s, remote: %s, status: %d, err: %v", route, r.RemoteAddr, code, err)
+			renderStatus(w, code, err.Error())
+			return
+		}
+
+		p, err := authn.Authenticate(r)
+		if err != nil {
+			log.Printf("auth deny, route: %s, remote: %s, status: 401, err: %v", route, r.RemoteAddr, err)
+			if authn.Basic() {
+				w.Header().Set("WWW-Authenticate", `Basic realm="query"`)
+			}
+			renderStatus(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		if !p.AllowRoute(route) {
+			log.Printf("auth deny, principal: %s, method: %s, route: %s, remote: %s, status: 403, err: route not allowed",
+				p.Name, p.Method, route, r.RemoteAddr)
+			renderStatus(w, http.StatusForbidden, fmt.Sprintf("forbidden, %s can not access %s", p.Name, route))
+			return
+		}
+
+		if p.RestrictsEndpoints() {
+			for _, endpoint := range requestEndpoints(r) {
+				if pattern.IsPattern(endpoint) || p.AllowEndpoint(endpoint) {
+					continue
+				}
+				err := &auth.ForbiddenError{Principal: p.Name, Endpoint: endpoint}
+				log.Printf("auth deny, principal: %s, method: %s, route: %s, remote: %s, status: 403, err: %v",
+					p.Name, p.Method, route, r.RemoteAddr, err)
+				renderStatus(w, http.StatusForbidden, err.Error())
+				return
+			}
+		}
+
+		log.Printf("auth allow, principal: %s, method: %s, route: %s, remote: %s", p.Name, p.Method, route, r.RemoteAddr)
+		next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), p)))
+	})
+}
+
+// authorizeEndpoint 直接查询graph(不经过service)的接口检查调用方能否读取endpoint, 不能读取时返回403和false
+func authorizeEndpoint(w http.ResponseWriter, r *http.Request, endpoint string) bool {
+	if err := auth.Authorize(r.Context(), endpoint); err != nil {
+		renderStatus(w, http.StatusForbidden, err.Error())
+		return false
+	}
+	return true
+}
+
+// denyRestricted 原样转发dashboard响应的接口无法按endpoint规则过滤, 只能读取部分endpoint的调用方访问时返回403和true
+func denyRestricted(w http.ResponseWriter, r *http.Request) bool {
+	p := auth.FromContext(r.Context())
+	if p == nil || !p.RestrictsEndpoints() {
+		return false
+	}
+	renderStatus(w, http.StatusForbidden, fmt.Sprintf("forbidden, %s can only read some endpoints, %s is not filtered", p.Name, r.URL.Path))
+	return true
+}
+
+func renderStatus(w http.ResponseWriter, code int, msg string) {
+	RenderJsonStatus(w, code, map[string]string{"msg": msg})
+}
+
+// cleanPath 与http.ServeMux一样清理路径中的 . 和 .., 保留末尾的 /
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	np := path.Clean(p)
+	if strings.HasSuffix(p, "/") && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// bufferBody 把请求body读入内存后放回, 不影响后续的处理; 超过limit(不大于0时为默认值)时返回errBodyTooLarge
+func bufferBody(r *http.Request, limit int64) error {
+	if r.Body == nil {
+		return nil
+	}
+	if limit <= 0 {
+		limit = defaultAuthMaxBodyBytes
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	r.Body.Close()
+	if err != nil {
+		return fmt.Errorf("read body fail, %v", err)
+	}
+	if int64(len(body)) > limit {
+		return errBodyTooLarge
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// requestEndpoints 返回请求中明确指定的endpoint: url参数endpoint, 以及json body中各层的endpoint、endpoints字段;
+// body已由bufferBody读入内存, 读取后放回, 不影响后续的处理. 模式、表达式、grafana的target等由service查询graph之前检查
+func requestEndpoints(r *http.Request) []string {
+	endpoints := r.URL.Query()["endpoint"]
+	if r.Body == nil {
+		return endpoints
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return endpoints
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return endpoints
+	}
+	var v interface{}
+	if err := json.Unmarshal(trimmed, &v); err != nil {
+		return endpoints
+	}
+	return appendJsonEndpoints(endpoints, v)
+}
+
+func appendJsonEndpoints(endpoints []string, v interface{}) []string {
+	switch x := v.(type) {
+	case []interface{}:
+		for _, item := range x {
+			endpoints = appendJsonEndpoints(endpoints, item)
+		}
+	case map[string]interface{}:
+		for k, item := range x {
+			switch k {
+			case "endpoint":
+				if s, ok := item.(string); ok && s != "" {
+					endpoints = append(endpoints, s)
+				}
+			case "endpoints":
+				if list, ok := item.([]interface{}); ok {
+					for _, e := range list {
+						if s, ok := e.(string); ok && s != "" {
+							endpoints = append(endpoints, s)
+						}
+					}
+				}
+			default:
+				endpoints = appendJsonEndpoints(endpoints, item)
+			}
+		}
+	}
+	return endpoints
+}
+
+// redactedConfig 返回隐去密钥的配置, 供/config展示
+func redactedConfig(c *g.GlobalConfig) *g.GlobalConfig {
+	if c == nil {
+		return nil
+	}
+	ret := *c
+	if c.Http != nil && c.Http.ReloadToken != "" {
+		h := *c.Http
+		h.ReloadToken = redacted
+		ret.Http = &h
+	}
+	if c.Auth != nil {
+		a := *c.Auth
+		a.Tokens = redactPrincipals(a.Tokens)
+		a.HmacKeys = redactPrincipals(a.HmacKeys)
+		ret.Auth = &a
+	}
+	return &ret
+}
+
+const redacted = "******"
+
+func redactPrincipals(principals []*g.AuthPrincipal) []*g.AuthPrincipal {
+	ret := make([]*g.AuthPrincipal, 0, len(principals))
+	for _, p := range principals {
+		if p == nil {
+			continue
+		}
+		c := *p
+		c.Secret = redacted
+		ret = append(ret, &c)
+	}
+	return ret
+}
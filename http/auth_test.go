@@ -0,0 +1,324 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/auth"
+	"github.com/jianvhen/query/g"
+)
+
+// withAuthConfig 在测试配置中加上auth并热加载, 返回恢复原配置的函数
+func withAuthConfig(t *testing.T, authCfg string) func() {
+	return withConfig(t, "auth", authCfg)
+}
+
+// withConfig 把测试配置中的key替换为raw并热加载, 返回恢复原配置的函数
+func withConfig(t *testing.T, key, raw string) func() {
+	orig, err := ioutil.ReadFile(g.ConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg map[string]json.RawMessage
+	if err := json.Unmarshal(orig, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg[key] = json.RawMessage(raw)
+	bs, _ := json.Marshal(cfg)
+	if err := ioutil.WriteFile(g.ConfigFile, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		ioutil.WriteFile(g.ConfigFile, orig, 0644)
+		if err := g.ReloadConfig(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	setup(t)
+	fakeGraph.AddSeries(series("host01", "cpu.idle", 60, 1, 2), series("web-01", "cpu.idle", 60, 3, 4))
+
+	// alice:secret(apr1), bob:secret({SHA}), carol使用不支持的bcrypt, 被忽略
+	htpasswd := filepath.Join(filepath.Dir(g.ConfigFile), "htpasswd")
+	lines := "alice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\ncarol:$2y$05$abcdefghijklmnopqrstuv\n"
+	if err := ioutil.WriteFile(htpasswd, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer withAuthConfig(t, fmt.Sprintf(`{
+		"enabled": true,
+		"tokens": [
+			{"name": "ops", "secret": "ops-token"},
+			{"name": "team-a", "secret": "team-a-token", "routes": ["/graph/"], "endpoints": ["web-*"]}
+		],
+		"hmacKeys": [{"name": "ci", "secret": "ci-secret", "routes": ["/graph/last"]}],
+		"htpasswd": %q,
+		"users": [{"name": "bob", "endpoints": ["/host\\d+/"]}],
+		"maxBodyBytes": 4096
+	}`, htpasswd))()
+
+	srv := httptest.NewServer(withAuth(http.DefaultServeMux))
+	defer srv.Close()
+
+	do := func(method, path string, body interface{}, setAuth func(r *http.Request, body []byte)) (int, string) {
+		var bs []byte
+		if body != nil {
+			bs, _ = json.Marshal(body)
+		}
+		req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(bs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if setAuth != nil {
+			setAuth(req, bs)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	bearer := func(token string) func(r *http.Request, body []byte) {
+		return func(r *http.Request, body []byte) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	basic := func(user, password string) func(r *http.Request, body []byte) {
+		return func(r *http.Request, body []byte) { r.SetBasicAuth(user, password) }
+	}
+	last := func(endpoint string) []cmodel.GraphLastParam {
+		return []cmodel.GraphLastParam{{Endpoint: endpoint, Counter: "cpu.idle"}}
+	}
+
+	cases := []struct {
+		name    string
+		method  string
+		path    string
+		body    interface{}
+		setAuth func(r *http.Request, body []byte)
+		code    int
+	}{
+		{"public route", "GET", "/health", nil, nil, http.StatusOK},
+		{"no credentials", "POST", "/graph/last", last("host01"), nil, http.StatusUnauthorized},
+		{"bad token", "POST", "/graph/last", last("host01"), bearer("nope"), http.StatusUnauthorized},
+		{"unrestricted token", "POST", "/graph/last", last("host01"), bearer("ops-token"), http.StatusOK},
+		{"unrestricted token on config", "GET", "/config", nil, bearer("ops-token"), http.StatusOK},
+		{"route not allowed", "GET", "/config", nil, bearer("team-a-token"), http.StatusForbidden},
+		{"route not allowed after cleaning", "GET", "/graph/../config", nil, bearer("team-a-token"), http.StatusForbidden},
+		{"endpoint allowed", "POST", "/graph/last", last("web-01"), bearer("team-a-token"), http.StatusOK},
+		{"endpoint not allowed", "POST", "/graph/last", last("host01"), bearer("team-a-token"), http.StatusForbidden},
+		{"endpoint param not allowed", "GET", "/graph/history/one?endpoint=host01&counter=cpu.idle", nil, bearer("team-a-token"), http.StatusForbidden},
+		{"apr1 user", "POST", "/graph/last", last("host01"), basic("alice", "secret"), http.StatusOK},
+		{"apr1 user wrong password", "POST", "/graph/last", last("host01"), basic("alice", "wrong"), http.StatusUnauthorized},
+		{"sha user", "POST", "/graph/last", last("host01"), basic("bob", "secret"), http.StatusOK},
+		{"sha user endpoint not allowed", "POST", "/graph/last", last("web-01"), basic("bob", "secret"), http.StatusForbidden},
+		{"unsupported hash", "POST", "/graph/last", last("host01"), basic("carol", "secret"), http.StatusUnauthorized},
+		{"hmac", "POST", "/graph/last?envelope=1", last("host01"), func(r *http.Request, body []byte) {
+			auth.SignRequest(r, "ci", "ci-secret", body)
+		}, http.StatusOK},
+		{"hmac route not allowed", "POST", "/graph/history", historyBody(0, 60, "host01", "cpu.idle"), func(r *http.Request, body []byte) {
+			auth.SignRequest(r, "ci", "ci-secret", body)
+		}, http.StatusForbidden},
+		{"hmac body changed", "POST", "/graph/last", last("host01"), func(r *http.Request, body []byte) {
+			auth.SignRequest(r, "ci", "ci-secret", []byte("[]"))
+		}, http.StatusUnauthorized},
+		{"hmac wrong secret", "POST", "/graph/last", last("host01"), func(r *http.Request, body []byte) {
+			auth.SignRequest(r, "ci", "nope", body)
+		}, http.StatusUnauthorized},
+		{"hmac expired", "POST", "/graph/last", last("host01"), func(r *http.Request, body []byte) {
+			ts := time.Now().Unix() - 3600
+			r.Header.Set(auth.HeaderKey, "ci")
+			r.Header.Set(auth.HeaderTimestamp, strconv.FormatInt(ts, 10))
+			r.Header.Set(auth.HeaderSignature, auth.Sign("ci-secret", r.Method, r.URL.RequestURI(), ts, body))
+		}, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		code, body := do(c.method, c.path, c.body, c.setAuth)
+		if code != c.code {
+			t.Errorf("%s: expected %d, got %d %s", c.name, c.code, code, body)
+		}
+	}
+
+	// 401时提示basic认证
+	req, _ := http.NewRequest("GET", srv.URL+"/graph/info/one?endpoint=host01&counter=cpu.idle", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") != `Basic realm="query"` {
+		t.Fatalf("unexpected response: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	code, body := do("POST", "/graph/last", last("host01"), basic("alice", "wrong"))
+	if code != http.StatusUnauthorized || !strings.Contains(body, "invalid credentials") {
+		t.Fatalf("unexpected response: %d %s", code, body)
+	}
+
+	// /config不展示密钥
+	code, body = do("GET", "/config", nil, bearer("ops-token"))
+	if code != http.StatusOK || strings.Contains(body, "ops-token") || strings.Contains(body, "ci-secret") {
+		t.Fatalf("secrets in /config: %d %s", code, body)
+	}
+
+	// 表达式中的endpoint在service查询graph之前检查, 引用了不能读取的曲线时返回403, 不发出调用
+	fakeGraph.Reset()
+	fakeGraph.AddSeries(series("host01", "cpu.idle", 60, 1, 2), series("web-01", "cpu.idle", 60, 3, 4))
+	for _, e := range []string{"host01:cpu.idle", "web-01:cpu.idle - host01:cpu.idle"} {
+		code, body = do("POST", "/graph/expr", map[string]interface{}{"expr": e, "start": 0, "end": 180},
+			bearer("team-a-token"))
+		if code != http.StatusForbidden || !strings.Contains(body, "can not read endpoint host01") {
+			t.Fatalf("%s: unexpected response: %d %s", e, code, body)
+		}
+	}
+	if n := fakeGraph.Calls("Graph.Query"); n != 1 {
+		t.Fatalf("expected 1 call to Graph.Query, got %d", n)
+	}
+
+	// body超过maxBodyBytes时在认证之前拒绝
+	big := []cmodel.GraphLastParam{}
+	for len(big) < 200 {
+		big = append(big, last("web-01")...)
+	}
+	code, body = do("POST", "/graph/last", big, bearer("team-a-token"))
+	if code != http.StatusRequestEntityTooLarge || !strings.Contains(body, "request body too large") {
+		t.Fatalf("unexpected response: %d %s", code, body)
+	}
+	code, body = do("POST", "/graph/last", big[:50], bearer("team-a-token"))
+	if code != http.StatusOK {
+		t.Fatalf("unexpected response: %d %s", code, body)
+	}
+	code, body = do("POST", "/graph/expr", map[string]interface{}{"expr": "web-01:cpu.idle * 2", "start": 0, "end": 180},
+		bearer("team-a-token"))
+	if code != http.StatusOK || !strings.Contains(body, "web-01") {
+		t.Fatalf("unexpected response: %d %s", code, body)
+	}
+}
+
+func TestAuthListings(t *testing.T) {
+	setup(t)
+	fakeGraph.AddSeries(series("host01", "cpu.idle", 60, 1, 2), series("web-01", "cpu.idle", 60, 3, 4))
+
+	// 假的dashboard索引
+	index := map[string][]string{"host01": {"cpu.idle", "mem.used"}, "web-01": {"cpu.idle"}, "web-02": {"cpu.busy"}}
+	dashboardSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		var data interface{}
+		switch r.URL.Path {
+		case "/api/endpoints":
+			re := regexp.MustCompile(r.Form.Get("q"))
+			endpoints := []string{}
+			for endpoint := range index {
+				if re.MatchString(endpoint) {
+					endpoints = append(endpoints, endpoint)
+				}
+			}
+			sort.Strings(endpoints)
+			data = endpoints
+		case "/api/counters":
+			var endpoints []string
+			json.Unmarshal([]byte(r.Form.Get("endpoints")), &endpoints)
+			items := [][]interface{}{}
+			for _, endpoint := range endpoints {
+				for _, counter := range index[endpoint] {
+					items = append(items, []interface{}{counter, "GAUGE", 60})
+				}
+			}
+			data = items
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "data": data})
+	}))
+	defer dashboardSrv.Close()
+	defer withConfig(t, "api", fmt.Sprintf(`{"dashboard": %q, "max": 100}`, dashboardSrv.URL))()
+	defer withAuthConfig(t, `{
+		"enabled": true,
+		"tokens": [
+			{"name": "ops", "secret": "ops-token"},
+			{"name": "team-a", "secret": "team-a-token", "endpoints": ["web-*"]}
+		]
+	}`)()
+
+	srv := httptest.NewServer(withAuth(http.DefaultServeMux))
+	defer srv.Close()
+
+	do := func(method, path, token string, body interface{}) (int, string) {
+		var bs []byte
+		if body != nil {
+			bs, _ = json.Marshal(body)
+		}
+		req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(bs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	// grafana的endpoint列表只包含能读取的endpoint
+	for _, c := range []struct {
+		token    string
+		path     string
+		body     interface{}
+		expected string
+	}{
+		{"ops-token", "/api/grafana/search", map[string]string{"target": ""}, `["host01","web-01","web-02"]`},
+		{"team-a-token", "/api/grafana/search", map[string]string{"target": ""}, `["web-01","web-02"]`},
+		{"team-a-token", "/api/grafana/search", map[string]string{"target": "host"}, `[]`},
+		{"team-a-token", "/api/grafana/search", map[string]string{"target": "host01#"}, `[]`},
+		{"team-a-token", "/api/grafana/search", map[string]string{"target": "*#cpu"}, `["*#cpu.idle","*#cpu.busy"]`},
+		{"ops-token", "/api/grafana/tag-values", map[string]string{"key": "endpoint"}, `[{"text":"host01"},{"text":"web-01"},{"text":"web-02"}]`},
+		{"team-a-token", "/api/grafana/tag-values", map[string]string{"key": "endpoint"}, `[{"text":"web-01"},{"text":"web-02"}]`},
+	} {
+		code, body := do("POST", c.path, c.token, c.body)
+		if code != http.StatusOK || body != c.expected {
+			t.Errorf("%s %s %v: expected %s, got %d %s", c.token, c.path, c.body, c.expected, code, body)
+		}
+	}
+
+	// 原样转发dashboard响应的接口不能按endpoint过滤, 只能读取部分endpoint的调用方不能访问
+	for _, path := range []string{"/api/endpoints?q=.%2B&limit=10", "/api/counters", "/api/chart"} {
+		if code, body := do("POST", path, "team-a-token", nil); code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d %s", path, code, body)
+		}
+	}
+	if code, body := do("GET", "/api/endpoints?q=.%2B&limit=10&regex_query=1", "ops-token", nil); code != http.StatusOK || !strings.Contains(body, "host01") {
+		t.Errorf("unexpected response: %d %s", code, body)
+	}
+
+	// 模式展开后去掉不能读取的endpoint, envelope中也不出现
+	body := historyBody(0, 180, "*", "cpu.idle")
+	code, out := do("POST", "/graph/history?envelope=1", "team-a-token", body)
+	if code != http.StatusOK || strings.Contains(out, "host01") || !strings.Contains(out, "web-01") {
+		t.Fatalf("unexpected response: %d %s", code, out)
+	}
+	if code, out = do("POST", "/graph/history?envelope=1", "ops-token", body); code != http.StatusOK || !strings.Contains(out, "host01") {
+		t.Fatalf("unexpected response: %d %s", code, out)
+	}
+}
@@ -1,12 +1,15 @@
 package http
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"net"
 	"net/http"
 
 	"github.com/toolkits/file"
 
 	"github.com/jianvhen/query/g"
+	"github.com/jianvhen/query/graph"
 )
 
 func configCommonRoutes() {
@@ -22,8 +25,63 @@ func configCommonRoutes() {
 		w.Write([]byte(fmt.Sprintf("%s\n", file.SelfDir())))
 	})
 
+	// 配置中的token、密钥不展示
 	http.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
-		RenderDataJson(w, g.Config())
+		RenderDataJson(w, redactedConfig(g.Config()))
 	})
 
+	// post, 仅允许本机或携带正确reloadToken的请求
+	http.HandleFunc("/config/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !isLocalRequest(r) && !validReloadToken(r) {
+			http.Error(w, "no privilege", http.StatusForbidden)
+			return
+		}
+
+		if err := g.ReloadConfig(); err != nil {
+			StdRender(w, "", err)
+			return
+		}
+		graph.Reload()
+
+		StdRender(w, "ok", nil)
+	})
+
+	// post, 清空缓存; 带endpoint参数时只清除该endpoint的缓存
+	http.HandleFunc("/cache/purge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !isLocalRequest(r) && !validReloadToken(r) {
+			http.Error(w, "no privilege", http.StatusForbidden)
+			return
+		}
+
+		n := graph.PurgeCache(r.FormValue("endpoint"))
+		StdRender(w, map[string]int{"purged": n}, nil)
+	})
+
+}
+
+func isLocalRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func validReloadToken(r *http.Request) bool {
+	token := g.Config().Http.ReloadToken
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Reload-Token")), []byte(token)) == 1
 }
@@ -0,0 +1,398 @@
+package http
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/aggregate"
+	"github.com/jianvhen/query/align"
+)
+
+// 历史数据的导出格式
+const (
+	FormatJson   = "json"
+	FormatCsv    = "csv"
+	FormatNdjson = "ndjson"
+	FormatInflux = "influx"
+)
+
+var contentTypes = map[string]string{
+	FormatJson:   "application/json; charset=UTF-8",
+	FormatCsv:    "text/csv; charset=UTF-8",
+	FormatNdjson: "application/x-ndjson",
+	FormatInflux: "text/plain; charset=UTF-8",
+}
+
+var acceptFormats = map[string]string{
+	"application/json":                     FormatJson,
+	"text/csv":                             FormatCsv,
+	"application/x-ndjson":                 FormatNdjson,
+	"application/x-influxdb-line-protocol": FormatInflux,
+}
+
+// exportOptions 导出格式的请求参数
+// format: json(默认)、csv、ndjson、influx; 没有format参数时按Accept头选择
+// layout: csv的布局, wide(默认, 每条曲线一列, 按时间戳对齐)或long(每个数据点一行)
+// time_format: unix(默认)、unix_ms、rfc3339, 或Go的时间格式如 2006-01-02 15:04:05; influx默认为纳秒
+type exportOptions struct {
+	format     string
+	layout     string
+	timeFormat string
+}
+
+func exportOptionsOf(r *http.Request) (*exportOptions, error) {
+	query := r.URL.Query()
+	opts := &exportOptions{
+		format:     query.Get("format"),
+		layout:     query.Get("layout"),
+		timeFormat: query.Get("time_format"),
+	}
+
+	if opts.format == "" {
+		opts.format = FormatJson
+		for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+			if format, ok := acceptFormats[mediaType]; err == nil && ok {
+				opts.format = format
+				break
+			}
+		}
+	}
+
+	switch opts.format {
+	case FormatJson, FormatNdjson:
+	case FormatCsv:
+		if opts.layout != "" && opts.layout != "wide" && opts.layout != "long" {
+			return nil, fmt.Errorf("invalid layout: %s", opts.layout)
+		}
+	case FormatInflux:
+		switch opts.timeFormat {
+		case "", "unix", "unix_ms":
+		default:
+			return nil, fmt.Errorf("invalid time_format for influx: %s", opts.timeFormat)
+		}
+	default:
+		return nil, fmt.Errorf("invalid format: %s", opts.format)
+	}
+	return opts, nil
+}
+
+func (this *exportOptions) formatTime(ts int64) string {
+	switch this.timeFormat {
+	case "", "unix":
+		return strconv.FormatInt(ts, 10)
+	case "unix_ms":
+		return strconv.FormatInt(ts*1000, 10)
+	case "rfc3339":
+		return time.Unix(ts, 0).Format(time.RFC3339)
+	}
+	return time.Unix(ts, 0).Format(this.timeFormat)
+}
+
+// renderHistory 按导出格式输出已经全部查询完成的历史数据, 不是流式的: 整个结果都在内存中, 只是编码时直接写出, 不再拼接整个响应体;
+// 用于json、csv的wide布局、带聚合参数和stream=0的请求, 其他请求见streamRequested和historyStream
+func renderHistory(w http.ResponseWriter, opts *exportOptions, data []*cmodel.GraphQueryResponse, param *GraphHistoryParam) {
+	if opts.format == FormatJson {
+		StdRender(w, data, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypes[opts.format])
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	bw := bufio.NewWriterSize(w, 32*1024)
+	var err error
+	switch opts.format {
+	case FormatCsv:
+		if opts.layout == "long" {
+			err = writeCsvLong(bw, opts, data, true)
+		} else {
+			err = writeCsvWide(bw, opts, data, param)
+		}
+	case FormatNdjson:
+		err = writeNdjson(bw, opts, data)
+	case FormatInflux:
+		err = writeInflux(bw, opts, data)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		log.Printf("export %s fail, err: %v", opts.format, err)
+	}
+}
+
+func formatValue(v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// writeCsvWide 每条曲线一列, 列名为 endpoint:counter; 各曲线按时间戳对齐, 没有数据的单元格为空
+func writeCsvWide(w io.Writer, opts *exportOptions, data []*cmodel.GraphQueryResponse, param *GraphHistoryParam) error {
+	aligned := align.Align(data, int64(param.Start), int64(param.End), 0, param.CF, "")
+
+	cw := csv.NewWriter(w)
+	header := make([]string, 0, len(aligned.Series)+1)
+	header = append(header, "timestamp")
+	for _, s := range aligned.Series {
+		header = append(header, s.Endpoint+":"+s.Counter)
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	row := make([]string, len(header))
+	for j, ts := range aligned.Timestamps {
+		row[0] = opts.formatTime(ts)
+		for i := range aligned.Series {
+			row[i+1] = formatValue(aligned.Values[i][j])
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeCsvLong 每个数据点一行: timestamp,endpoint,counter,value; NaN的value为空
+func writeCsvLong(w io.Writer, opts *exportOptions, data []*cmodel.GraphQueryResponse, header bool) error {
+	cw := csv.NewWriter(w)
+	if header {
+		if err := cw.Write([]string{"timestamp", "endpoint", "counter", "value"}); err != nil {
+			return err
+		}
+	}
+	for _, s := range data {
+		for _, v := range s.Values {
+			if v == nil {
+				continue
+			}
+			if err := cw.Write([]string{opts.formatTime(v.Timestamp), s.Endpoint, s.Counter, formatValue(float64(v.Value))}); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+type ndjsonPoint struct {
+	Endpoint  string           `json:"endpoint"`
+	Counter   string           `json:"counter"`
+	Timestamp interface{}      `json:"timestamp"`
+	Value     cmodel.JsonFloat `json:"value"`
+}
+
+// writeNdjson 每个数据点一行json, NaN的value为null; time_format为unix、unix_ms时timestamp为数字
+func writeNdjson(w io.Writer, opts *exportOptions, data []*cmodel.GraphQueryResponse) error {
+	enc := json.NewEncoder(w)
+	for _, s := range data {
+		for _, v := range s.Values {
+			if v == nil {
+				continue
+			}
+			point := ndjsonPoint{Endpoint: s.Endpoint, Counter: s.Counter, Timestamp: opts.formatTime(v.Timestamp), Value: v.Value}
+			switch opts.timeFormat {
+			case "", "unix":
+				point.Timestamp = v.Timestamp
+			case "unix_ms":
+				point.Timestamp = v.Timestamp * 1000
+			}
+			if err := enc.Encode(&point); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// writeInflux 输出InfluxDB line protocol: measurement为counter的metric, endpoint和counter中的tags作为tag, 值写入value字段;
+// line protocol不能表示NaN, NaN的数据点被跳过. 时间戳默认为纳秒, time_format为unix、unix_ms时为秒、毫秒
+func writeInflux(w io.Writer, opts *exportOptions, data []*cmodel.GraphQueryResponse) error {
+	multiplier := int64(time.Second)
+	switch opts.timeFormat {
+	case "unix":
+		multiplier = 1
+	case "unix_ms":
+		multiplier = int64(time.Second / time.Millisecond)
+	}
+
+	for _, s := range data {
+		tags := aggregate.Tags(s.Counter)
+		tags["endpoint"] = s.Endpoint
+		keys := make([]string, 0, len(tags))
+		for key := range tags {
+			keys = append(keys, key)
+		}
+		// 按key排序的tag写入influxdb时效率更高
+		sort.Strings(keys)
+
+		line := influxMeasurementEscaper.Replace(aggregate.Metric(s.Counter))
+		for _, key := range keys {
+			if tags[key] == "" {
+				continue
+			}
+			line += "," + influxTagEscaper.Replace(key) + "=" + influxTagEscaper.Replace(tags[key])
+		}
+		line += " value="
+
+		for _, v := range s.Values {
+			if v == nil || math.IsNaN(float64(v.Value)) || math.IsInf(float64(v.Value), 0) {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "%s%s %d\n", line, strconv.FormatFloat(float64(v.Value), 'f', -1, 64), v.Timestamp*multiplier); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// historyStream 流式输出历史数据: 每条曲线返回时立即编码并flush; 客户端读取慢时写操作阻塞, graph的查询随之暂停.
+// 支持json(chunked的json数组)、ndjson、csv(long布局)和influx格式
+type historyStream struct {
+	w       http.ResponseWriter
+	bw      *bufio.Writer
+	opts    *exportOptions
+	started bool
+	count   int
+}
+
+// streamErrorTrailer 开始输出之后发生的错误(如数据点超过上限)写入该trailer; 这时输出是不完整的, 调用方需要检查该trailer, 另见finish
+const streamErrorTrailer = "X-Query-Error"
+
+// streamRequested 判断是否流式输出: 以stream参数为准; 没有该参数时, 不带聚合参数的csv(long布局)、ndjson、influx默认流式输出,
+// 这些格式逐条记录编码, 不需要完整的结果; json和csv的wide布局(需要按时间戳对齐)默认不是流式的
+func streamRequested(r *http.Request, opts *exportOptions, param *GraphHistoryParam) bool {
+	if v := r.URL.Query().Get("stream"); v != "" {
+		stream, _ := strconv.ParseBool(v)
+		return stream
+	}
+	if param.Aggregate != nil {
+		return false
+	}
+	switch opts.format {
+	case FormatNdjson, FormatInflux:
+		return true
+	case FormatCsv:
+		return opts.layout == "long"
+	}
+	return false
+}
+
+func checkStreamOptions(opts *exportOptions) error {
+	if opts.format == FormatCsv && opts.layout != "long" {
+		return errors.New("stream mode only supports csv with layout=long")
+	}
+	return nil
+}
+
+func (this *historyStream) start() error {
+	this.started = true
+	this.w.Header().Set("Content-Type", contentTypes[this.opts.format])
+	this.w.Header().Set("Access-Control-Allow-Origin", "*")
+	this.w.Header().Set("Trailer", streamErrorTrailer)
+	this.bw = bufio.NewWriterSize(this.w, 32*1024)
+
+	switch this.opts.format {
+	case FormatJson:
+		_, err := this.bw.WriteString("[")
+		return err
+	case FormatCsv:
+		return writeCsvLong(this.bw, this.opts, nil, true)
+	}
+	return nil
+}
+
+func (this *historyStream) write(resp *cmodel.GraphQueryResponse) error {
+	if !this.started {
+		if err := this.start(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	data := []*cmodel.GraphQueryResponse{resp}
+	switch this.opts.format {
+	case FormatJson:
+		var bs []byte
+		if bs, err = json.Marshal(resp); err == nil {
+			if this.count > 0 {
+				this.bw.WriteString(",")
+			}
+			_, err = this.bw.Write(bs)
+		}
+	case FormatCsv:
+		err = writeCsvLong(this.bw, this.opts, data, false)
+	case FormatNdjson:
+		err = writeNdjson(this.bw, this.opts, data)
+	case FormatInflux:
+		err = writeInflux(this.bw, this.opts, data)
+	}
+	if err != nil {
+		return err
+	}
+	this.count++
+	return this.flush()
+}
+
+func (this *historyStream) flush() error {
+	if err := this.bw.Flush(); err != nil {
+		return err
+	}
+	if f, ok := this.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// finish 结束输出; 还没有开始输出时, 错误按StdRender返回400
+func (this *historyStream) finish(err error) {
+	if err != nil && !this.started {
+		StdRender(this.w, "", err)
+		return
+	}
+	if !this.started {
+		if err := this.start(); err != nil {
+			log.Printf("stream history fail, err: %v", err)
+			return
+		}
+	}
+
+	// 已经开始输出时状态码只能是200, 错误写入trailer; 不检查trailer的客户端也不能把不完整的输出当作完整的结果:
+	// json数组不闭合, 无法解析; ndjson追加一行 {"error": ...}, 字段与数据点不同. csv、influx没有可以区分的记录, 只写入trailer
+	if err != nil {
+		log.Printf("stream history fail, err: %v", err)
+		this.w.Header().Set(streamErrorTrailer, err.Error())
+		if this.opts.format == FormatNdjson {
+			json.NewEncoder(this.bw).Encode(map[string]string{"error": err.Error()})
+		}
+	} else if this.opts.format == FormatJson {
+		this.bw.WriteString("]")
+	}
+	if err := this.flush(); err != nil {
+		log.Printf("stream history fail, err: %v", err)
+	}
+}
@@ -1,285 +1,388 @@
 package http
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"github.com/jianvhen/query/g"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"io"
 	"log"
-	"math/rand"
+	"math"
 	"net/http"
-	"net/url"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/align"
+	"github.com/jianvhen/query/g"
+	"github.com/jianvhen/query/pattern"
+	"github.com/jianvhen/query/service"
 )
 
-type Idc struct {
-	Id         int
-	Pop_id     int
-	Name       string
-	Count      int
-	Area       string
-	Province   string
-	City       string
-	Updated_at string
+// grafana JSON datasource(SimpleJSON)协议, 数据源的地址配置为 http://<query>/api/grafana
+// target的格式为 endpoint#counter, endpoint和counter均支持通配符或/正则/, 如 web-*#cpu.idle
+const grafanaTargetSep = "#"
+
+type GrafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
 }
 
-type Province struct {
-	Id         int
-	Province   string
-	Count      int
-	Updated_at string
+type GrafanaTarget struct {
+	Target string `json:"target"`
+	RefId  string `json:"refId"`
+	Type   string `json:"type"` // timeserie 或 table, 默认为timeserie
+	CF     string `json:"cf"`   // AVERAGE、MAX 或 MIN, 默认为AVERAGE
 }
 
-type City struct {
-	Id         int
-	City       string
-	Province   string
-	Count      int
-	Updated_at string
+type GrafanaAdhocFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
 }
 
-func getHosts(w http.ResponseWriter, req *http.Request, hostKeyword string) {
-	if len(hostKeyword) == 1 {
-		hostKeyword = ".+"
-	}
-	rand.Seed(time.Now().UTC().UnixNano())
-	random64 := rand.Float64()
-	_r := strconv.FormatFloat(random64, 'f', -1, 32)
-	maxQuery := strconv.Itoa(g.Config().Api.Max)
-	url := "/api/endpoints" + "?q=" + hostKeyword + "&tags&limit=" + maxQuery + "&_r=" + _r + "&regex_query=1"
-	if strings.Index(g.Config().Api.Query, req.Host) >= 0 {
-		url = "http://localhost:9966" + url
-	} else {
-		url = g.Config().Api.Query + url
-	}
+type GrafanaQueryParam struct {
+	Range         GrafanaRange         `json:"range"`
+	IntervalMs    int64                `json:"intervalMs"`
+	MaxDataPoints int                  `json:"maxDataPoints"`
+	Targets       []GrafanaTarget      `json:"targets"`
+	AdhocFilters  []GrafanaAdhocFilter `json:"adhocFilters"`
+}
 
-	reqGet, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		StdRender(w, "", err)
-	}
+type GrafanaTimeserie struct {
+	Target     string           `json:"target"`
+	Datapoints [][2]interface{} `json:"datapoints"` // [value, 毫秒时间戳], 没有数据时value为null
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(reqGet)
-	if err != nil {
-		StdRender(w, "", err)
-	}
+type GrafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type GrafanaTable struct {
+	Type    string          `json:"type"`
+	Columns []GrafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type GrafanaSearchParam struct {
+	Target string `json:"target"`
+}
+
+type GrafanaTagValuesParam struct {
+	Key string `json:"key"`
+}
+
+// ad hoc filter 支持的key
+var grafanaTagKeys = []map[string]string{
+	{"type": "string", "text": "endpoint"},
+	{"type": "string", "text": "counter"},
+}
 
-	defer resp.Body.Close()
+func configGrafanaRoutes() {
+	// 数据源的连通性测试
+	http.HandleFunc("/api/grafana/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/grafana/" {
+			http.NotFound(w, r)
+			return
+		}
+		RenderJson(w, "OK")
+	})
+
+	http.HandleFunc("/api/grafana/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			RenderJson(w, "OK")
+			return
+		}
+
+		var body GrafanaSearchParam
+		if err := decodeGrafanaBody(r, &body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		targets, err := grafanaSearch(r.Context(), strings.TrimSpace(body.Target))
+		if err != nil {
+			log.Printf("grafana search fail, %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		RenderJson(w, targets)
+	})
+
+	http.HandleFunc("/api/grafana/query", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			RenderJson(w, "OK")
+			return
+		}
 
-	result := []interface{}{}
-	if resp.Status == "200 OK" {
-		body, _ := ioutil.ReadAll(resp.Body)
-		var nodes = make(map[string]interface{})
-		if err := json.Unmarshal(body, &nodes); err != nil {
-			StdRender(w, "", err)
+		var body GrafanaQueryParam
+		if err := decodeGrafanaBody(r, &body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		for _, host := range nodes["data"].([]interface{}) {
-			item := map[string]interface{}{
-				"text":       host,
-				"expandable": true,
+
+		ctx, cancel, err := requestContext(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer cancel()
+
+		ret, err := grafanaQuery(ctx, &body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		RenderJson(w, ret)
+	})
+
+	// 没有事件数据, 返回空列表
+	http.HandleFunc("/api/grafana/annotations", func(w http.ResponseWriter, r *http.Request) {
+		RenderJson(w, []interface{}{})
+	})
+
+	http.HandleFunc("/api/grafana/tag-keys", func(w http.ResponseWriter, r *http.Request) {
+		RenderJson(w, grafanaTagKeys)
+	})
+
+	http.HandleFunc("/api/grafana/tag-values", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			RenderJson(w, "OK")
+			return
+		}
+
+		var body GrafanaTagValuesParam
+		if err := decodeGrafanaBody(r, &body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// counter依赖于endpoint, 只能列出endpoint的取值
+		values := []map[string]string{}
+		if body.Key == "endpoint" {
+			endpoints, err := grafanaEndpoints(r.Context(), "")
+			if err != nil {
+				log.Printf("grafana tag-values fail, %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, endpoint := range endpoints {
+				values = append(values, map[string]string{"text": endpoint})
 			}
-			result = append(result, item)
 		}
-		RenderJson(w, result)
-	} else {
-		RenderJson(w, result)
-	}
+		RenderJson(w, values)
+	})
 }
 
-func getNextCounterSegment(metric string, counter string) string {
-	if len(metric) > 0 {
-		metric += "."
+func decodeGrafanaBody(r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return nil
 	}
-	counter = strings.Replace(counter, metric, "", 1)
-	segment := strings.Split(counter, ".")[0]
-	return segment
-}
-
-func checkSegmentExpandable(segment string, counter string) bool {
-	segments := strings.Split(counter, ".")
-	expandable := !(segment == segments[len(segments)-1])
-	return expandable
+	// grafana的部分请求没有body
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
 }
 
-func getMetrics(w http.ResponseWriter, req *http.Request, query string) {
-	result := []interface{}{}
-
-	query = strings.Replace(query, "#.*", "", -1)
-	arrQuery := strings.Split(query, "#")
-	host, arrMetric := arrQuery[0], arrQuery[1:]
-	maxQuery := strconv.Itoa(g.Config().Api.Max)
-	metric := strings.Join(arrMetric, ".")
-	reg, _ := regexp.Compile("(^{|}$)")
-	host = reg.ReplaceAllString(host, "")
-	host = strings.Replace(host, ",", "\",\"", -1)
-
-	endpoints := "[\"" + host + "\"]"
-
-	rand.Seed(time.Now().UTC().UnixNano())
-	random64 := rand.Float64()
-	_r := strconv.FormatFloat(random64, 'f', -1, 32)
-
-	form := url.Values{}
-	form.Set("endpoints", endpoints)
-	form.Add("q", metric)
-	form.Add("limit", maxQuery)
-	form.Add("_r", _r)
-
-	target := "/api/counters"
-	if strings.Index(g.Config().Api.Query, req.Host) >= 0 {
-		target = "http://localhost:9966" + target
-	} else {
-		target = g.Config().Api.Query + target
+// grafanaSearch 不含#时按endpoint查询, 返回endpoint列表; 含#时查询endpoint上的counter, 返回endpoint#counter列表
+func grafanaSearch(ctx context.Context, target string) ([]string, error) {
+	if !strings.Contains(target, grafanaTargetSep) {
+		return grafanaEndpoints(ctx, target)
 	}
 
-	reqPost, err := http.NewRequest("POST", target, strings.NewReader(form.Encode()))
-	if err != nil {
-		log.Println("Error =", err.Error())
+	parts := strings.SplitN(target, grafanaTargetSep, 2)
+	endpoint, q := parts[0], parts[1]
+
+	endpoints := []string{endpoint}
+	if pattern.IsPattern(endpoint) {
+		var err error
+		if endpoints, err = grafanaEndpoints(ctx, endpoint); err != nil {
+			return nil, err
+		}
+	}
+	if len(endpoints) == 0 {
+		return []string{}, nil
 	}
-	reqPost.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	client := &http.Client{}
-	resp, err := client.Do(reqPost)
+	counters, err := service.Counters(ctx, endpoints, q, grafanaMax())
 	if err != nil {
-		log.Println("Error =", err.Error())
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.Status == "200 OK" {
-		body, _ := ioutil.ReadAll(resp.Body)
-		var nodes = make(map[string]interface{})
-		if err := json.Unmarshal(body, &nodes); err != nil {
-			log.Println(err.Error())
+	// 保留endpoint中的模式, 查询时再展开
+	ret := make([]string, 0, len(counters))
+	seen := make(map[string]bool)
+	for _, counter := range counters {
+		if seen[counter] {
+			continue
 		}
-		var segmentPool = make(map[string]int)
-		for _, data := range nodes["data"].([]interface{}) {
-			counter := data.([]interface{})[0].(string)
-			segment := getNextCounterSegment(metric, counter)
-			expandable := checkSegmentExpandable(segment, counter)
-			if _, ok := segmentPool[segment]; !ok {
-				item := map[string]interface{}{
-					"text":       segment,
-					"expandable": expandable,
-				}
-				result = append(result, item)
-				segmentPool[segment] = 1
-			}
+		seen[counter] = true
+		ret = append(ret, endpoint+grafanaTargetSep+counter)
+	}
+	return ret, nil
+}
+
+// grafanaEndpoints 查询匹配的endpoint, 为空时返回全部; 不是模式时按子串匹配
+func grafanaEndpoints(ctx context.Context, q string) ([]string, error) {
+	regex := ".+"
+	if pattern.IsPattern(q) {
+		re, err := pattern.Compile(q)
+		if err != nil {
+			return nil, err
 		}
-		RenderJson(w, result)
-	} else {
-		RenderJson(w, result)
+		regex = strings.TrimSuffix(strings.TrimPrefix(re.String(), "^"), "$")
+	} else if q != "" {
+		regex = ".*" + regexp.QuoteMeta(q) + ".*"
 	}
+	return service.Endpoints(ctx, regex, grafanaMax())
 }
 
-func setQueryEditor(w http.ResponseWriter, req *http.Request) {
-	query := req.URL.Query().Get("query")
-	query = strings.Replace(query, ".%", "", -1)
-	query = strings.Replace(query, ".undefined", "", -1)
-	query = strings.Replace(query, ".select metric", "", -1)
-	if !strings.Contains(query, "#") {
-		getHosts(w, req, query)
-	} else {
-		getMetrics(w, req, query)
+func grafanaMax() int {
+	if g.Config().Api == nil {
+		return 0
 	}
+	return g.Config().Api.Max
 }
 
-func getMetricValues(req *http.Request, host string, targets []string, result []interface{}) []interface{} {
-	endpoint_counters := []interface{}{}
-	metric := strings.Join(targets, ".")
-	if strings.Contains(host, "{") { // Templating metrics request
-		host = strings.Replace(host, "{", "", -1)
-		host = strings.Replace(host, "}", "", -1)
-		hosts := strings.Split(host, ",")
-		for _, host := range hosts {
-			item := map[string]string{
-				"endpoint": host,
-				"counter":  metric,
-			}
-			endpoint_counters = append(endpoint_counters, item)
-		}
-	} else {
-		item := map[string]string{
-			"endpoint": host,
-			"counter":  metric,
-		}
-		endpoint_counters = append(endpoint_counters, item)
+func grafanaQuery(ctx context.Context, body *GrafanaQueryParam) ([]interface{}, error) {
+	start, end := body.Range.From.Unix(), body.Range.To.Unix()
+	if end <= start {
+		return nil, errors.New("invalid range")
 	}
 
-	if len(endpoint_counters) > 0 {
-		from, err := strconv.ParseInt(req.PostForm["from"][0], 10, 64)
-		until, err := strconv.ParseInt(req.PostForm["until"][0], 10, 64)
-		url := "/graph/history"
-		if strings.Index(g.Config().Api.Query, req.Host) >= 0 {
-			url = "http://localhost:9966" + url
-		} else {
-			url = g.Config().Api.Query + url
+	ret := []interface{}{}
+	for _, t := range body.Targets {
+		if strings.TrimSpace(t.Target) == "" {
+			continue
 		}
 
-		args := map[string]interface{}{
-			"start":             from,
-			"end":               until,
-			"cf":                "AVERAGE",
-			"endpoint_counters": endpoint_counters,
+		cf := t.CF
+		if cf == "" {
+			cf = "AVERAGE"
 		}
-		bs, err := json.Marshal(args)
-		if err != nil {
-			log.Println("Error =", err.Error())
+		if cf != "AVERAGE" && cf != "MAX" && cf != "MIN" {
+			return nil, fmt.Errorf("invalid cf: %s", t.CF)
 		}
 
-		reqPost, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte(bs)))
+		series, err := grafanaSeries(ctx, t.Target, cf, body.AdhocFilters, start, end)
 		if err != nil {
-			log.Println("Error =", err.Error())
+			return nil, err
 		}
-		reqPost.Header.Set("Content-Type", "application/json")
 
-		client := &http.Client{}
-		resp, err := client.Do(reqPost)
-		if err != nil {
-			log.Println("Error =", err.Error())
+		// 步长不小于曲线本身的step和grafana的intervalMs, 且点数不超过maxDataPoints
+		minStep := align.CommonStep(series)
+		if interval := body.IntervalMs / 1000; interval > minStep {
+			minStep = interval
 		}
-		defer resp.Body.Close()
+		step := align.StepFor(start, end, minStep, body.MaxDataPoints)
+		aligned := align.Align(series, start, end, step, cf, align.FillNull)
 
-		if resp.Status == "200 OK" {
-			body, _ := ioutil.ReadAll(resp.Body)
-			nodes := []interface{}{}
-			if err := json.Unmarshal(body, &nodes); err != nil {
-				log.Println(err.Error())
+		if t.Type == "table" {
+			ret = append(ret, grafanaTable(aligned))
+			continue
+		}
+		for i, s := range aligned.Series {
+			ts := &GrafanaTimeserie{
+				Target:     s.Endpoint + grafanaTargetSep + s.Counter,
+				Datapoints: make([][2]interface{}, 0, len(aligned.Timestamps)),
 			}
-
-			for _, node := range nodes {
-				if _, ok := node.(map[string]interface{})["Values"]; ok {
-					result = append(result, node)
-				}
+			for j, timestamp := range aligned.Timestamps {
+				ts.Datapoints = append(ts.Datapoints, [2]interface{}{grafanaValue(aligned.Values[i][j]), timestamp * 1000})
 			}
+			ret = append(ret, ts)
 		}
 	}
-	return result
+	return ret, nil
 }
 
-func getValues(w http.ResponseWriter, req *http.Request) {
-	result := []interface{}{}
-	req.ParseForm()
-	for _, target := range req.PostForm["target"] {
-		if !strings.Contains(target, ".select metric") {
-			targets := strings.Split(target, "#")
-			host, targets := targets[0], targets[1:]
-			result = getMetricValues(req, host, targets, result)
+// grafanaSeries 展开target中的模式, 按ad hoc filter过滤后按cf查询graph
+func grafanaSeries(ctx context.Context, target, cf string, filters []GrafanaAdhocFilter, start, end int64) ([]*cmodel.GraphQueryResponse, error) {
+	parts := strings.SplitN(target, grafanaTargetSep, 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid target: %s, should be endpoint%scounter", target, grafanaTargetSep)
+	}
+
+	ecs, err := service.Expand(ctx, []cmodel.GraphInfoParam{{Endpoint: parts[0], Counter: parts[1]}})
+	if err != nil {
+		return nil, err
+	}
+
+	matched := make([]cmodel.GraphInfoParam, 0, len(ecs))
+	for _, ec := range ecs {
+		ok, err := matchAdhocFilters(filters, ec)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, ec)
 		}
 	}
-	RenderJson(w, result)
+	return service.Query(ctx, start, end, cf, matched), nil
 }
 
-func GrafanaApiParser(w http.ResponseWriter, req *http.Request) {
-	if req.Method == "GET" {
-		setQueryEditor(w, req)
-	} else if req.Method == "POST" {
-		getValues(w, req)
+func matchAdhocFilters(filters []GrafanaAdhocFilter, ec cmodel.GraphInfoParam) (bool, error) {
+	for _, f := range filters {
+		var v string
+		switch f.Key {
+		case "endpoint":
+			v = ec.Endpoint
+		case "counter":
+			v = ec.Counter
+		default:
+			continue
+		}
+
+		var match bool
+		switch f.Operator {
+		case "=":
+			match = v == f.Value
+		case "!=":
+			match = v != f.Value
+		case "=~", "!~":
+			re, err := regexp.Compile(f.Value)
+			if err != nil {
+				return false, fmt.Errorf("bad filter %s: %v", f.Value, err)
+			}
+			match = re.MatchString(v) == (f.Operator == "=~")
+		default:
+			return false, fmt.Errorf("invalid filter operator: %s", f.Operator)
+		}
+		if !match {
+			return false, nil
+		}
 	}
+	return true, nil
 }
 
-func configGrafanaRoutes() {
-	http.HandleFunc("/api/grafana/", GrafanaApiParser)
+func grafanaTable(aligned *align.Result) *GrafanaTable {
+	table := &GrafanaTable{
+		Type: "table",
+		Columns: []GrafanaColumn{
+			{Text: "Time", Type: "time"},
+			{Text: "Endpoint", Type: "string"},
+			{Text: "Counter", Type: "string"},
+			{Text: "Value", Type: "number"},
+		},
+		Rows: [][]interface{}{},
+	}
+	for i, s := range aligned.Series {
+		for j, timestamp := range aligned.Timestamps {
+			if math.IsNaN(aligned.Values[i][j]) {
+				continue
+			}
+			table.Rows = append(table.Rows, []interface{}{timestamp * 1000, s.Endpoint, s.Counter, aligned.Values[i][j]})
+		}
+	}
+	return table
+}
+
+func grafanaValue(v float64) interface{} {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	return v
 }
@@ -0,0 +1,40 @@
+package http
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGrafanaQueryCF(t *testing.T) {
+	setup(t)
+	fakeGraph.AddSeries(series("host01", "cpu.idle", 60, 1, 5, 2, 8))
+
+	query := func(cf string) ([]interface{}, error) {
+		return grafanaQuery(context.Background(), &GrafanaQueryParam{
+			Range:         GrafanaRange{From: time.Unix(120, 0), To: time.Unix(299, 0)},
+			MaxDataPoints: 2,
+			Targets:       []GrafanaTarget{{Target: "host01#cpu.idle", CF: cf}},
+		})
+	}
+
+	// 按2个点降采样, 每个点由两个60秒的点按cf归约
+	cases := map[string][2]float64{"": {3.5, 8}, "AVERAGE": {3.5, 8}, "MAX": {5, 8}, "MIN": {2, 8}}
+	for cf, expected := range cases {
+		ret, err := query(cf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ret) != 1 {
+			t.Fatalf("%s: expected 1 series, got %d", cf, len(ret))
+		}
+		points := ret[0].(*GrafanaTimeserie).Datapoints
+		if len(points) != 2 || points[0][0] != expected[0] || points[1][0] != expected[1] {
+			t.Errorf("%s: expected %v, got %v", cf, expected, points)
+		}
+	}
+
+	if _, err := query("LAST"); err == nil {
+		t.Fatal("expected error for invalid cf")
+	}
+}
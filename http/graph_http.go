@@ -4,23 +4,18 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
-	"math"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/jianvhen/query/align"
 	"github.com/jianvhen/query/graph"
-	"github.com/jianvhen/query/proc"
+	"github.com/jianvhen/query/service"
 	cmodel "github.com/open-falcon/common/model"
 )
 
-type GraphHistoryParam struct {
-	Start            int                     `json:"start"`
-	End              int                     `json:"end"`
-	CF               string                  `json:"cf"`
-	EndpointCounters []cmodel.GraphInfoParam `json:"endpoint_counters"`
-}
+type GraphHistoryParam = service.HistoryParam
 
 type EChartsData struct {
 	Timestamp []interface{}              `json:"timestamp"`
@@ -54,35 +49,31 @@ func ParseDuration(param string) (start, end int64) {
 	return before.Unix(), now.Unix()
 }
 
-//如果请求的不同counter的采集周期不一致，或者不同的采集频率，可能出现不准确
-func (this *EChartsData) GetEchartsData(datas []*cmodel.GraphQueryResponse) {
+// GetEchartsData 把多条曲线对齐到相同的时间轴上, step<=0时取各曲线中最大的step
+func (this *EChartsData) GetEchartsData(datas []*cmodel.GraphQueryResponse, start, end, step int64, cf, fill string) {
 	if this.Data == nil {
 		this.Data = make(map[string]([]interface{}))
 	}
-	var max int
-	var index int
-	for i, _ := range datas {
-		if max < len(datas[i].Values) {
-			max = len(datas[i].Values)
-			index = i
-		}
-	}
-	counter := datas[index].Counter
-	for _, val := range datas[index].Values {
-		this.Timestamp = append(this.Timestamp, val.Timestamp)
+
+	aligned := align.Align(datas, start, end, step, cf, fill)
+	for _, ts := range aligned.Timestamps {
+		this.Timestamp = append(this.Timestamp, ts)
 	}
-	for i, _ := range datas {
-		counter = datas[i].Counter
-		for j, val := range datas[i].Values {
-			if val.Timestamp == this.Timestamp[j] {
-				this.Data[counter] = append(this.Data[counter], val.Value)
-			} else {
-				this.Data[counter] = append(this.Data[counter], cmodel.JsonFloat(math.NaN())) //not data
-			}
+	for i, s := range aligned.Series {
+		values := make([]interface{}, 0, len(aligned.Values[i]))
+		for _, v := range aligned.Values[i] {
+			values = append(values, cmodel.JsonFloat(v))
 		}
+		this.Data[s.Counter] = values
 	}
 }
 
+// envelopeRequested 请求参数envelope=1时, 批量查询返回envelope格式, 每个endpoint/counter都有一个带状态的结果
+func envelopeRequested(r *http.Request) bool {
+	envelope, _ := strconv.ParseBool(r.URL.Query().Get("envelope"))
+	return envelope
+}
+
 func configGraphRoutes() {
 
 	// method:post
@@ -93,9 +84,6 @@ func configGraphRoutes() {
 			return
 		}
 
-		// statistics
-		proc.HistoryRequestCnt.Incr()
-
 		var body GraphHistoryParam
 		decoder := json.NewDecoder(r.Body)
 		err := decoder.Decode(&body)
@@ -104,37 +92,46 @@ func configGraphRoutes() {
 			return
 		}
 
-		if len(body.EndpointCounters) == 0 {
-			StdRender(w, "", errors.New("empty_payload"))
+		opts, err := exportOptionsOf(r)
+		if err != nil {
+			StdRender(w, "", err)
 			return
 		}
 
-		data := []*cmodel.GraphQueryResponse{}
-		for _, ec := range body.EndpointCounters {
-			request := cmodel.GraphQueryParam{
-				Start:     int64(body.Start),
-				End:       int64(body.End),
-				ConsolFun: body.CF,
-				Endpoint:  ec.Endpoint,
-				Counter:   ec.Counter,
-			}
-			result, err := graph.QueryOne(request)
-			if err != nil {
-				log.Printf("graph.queryOne fail, %v", err)
-			}
-			if result == nil {
-				continue
+		ctx, cancel, err := requestContext(r)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+		defer cancel()
+
+		if envelopeRequested(r) {
+			if opts.format != FormatJson {
+				StdRender(w, "", errors.New("envelope only supports json format"))
+				return
 			}
-			data = append(data, result)
+			items, err := service.HistoryItems(ctx, &body)
+			StdRender(w, service.Envelope{Items: items}, err)
+			return
 		}
 
-		// statistics
-		proc.HistoryResponseCounterCnt.IncrBy(int64(len(data)))
-		for _, item := range data {
-			proc.HistoryResponseItemCnt.IncrBy(int64(len(item.Values)))
+		// 流式输出时每条曲线返回后立即输出, 不在内存中保留整个结果
+		if streamRequested(r, opts, &body) {
+			if err := checkStreamOptions(opts); err != nil {
+				StdRender(w, "", err)
+				return
+			}
+			out := &historyStream{w: w, opts: opts}
+			out.finish(service.HistoryStream(ctx, &body, out.write))
+			return
 		}
 
-		StdRender(w, data, nil)
+		data, err := service.History(ctx, &body)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+		renderHistory(w, opts, data, &body)
 	})
 
 	// post, info
@@ -144,8 +141,6 @@ func configGraphRoutes() {
 			StdRender(w, "OK", nil)
 			return
 		}
-		// statistics
-		proc.InfoRequestCnt.Incr()
 
 		var body []*cmodel.GraphInfoParam
 		decoder := json.NewDecoder(r.Body)
@@ -155,27 +150,29 @@ func configGraphRoutes() {
 			return
 		}
 
-		if len(body) == 0 {
-			StdRender(w, "", errors.New("empty"))
-			return
-		}
-
-		data := []*cmodel.GraphFullyInfo{}
+		params := []cmodel.GraphInfoParam{}
 		for _, param := range body {
 			if param == nil {
 				continue
 			}
-			info, err := graph.Info(*param)
-			if err != nil {
-				log.Printf("graph.info fail, resp: %v, err: %v", info, err)
-			}
-			if info == nil {
-				continue
-			}
-			data = append(data, info)
+			params = append(params, *param)
 		}
 
-		StdRender(w, data, nil)
+		ctx, cancel, err := requestContext(r)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+		defer cancel()
+
+		if envelopeRequested(r) {
+			items, err := service.InfoItems(ctx, params)
+			StdRender(w, service.Envelope{Items: items}, err)
+			return
+		}
+
+		data, err := service.Info(ctx, params)
+		StdRender(w, data, err)
 	})
 
 	// post, last
@@ -185,8 +182,6 @@ func configGraphRoutes() {
 			StdRender(w, "OK", nil)
 			return
 		}
-		// statistics
-		proc.LastRequestCnt.Incr()
 
 		var body []*cmodel.GraphLastParam
 		decoder := json.NewDecoder(r.Body)
@@ -196,30 +191,29 @@ func configGraphRoutes() {
 			return
 		}
 
-		if len(body) == 0 {
-			StdRender(w, "", errors.New("empty"))
-			return
-		}
-
-		data := []*cmodel.GraphLastResp{}
+		params := []cmodel.GraphLastParam{}
 		for _, param := range body {
 			if param == nil {
 				continue
 			}
-			last, err := graph.Last(*param)
-			if err != nil {
-				log.Printf("graph.last fail, resp: %v, err: %v", last, err)
-			}
-			if last == nil {
-				continue
-			}
-			data = append(data, last)
+			params = append(params, *param)
 		}
 
-		// statistics
-		proc.LastRequestItemCnt.IncrBy(int64(len(data)))
+		ctx, cancel, err := requestContext(r)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+		defer cancel()
 
-		StdRender(w, data, nil)
+		if envelopeRequested(r) {
+			items, err := service.LastItems(ctx, params)
+			StdRender(w, service.Envelope{Items: items}, err)
+			return
+		}
+
+		data, err := service.Last(ctx, params)
+		StdRender(w, data, err)
 	})
 
 	// post, last/raw
@@ -229,8 +223,6 @@ func configGraphRoutes() {
 			StdRender(w, "OK", nil)
 			return
 		}
-		// statistics
-		proc.LastRawRequestCnt.Incr()
 
 		var body []*cmodel.GraphLastParam
 		decoder := json.NewDecoder(r.Body)
@@ -240,28 +232,29 @@ func configGraphRoutes() {
 			return
 		}
 
-		if len(body) == 0 {
-			StdRender(w, "", errors.New("empty"))
-			return
-		}
-
-		data := []*cmodel.GraphLastResp{}
+		params := []cmodel.GraphLastParam{}
 		for _, param := range body {
 			if param == nil {
 				continue
 			}
-			last, err := graph.LastRaw(*param)
-			if err != nil {
-				log.Printf("graph.last.raw fail, resp: %v, err: %v", last, err)
-			}
-			if last == nil {
-				continue
-			}
-			data = append(data, last)
+			params = append(params, *param)
 		}
-		// statistics
-		proc.LastRawRequestItemCnt.IncrBy(int64(len(data)))
-		StdRender(w, data, nil)
+
+		ctx, cancel, err := requestContext(r)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+		defer cancel()
+
+		if envelopeRequested(r) {
+			items, err := service.LastRawItems(ctx, params)
+			StdRender(w, service.Envelope{Items: items}, err)
+			return
+		}
+
+		data, err := service.LastRaw(ctx, params)
+		StdRender(w, data, err)
 	})
 
 	//sdp add
@@ -299,7 +292,18 @@ func configGraphRoutes() {
 			Endpoint:  endpoint,
 			Counter:   counter,
 		}
-		result, err := graph.QueryOne(request)
+		if !authorizeEndpoint(w, r, request.Endpoint) {
+			return
+		}
+
+		ctx, cancel, err := requestContext(r)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+		defer cancel()
+
+		result, err := graph.QueryOne(ctx, request)
 		log.Printf("query one result: %v, err: %v", result, err)
 		if err != nil {
 			StdRender(w, "", err)
@@ -323,7 +327,18 @@ func configGraphRoutes() {
 			Counter:  counter,
 		}
 
-		result, err := graph.Info(param)
+		if !authorizeEndpoint(w, r, param.Endpoint) {
+			return
+		}
+
+		ctx, cancel, err := requestContext(r)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+		defer cancel()
+
+		result, err := graph.Info(ctx, param)
 		log.Printf("graph.info result: %v, err: %v", result, err)
 		if err != nil {
 			StdRender(w, "", err)
@@ -335,7 +350,8 @@ func configGraphRoutes() {
 
 	//method:get
 	http.HandleFunc("/graph/sdp/one", func(w http.ResponseWriter, r *http.Request) {
-		var duration, cf, endpoint string
+		var duration, cf, endpoint, fill string
+		var step int64
 		var counters []string
 		var echarts EChartsData
 		r.ParseForm()
@@ -349,6 +365,10 @@ func configGraphRoutes() {
 				endpoint = value[0]
 			case "counter":
 				counters = value
+			case "step":
+				step, _ = strconv.ParseInt(value[0], 10, 64)
+			case "fill":
+				fill = value[0]
 			}
 		}
 
@@ -366,29 +386,46 @@ func configGraphRoutes() {
 			return
 		}
 
+		if err := align.CheckFill(fill); err != nil {
+			StdRender(w, "", err)
+			return
+		}
+
 		start, end := ParseDuration(duration)
 
-		data := []*cmodel.GraphQueryResponse{}
+		requests := make([]cmodel.GraphQueryParam, 0, len(counters))
 		for _, counter := range counters {
-			request := cmodel.GraphQueryParam{
+			requests = append(requests, cmodel.GraphQueryParam{
 				Start:     int64(start),
 				End:       int64(end),
 				ConsolFun: cf,
 				Endpoint:  endpoint,
 				Counter:   counter,
-			}
-			result, err := graph.QueryOne(request)
+			})
+		}
+		if !authorizeEndpoint(w, r, endpoint) {
+			return
+		}
+
+		ctx, cancel, err := requestContext(r)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+		defer cancel()
+
+		data, errs := graph.QueryMany(ctx, requests)
+		for _, err := range errs {
 			if err != nil {
 				log.Printf("query one fail: %v", err)
 			}
-			data = append(data, result)
 		}
-		echarts.GetEchartsData(data)
+		echarts.GetEchartsData(data, start, end, step, cf, fill)
 
 		StdRender(w, echarts, nil)
 	})
 
-	// post, last
+	// post, 按agent.alive判断endpoint是否存活, 保留原有的请求和响应格式
 	http.HandleFunc("/graph/sdp/alive", func(w http.ResponseWriter, r *http.Request) {
 		var body []*GraphAliveParam
 		decoder := json.NewDecoder(r.Body)
@@ -398,35 +435,174 @@ func configGraphRoutes() {
 			return
 		}
 
-		if len(body) == 0 {
-			StdRender(w, "", errors.New("empty_payload"))
+		ctx, cancel, err := requestContext(r)
+		if err != nil {
+			StdRender(w, "", err)
 			return
 		}
+		defer cancel()
 
-		data := []*GraphAliveResponse{}
-		for _, param := range body {
-			var res GraphAliveResponse
-			res.Endpoint = param.Endpoint
-			tmp := cmodel.GraphLastParam{
-				Endpoint: param.Endpoint,
-				Counter:  "agent.alive",
-			}
-			last, err := graph.Last(tmp)
-			if err != nil {
-				// can't get data from graph return false
-				log.Printf("graph.last fail, resp: %v, err: %v", last, err)
-				res.Status = 0
-				data = append(data, &res)
+		param := &service.AliveParam{}
+		for _, item := range body {
+			if item == nil {
 				continue
 			}
-			if time.Now().Unix()-last.Value.Timestamp <= 120 {
-				res.Status = 1
-			} else {
-				res.Status = 0
+			param.Endpoints = append(param.Endpoints, item.Endpoint)
+		}
+
+		items, err := service.Alive(ctx, param)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+
+		data := make([]*GraphAliveResponse, 0, len(items))
+		for _, item := range items {
+			if item.Error != "" {
+				log.Printf("graph.last fail, endpoint: %s, err: %s", item.Endpoint, item.Error)
 			}
-			data = append(data, &res)
+			data = append(data, &GraphAliveResponse{Endpoint: item.Endpoint, Status: item.Status})
 		}
 		StdRender(w, data, nil)
 	})
 
+	// post, 存活检测, 参数见service.AliveParam
+	http.HandleFunc("/graph/alive", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			StdRender(w, "OK", nil)
+			return
+		}
+
+		var body service.AliveParam
+		decoder := json.NewDecoder(r.Body)
+		err := decoder.Decode(&body)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+
+		ctx, cancel, err := requestContext(r)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+		defer cancel()
+
+		data, err := service.Alive(ctx, &body)
+		StdRender(w, data, err)
+	})
+
+	// post, 数据新鲜度报告, 参数见service.StaleParam
+	http.HandleFunc("/graph/stale", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			StdRender(w, "OK", nil)
+			return
+		}
+
+		var body service.StaleParam
+		decoder := json.NewDecoder(r.Body)
+		err := decoder.Decode(&body)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+
+		ctx, cancel, err := requestContext(r)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+		defer cancel()
+
+		data, err := service.Stale(ctx, &body)
+		StdRender(w, data, err)
+	})
+
+	// post, 表达式查询, 参数见service.ExprParam, 语法见expr包
+	http.HandleFunc("/graph/expr", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			StdRender(w, "OK", nil)
+			return
+		}
+
+		var body service.ExprParam
+		decoder := json.NewDecoder(r.Body)
+		err := decoder.Decode(&body)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+
+		ctx, cancel, err := requestContext(r)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+		defer cancel()
+
+		data, err := service.Expr(ctx, &body)
+		StdRender(w, data, err)
+	})
+
+	// post, 按counter的值对endpoint排序, 参数见service.TopNParam
+	http.HandleFunc("/graph/topn", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			StdRender(w, "OK", nil)
+			return
+		}
+
+		var body service.TopNParam
+		decoder := json.NewDecoder(r.Body)
+		err := decoder.Decode(&body)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+
+		ctx, cancel, err := requestContext(r)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+		defer cancel()
+
+		data, err := service.TopN(ctx, &body)
+		StdRender(w, data, err)
+	})
+
+	// post, 计算曲线上的阈值规则, 参数见service.EvaluateParam, 规则的语法见rule包
+	http.HandleFunc("/graph/evaluate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			StdRender(w, "OK", nil)
+			return
+		}
+
+		var body service.EvaluateParam
+		decoder := json.NewDecoder(r.Body)
+		err := decoder.Decode(&body)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+
+		ctx, cancel, err := requestContext(r)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+		defer cancel()
+
+		data, err := service.Evaluate(ctx, &body)
+		if err != nil {
+			StdRender(w, "", err)
+			return
+		}
+		// 有曲线无法计算时不能确定规则是否触发, 返回502, 调用方不能把结果当作没有触发
+		if data.Unknown {
+			RenderJsonStatus(w, http.StatusBadGateway, data)
+			return
+		}
+		RenderJson(w, data)
+	})
+
 }
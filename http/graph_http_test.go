@@ -0,0 +1,1032 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/aggregate"
+	"github.com/jianvhen/query/g"
+	"github.com/jianvhen/query/graph"
+	"github.com/jianvhen/query/graph/graphtest"
+	"github.com/jianvhen/query/service"
+)
+
+var (
+	fakeGraph *graphtest.Server
+	testSrv   *httptest.Server
+)
+
+const (
+	testCallTimeout     = 200
+	testMaxStreamPoints = 1000
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+
+	fakeGraph = graphtest.NewServer()
+
+	dir, err := ioutil.TempDir("", "query-test")
+	if err != nil {
+		panic(err)
+	}
+	cfg := fmt.Sprintf(`{
+		"http": {"enabled": true, "listen": "127.0.0.1:0"},
+		"graph": {
+			"connTimeout": 1000,
+			"callTimeout": %d,
+			"maxConns": 32,
+			"maxIdle": 32,
+			"replicas": 500,
+			"maxStreamPoints": %d,
+			"cluster": {"graph-00": "%s"}
+		}
+	}`, testCallTimeout, testMaxStreamPoints, fakeGraph.Addr)
+	cfgFile := filepath.Join(dir, "cfg.json")
+	if err := ioutil.WriteFile(cfgFile, []byte(cfg), 0644); err != nil {
+		panic(err)
+	}
+
+	g.ParseConfig(cfgFile)
+	graph.Start()
+	configCommonRoutes()
+	configGraphRoutes()
+	configApiRoutes()
+	configGrafanaRoutes()
+	testSrv = httptest.NewServer(http.DefaultServeMux)
+
+	code := m.Run()
+
+	testSrv.Close()
+	fakeGraph.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func setup(t *testing.T) {
+	fakeGraph.Reset()
+	graph.PurgeCache("")
+}
+
+func series(endpoint, counter string, step int, values ...float64) *cmodel.GraphQueryResponse {
+	s := &cmodel.GraphQueryResponse{Endpoint: endpoint, Counter: counter, DsType: "GAUGE", Step: step}
+	for i, v := range values {
+		s.Values = append(s.Values, &cmodel.RRDData{Timestamp: int64((i + 1) * step), Value: cmodel.JsonFloat(v)})
+	}
+	return s
+}
+
+// postJson 发送json请求, 返回状态码, 并把响应解析到v中
+func postJson(t *testing.T, path string, body interface{}, v interface{}) int {
+	bs, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(testSrv.URL+path, "application/json", bytes.NewReader(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decodeResp(t, resp, v)
+}
+
+func getForm(t *testing.T, path string, params url.Values, v interface{}) int {
+	resp, err := http.Get(testSrv.URL + path + "?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decodeResp(t, resp, v)
+}
+
+func decodeResp(t *testing.T, resp *http.Response, v interface{}) int {
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("decode response of %s: %v", resp.Request.URL.Path, err)
+	}
+	return resp.StatusCode
+}
+
+func historyBody(start, end int, ecs ...string) GraphHistoryParam {
+	body := GraphHistoryParam{Start: start, End: end, CF: "AVERAGE"}
+	for i := 0; i+1 < len(ecs); i += 2 {
+		body.EndpointCounters = append(body.EndpointCounters, cmodel.GraphInfoParam{Endpoint: ecs[i], Counter: ecs[i+1]})
+	}
+	return body
+}
+
+func envelopeItems(t *testing.T, path string, body interface{}) []*service.Item {
+	var envelope struct {
+		Items []*service.Item `json:"items"`
+	}
+	if code := postJson(t, path, body, &envelope); code != http.StatusOK {
+		t.Fatalf("%s: status %d", path, code)
+	}
+	return envelope.Items
+}
+
+func TestHistory(t *testing.T) {
+	setup(t)
+	fakeGraph.AddSeries(series("host01", "cpu.idle", 60, 1, 2, 3, 4))
+
+	var data []*cmodel.GraphQueryResponse
+	code := postJson(t, "/graph/history", historyBody(120, 180, "host01", "cpu.idle", "host01", "missing"), &data)
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(data) != 2 {
+		t.Fatalf("expected 2 series, got %d", len(data))
+	}
+	if s := data[0]; s.Counter != "cpu.idle" || s.Step != 60 || len(s.Values) != 2 || s.Values[0].Value != 2 || s.Values[1].Timestamp != 180 {
+		t.Fatalf("unexpected series: %+v", s)
+	}
+	if len(data[1].Values) != 0 {
+		t.Fatalf("missing counter should have no values: %+v", data[1])
+	}
+
+	var msg map[string]string
+	if code := postJson(t, "/graph/history", historyBody(0, 60), &msg); code != http.StatusBadRequest || msg["msg"] != "empty_payload" {
+		t.Fatalf("unexpected response to empty payload: %d %v", code, msg)
+	}
+}
+
+func TestHistoryAggregate(t *testing.T) {
+	setup(t)
+	fakeGraph.AddSeries(
+		series("host01", "net.if.in.bytes/iface=eth0", 60, 1, 2),
+		series("host02", "net.if.in.bytes/iface=eth0", 60, 10, 20),
+	)
+
+	body := map[string]interface{}{
+		"start": 60, "end": 120, "cf": "AVERAGE",
+		"endpoint_counters": []map[string]string{
+			{"endpoint": "host01", "counter": "net.if.in.bytes/iface=eth0"},
+			{"endpoint": "host02", "counter": "net.if.in.bytes/iface=eth0"},
+		},
+		"aggregate": map[string]string{"fn": "sum"},
+	}
+	var data []*cmodel.GraphQueryResponse
+	if code := postJson(t, "/graph/history", body, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(data) != 1 || data[0].Endpoint != "*" || len(data[0].Values) != 2 || data[0].Values[0].Value != 11 || data[0].Values[1].Value != 22 {
+		t.Fatalf("unexpected aggregation: %+v", data)
+	}
+}
+
+func TestHistoryEnvelope(t *testing.T) {
+	setup(t)
+	fakeGraph.AddSeries(series("host01", "cpu.idle", 60, 1))
+
+	items := envelopeItems(t, "/graph/history?envelope=1", historyBody(0, 60, "host01", "cpu.idle", "host01", "missing"))
+	if len(items) != 2 {
+		t.Fatalf("expected 2 items, got %d", len(items))
+	}
+	if items[0].Status != graph.StatusOk || items[0].Addr != fakeGraph.Addr || items[0].Data == nil {
+		t.Fatalf("unexpected item: %+v", items[0])
+	}
+	if items[1].Status != graph.StatusNotFound || items[1].Data != nil {
+		t.Fatalf("unexpected item: %+v", items[1])
+	}
+}
+
+func TestBackendFailures(t *testing.T) {
+	setup(t)
+	fakeGraph.AddSeries(series("host01", "cpu.idle", 60, 1))
+	body := historyBody(0, 60, "host01", "cpu.idle")
+
+	fakeGraph.SetError("Graph.Query", errors.New("disk failure"))
+	items := envelopeItems(t, "/graph/history?envelope=1", body)
+	if items[0].Status != graph.StatusBackendError || items[0].Addr != fakeGraph.Addr || items[0].Error == "" {
+		t.Fatalf("unexpected item: %+v", items[0])
+	}
+
+	// 默认格式下失败的结果没有数据点
+	var data []*cmodel.GraphQueryResponse
+	if code := postJson(t, "/graph/history", body, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	for _, s := range data {
+		if len(s.Values) != 0 {
+			t.Fatalf("failed call should have no values: %+v", s)
+		}
+	}
+	fakeGraph.SetError("Graph.Query", nil)
+
+	fakeGraph.SetLatency(2 * testCallTimeout * time.Millisecond)
+	items = envelopeItems(t, "/graph/history?envelope=1", body)
+	if items[0].Status != graph.StatusTimeout {
+		t.Fatalf("unexpected item: %+v", items[0])
+	}
+	fakeGraph.SetLatency(0)
+
+	fakeGraph.DropConnections(1)
+	items = envelopeItems(t, "/graph/history?envelope=1", body)
+	if items[0].Status != graph.StatusBackendError {
+		t.Fatalf("unexpected item: %+v", items[0])
+	}
+
+	// 断开的连接被丢弃, 之后的请求恢复正常
+	items = envelopeItems(t, "/graph/history?envelope=1", body)
+	if items[0].Status != graph.StatusOk {
+		t.Fatalf("unexpected item: %+v", items[0])
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	setup(t)
+	fakeGraph.AddSeries(series("host01", "cpu.idle", 60, 1))
+	fakeGraph.SetLatency(testCallTimeout / 2 * time.Millisecond)
+
+	begin := time.Now()
+	items := envelopeItems(t, "/graph/history?envelope=1&timeout=20", historyBody(0, 60, "host01", "cpu.idle"))
+	if items[0].Status != graph.StatusTimeout {
+		t.Fatalf("unexpected item: %+v", items[0])
+	}
+	if elapsed := time.Since(begin); elapsed >= testCallTimeout/2*time.Millisecond {
+		t.Fatalf("request deadline not applied, took %v", elapsed)
+	}
+
+	var msg map[string]string
+	if code := postJson(t, "/graph/history?timeout=abc", historyBody(0, 60, "host01", "cpu.idle"), &msg); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid timeout, got %d", code)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	setup(t)
+	fakeGraph.AddSeries(series("host01", "cpu.idle", 30, 1))
+
+	var data []*cmodel.GraphFullyInfo
+	body := []cmodel.GraphInfoParam{{Endpoint: "host01", Counter: "cpu.idle"}}
+	if code := postJson(t, "/graph/info", body, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(data) != 1 || data[0].Step != 30 || data[0].ConsolFun != "AVERAGE" || data[0].Addr != fakeGraph.Addr || data[0].Filename == "" {
+		t.Fatalf("unexpected info: %+v", data)
+	}
+
+	items := envelopeItems(t, "/graph/info?envelope=1", body)
+	if len(items) != 1 || items[0].Status != graph.StatusOk {
+		t.Fatalf("unexpected items: %+v", items)
+	}
+}
+
+func TestInfoOne(t *testing.T) {
+	setup(t)
+
+	var info cmodel.GraphFullyInfo
+	code := getForm(t, "/graph/info/one", url.Values{"endpoint": {"host01"}, "counter": {"cpu.idle"}}, &info)
+	if code != http.StatusOK || info.Endpoint != "host01" || info.Step != 60 || info.Addr != fakeGraph.Addr {
+		t.Fatalf("unexpected info: %d %+v", code, info)
+	}
+
+	var msg map[string]string
+	if code := getForm(t, "/graph/info/one", url.Values{"endpoint": {"host01"}}, &msg); code != http.StatusBadRequest || msg["msg"] != "empty_endpoint_counter" {
+		t.Fatalf("unexpected response: %d %v", code, msg)
+	}
+}
+
+func TestLast(t *testing.T) {
+	setup(t)
+	fakeGraph.AddSeries(series("host01", "cpu.idle", 60, 1, 2, math.NaN()))
+
+	var data []*cmodel.GraphLastResp
+	body := []cmodel.GraphLastParam{{Endpoint: "host01", Counter: "cpu.idle"}, {Endpoint: "host01", Counter: "missing"}}
+	if code := postJson(t, "/graph/last", body, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(data) != 2 || data[0].Value == nil || data[0].Value.Value != 2 || data[0].Value.Timestamp != 120 || data[1].Value != nil {
+		t.Fatalf("unexpected last: %+v", data)
+	}
+
+	items := envelopeItems(t, "/graph/last?envelope=1", body)
+	if len(items) != 2 || items[0].Status != graph.StatusOk || items[1].Status != graph.StatusNotFound {
+		t.Fatalf("unexpected items: %+v", items)
+	}
+}
+
+func TestLastRaw(t *testing.T) {
+	setup(t)
+	fakeGraph.SetLastRaw("host01", "cpu.idle", &cmodel.RRDData{Timestamp: 100, Value: 42})
+
+	var data []*cmodel.GraphLastResp
+	body := []cmodel.GraphLastParam{{Endpoint: "host01", Counter: "cpu.idle"}}
+	if code := postJson(t, "/graph/last/raw", body, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(data) != 1 || data[0].Value == nil || data[0].Value.Value != 42 {
+		t.Fatalf("unexpected last raw: %+v", data)
+	}
+	if n := fakeGraph.Calls("Graph.LastRaw"); n != 1 {
+		t.Fatalf("expected 1 call to Graph.LastRaw, got %d", n)
+	}
+}
+
+func TestHistoryOne(t *testing.T) {
+	setup(t)
+	fakeGraph.AddSeries(series("host01", "cpu.idle", 60, 1, 2, 3))
+
+	var data cmodel.GraphQueryResponse
+	params := url.Values{"endpoint": {"host01"}, "counter": {"cpu.idle"}, "cf": {"AVERAGE"}, "start": {"60"}, "end": {"120"}}
+	if code := getForm(t, "/graph/history/one", params, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if data.Counter != "cpu.idle" || len(data.Values) != 2 {
+		t.Fatalf("unexpected series: %+v", data)
+	}
+
+	var msg map[string]string
+	params.Set("cf", "SUM")
+	if code := getForm(t, "/graph/history/one", params, &msg); code != http.StatusBadRequest || msg["msg"] != "invalid_cf" {
+		t.Fatalf("unexpected response: %d %v", code, msg)
+	}
+}
+
+func TestHistoryOneSplit(t *testing.T) {
+	setup(t)
+	now := time.Now().Unix()
+	start := now - 3*86400
+	s := series("host01", "cpu.idle", 60)
+	for ts := start - start%60; ts <= now; ts += 60 {
+		s.Values = append(s.Values, &cmodel.RRDData{Timestamp: ts, Value: 1})
+	}
+	fakeGraph.AddSeries(s)
+
+	var data graph.PlannedResponse
+	params := url.Values{"endpoint": {"host01"}, "counter": {"cpu.idle"}, "cf": {"AVERAGE"},
+		"start": {fmt.Sprint(start)}, "end": {fmt.Sprint(now)}}
+	if code := getForm(t, "/graph/history/one", params, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+
+	// 3天跨越了前三个rra: 20*60秒(7天), 5*60秒(2天), 60秒(12小时)
+	segs := data.Segments
+	if len(segs) != 3 || segs[0].Step != 1200 || segs[1].Step != 300 || segs[2].Step != 60 {
+		t.Fatalf("unexpected segments: %+v", segs)
+	}
+	if segs[0].Start != start || segs[2].End != now || segs[0].End+1 != segs[1].Start || segs[1].End+1 != segs[2].Start {
+		t.Fatalf("segments do not cover [%d, %d]: %+v %+v %+v", start, now, segs[0], segs[1], segs[2])
+	}
+	if n := fakeGraph.Calls("Graph.Query"); n != 3 {
+		t.Fatalf("expected 3 calls to Graph.Query, got %d", n)
+	}
+	if n := fakeGraph.Calls("Graph.Info"); n != 1 {
+		t.Fatalf("expected 1 call to Graph.Info, got %d", n)
+	}
+
+	count := func(start, end int64) int {
+		n := 0
+		for _, v := range s.Values {
+			if v.Timestamp >= start && v.Timestamp <= end {
+				n++
+			}
+		}
+		return n
+	}
+	if expected := count(start, now); data.Step != 60 || len(data.Values) != expected {
+		t.Fatalf("expected %d points at step 60, got %d at step %d", expected, len(data.Values), data.Step)
+	}
+	for i := 1; i < len(data.Values); i++ {
+		if data.Values[i].Timestamp <= data.Values[i-1].Timestamp {
+			t.Fatalf("values out of order at %d: %d after %d", i, data.Values[i].Timestamp, data.Values[i-1].Timestamp)
+		}
+	}
+
+	// 最近1小时只落在第一个rra中, 不调用Graph.Info, 不分段
+	fakeGraph.Reset()
+	fakeGraph.AddSeries(s)
+	data = graph.PlannedResponse{}
+	params.Set("start", fmt.Sprint(now-3600))
+	if code := getForm(t, "/graph/history/one", params, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(data.Segments) != 0 || len(data.Values) != count(now-3600, now) {
+		t.Fatalf("unexpected response: %d points, segments %+v", len(data.Values), data.Segments)
+	}
+	if q, i := fakeGraph.Calls("Graph.Query"), fakeGraph.Calls("Graph.Info"); q != 1 || i != 0 {
+		t.Fatalf("expected 1 call to Graph.Query and none to Graph.Info, got %d and %d", q, i)
+	}
+
+	// /graph/history同样分段查询(13小时跨越前两个rra); host01的步长已经缓存, 只为host02调用Graph.Info
+	fakeGraph.Reset()
+	fakeGraph.AddSeries(s, series("host02", "cpu.idle", 60, 1, 2, 3))
+	start = now - 13*3600
+	var history []*cmodel.GraphQueryResponse
+	body := historyBody(int(start), int(now), "host01", "cpu.idle", "host02", "cpu.idle")
+	if code := postJson(t, "/graph/history", body, &history); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(history) != 2 || history[0].Step != 60 || len(history[0].Values) != count(start, now) || len(history[1].Values) != 0 {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+	if q, i := fakeGraph.Calls("Graph.Query"), fakeGraph.Calls("Graph.Info"); q != 4 || i != 1 {
+		t.Fatalf("expected 4 calls to Graph.Query and 1 to Graph.Info, got %d and %d", q, i)
+	}
+}
+
+func TestSdpOne(t *testing.T) {
+	setup(t)
+	now := time.Now().Unix()
+	s := series("host01", "cpu.idle", 60)
+	s2 := series("host01", "cpu.busy", 60)
+	for ts := now - 1800; ts <= now; ts += 60 {
+		s.Values = append(s.Values, &cmodel.RRDData{Timestamp: ts, Value: 1})
+		s2.Values = append(s2.Values, &cmodel.RRDData{Timestamp: ts, Value: 2})
+	}
+	fakeGraph.AddSeries(s, s2)
+
+	var data struct {
+		Timestamp []int64              `json:"timestamp"`
+		Data      map[string][]float64 `json:"data"`
+	}
+	params := url.Values{"endpoint": {"host01"}, "counter": {"cpu.idle", "cpu.busy"}, "duration": {"1h"}, "step": {"300"}}
+	if code := getForm(t, "/graph/sdp/one", params, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(data.Timestamp) < 12 || len(data.Data) != 2 || len(data.Data["cpu.busy"]) != len(data.Timestamp) {
+		t.Fatalf("unexpected echarts data: %+v", data)
+	}
+	if v := data.Data["cpu.busy"][len(data.Timestamp)-2]; v != 2 {
+		t.Fatalf("unexpected value: %v", v)
+	}
+}
+
+func TestSdpAlive(t *testing.T) {
+	setup(t)
+	now := time.Now().Unix()
+	fakeGraph.SetLast("alive01", "agent.alive", &cmodel.RRDData{Timestamp: now - 30, Value: 1})
+	fakeGraph.SetLast("dead01", "agent.alive", &cmodel.RRDData{Timestamp: now - 3600, Value: 1})
+
+	var data []*GraphAliveResponse
+	body := []GraphAliveParam{{Endpoint: "alive01"}, {Endpoint: "dead01"}, {Endpoint: "gone01"}}
+	if code := postJson(t, "/graph/sdp/alive", body, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(data) != 3 || data[0].Status != 1 || data[1].Status != 0 || data[2].Status != 0 {
+		t.Fatalf("unexpected alive status: %+v", data)
+	}
+}
+
+func TestAlive(t *testing.T) {
+	setup(t)
+	now := time.Now().Unix()
+	fakeGraph.SetLast("web01", "agent.alive", &cmodel.RRDData{Timestamp: now - 30, Value: 1})
+	fakeGraph.SetLast("web02", "agent.alive", &cmodel.RRDData{Timestamp: now - 300, Value: 1})
+	fakeGraph.SetLast("db01", "agent.alive", &cmodel.RRDData{Timestamp: now - 300, Value: 1})
+	fakeGraph.SetLast("web01", "custom.heartbeat", &cmodel.RRDData{Timestamp: now - 1000, Value: 1})
+
+	body := service.AliveParam{
+		Endpoints: []string{"web01", "web02", "db01", "gone01"},
+		Groups:    []*g.AliveGroup{{Pattern: "db*", Threshold: 600}},
+	}
+	var data []*service.AliveItem
+	if code := postJson(t, "/graph/alive", body, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(data) != 4 {
+		t.Fatalf("expected 4 items, got %d", len(data))
+	}
+	for i, want := range []struct {
+		status    int
+		threshold int
+	}{{1, 120}, {0, 120}, {1, 600}, {0, 120}} {
+		if data[i].Status != want.status || data[i].Threshold != want.threshold || data[i].Addr != fakeGraph.Addr {
+			t.Fatalf("unexpected item %d: %+v", i, data[i])
+		}
+	}
+	if data[0].LastSeen != now-30 || data[0].Age < 30 || data[3].LastSeen != -1 || data[3].Age != -1 {
+		t.Fatalf("unexpected last seen: %+v %+v", data[0], data[3])
+	}
+
+	// 只返回不存活的endpoint
+	body.StaleOnly = true
+	if code := postJson(t, "/graph/alive", body, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(data) != 2 || data[0].Endpoint != "web02" || data[1].Endpoint != "gone01" {
+		t.Fatalf("unexpected stale endpoints: %+v", data)
+	}
+
+	// 自定义心跳counter和threshold
+	body = service.AliveParam{Endpoints: []string{"web01"}, Counter: "custom.heartbeat", Threshold: 3600}
+	if code := postJson(t, "/graph/alive", body, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(data) != 1 || data[0].Status != 1 || data[0].Threshold != 3600 || data[0].LastSeen != now-1000 {
+		t.Fatalf("unexpected item: %+v", data)
+	}
+}
+
+func TestStale(t *testing.T) {
+	setup(t)
+	now := time.Now().Unix()
+	fakeGraph.SetLast("host01", "cpu.idle", &cmodel.RRDData{Timestamp: now - 30, Value: 90})
+	fakeGraph.SetLast("host01", "disk.io.util", &cmodel.RRDData{Timestamp: now - 700, Value: 5})
+
+	body := service.StaleParam{
+		EndpointCounters: []cmodel.GraphInfoParam{
+			{Endpoint: "host01", Counter: "cpu.idle"},
+			{Endpoint: "host01", Counter: "disk.io.util"},
+			{Endpoint: "host01", Counter: "mem.memfree"},
+		},
+		MaxAge: 600,
+	}
+	var data service.StaleReport
+	if code := postJson(t, "/graph/stale", body, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if data.Total != 3 || data.Stale != 2 || data.Errors != 0 || len(data.Nodes) != 1 {
+		t.Fatalf("unexpected report: %+v", data)
+	}
+	node := data.Nodes[0]
+	if node.Addr != fakeGraph.Addr || node.Total != 3 || node.Stale != 2 || len(node.Items) != 3 {
+		t.Fatalf("unexpected node: %+v", node)
+	}
+	fresh, stale, missing := node.Items[0], node.Items[1], node.Items[2]
+	if fresh.Status != service.StaleFresh || fresh.StaleFor != 0 || fresh.Value == nil || *fresh.Value != 90 {
+		t.Fatalf("unexpected fresh item: %+v", fresh)
+	}
+	if stale.Status != service.StaleStale || stale.LastSeen != now-700 || stale.StaleFor < 100 || *stale.Value != 5 {
+		t.Fatalf("unexpected stale item: %+v", stale)
+	}
+	if missing.Status != service.StaleStale || missing.LastSeen != -1 || missing.Value != nil {
+		t.Fatalf("unexpected missing item: %+v", missing)
+	}
+
+	// 只返回stale和查询失败的曲线, 统计数字不变
+	fakeGraph.SetError("Graph.Last", errors.New("disk failure"))
+	body.StaleOnly = true
+	data = service.StaleReport{}
+	if code := postJson(t, "/graph/stale", body, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if data.Total != 3 || data.Stale != 0 || data.Errors != 3 || len(data.Nodes[0].Items) != 3 {
+		t.Fatalf("unexpected report: %+v", data)
+	}
+	if item := data.Nodes[0].Items[0]; item.Status != graph.StatusBackendError || item.Error == "" {
+		t.Fatalf("unexpected item: %+v", item)
+	}
+
+	fakeGraph.SetError("Graph.Last", nil)
+	data = service.StaleReport{}
+	if code := postJson(t, "/graph/stale", body, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if data.Total != 3 || data.Stale != 2 || len(data.Nodes[0].Items) != 2 {
+		t.Fatalf("unexpected report: %+v", data)
+	}
+
+	body.MaxAge = 0
+	var msg map[string]string
+	if code := postJson(t, "/graph/stale", body, &msg); code == http.StatusOK {
+		t.Fatal("expected error for invalid max_age")
+	}
+}
+
+func TestExpr(t *testing.T) {
+	setup(t)
+	fakeGraph.AddSeries(
+		series("host01", "disk.used", 60, 50, 60, 70),
+		series("host01", "disk.total", 60, 100, 100, 0),
+		series("host01", "net.if.in.bytes", 60, 0, 600, 1200, 600),
+		series("host02", "disk.used", 60, 40, 40, 40),
+	)
+
+	// NaN输出为null, 解析为nil
+	type point struct {
+		Timestamp int64    `json:"timestamp"`
+		Value     *float64 `json:"value"`
+	}
+	type result struct {
+		Endpoint string   `json:"endpoint"`
+		Counter  string   `json:"counter"`
+		Step     int      `json:"step"`
+		Values   []*point `json:"Values"`
+	}
+	values := func(s *result) string {
+		ret := []interface{}{}
+		for _, p := range s.Values {
+			if p.Value == nil {
+				ret = append(ret, nil)
+			} else {
+				ret = append(ret, *p.Value)
+			}
+		}
+		return fmt.Sprint(ret)
+	}
+	query := func(expr string) []*result {
+		var data []*result
+		body := service.ExprParam{Expr: expr, Endpoint: "host01", Start: 60, End: 180}
+		if code := postJson(t, "/graph/expr", body, &data); code != http.StatusOK {
+			t.Fatalf("%s: status %d", expr, code)
+		}
+		return data
+	}
+
+	// 除以0的结果为NaN, 输出为null
+	data := query("disk.used / disk.total * 100")
+	if len(data) != 1 || data[0].Endpoint != "host01" || data[0].Counter != "((disk.used / disk.total) * 100)" || data[0].Step != 60 {
+		t.Fatalf("unexpected result: %+v", data)
+	}
+	if values(data[0]) != "[50 60 <nil>]" {
+		t.Fatalf("unexpected values: %v", values(data[0]))
+	}
+
+	data = query("host01:disk.used - host02:disk.used")
+	if len(data) != 1 || data[0].Endpoint != "*" || values(data[0]) != "[10 20 30]" {
+		t.Fatalf("unexpected result: %+v %v", data, values(data[0]))
+	}
+
+	data = query("rate(net.if.in.bytes)")
+	if len(data) != 1 || data[0].Counter != "rate(net.if.in.bytes)" || values(data[0]) != "[<nil> 10 10]" {
+		t.Fatalf("unexpected result: %+v %v", data, values(data[0]))
+	}
+
+	data = query("clamp(scale(moving_avg(disk.used, 2), 2), 0, 125)")
+	if len(data) != 1 || values(data[0]) != "[100 110 125]" {
+		t.Fatalf("unexpected result: %+v %v", data, values(data[0]))
+	}
+
+	var msg map[string]string
+	for _, expr := range []string{"", "disk.used +", "unknown(disk.used)", "rate(1)", "topk(disk.used, 1)", "abs(disk.used, 1)"} {
+		body := service.ExprParam{Expr: expr, Endpoint: "host01", Start: 60, End: 180}
+		if code := postJson(t, "/graph/expr", body, &msg); code != http.StatusBadRequest || msg["msg"] == "" {
+			t.Fatalf("%q: expected error, got %d %v", expr, code, msg)
+		}
+	}
+}
+
+func TestTopN(t *testing.T) {
+	setup(t)
+	now := time.Now().Unix()
+	recent := func(endpoint string, values ...float64) *cmodel.GraphQueryResponse {
+		s := &cmodel.GraphQueryResponse{Endpoint: endpoint, Counter: "cpu.busy", DsType: "GAUGE", Step: 60}
+		for i, v := range values {
+			s.Values = append(s.Values, &cmodel.RRDData{Timestamp: now - int64(len(values)-i)*60, Value: cmodel.JsonFloat(v)})
+		}
+		return s
+	}
+	fakeGraph.AddSeries(
+		recent("host01", 10, 90, 20),
+		recent("host02", 50, 50, 50),
+		recent("host03", 5, 5, 95),
+	)
+
+	ranked := func(param service.TopNParam) string {
+		var data []*service.TopNItem
+		if code := postJson(t, "/graph/topn", param, &data); code != http.StatusOK {
+			t.Fatalf("%+v: status %d", param, code)
+		}
+		ret := []string{}
+		for i, item := range data {
+			if item.Rank != i+1 || item.Counter != "cpu.busy" {
+				t.Fatalf("unexpected item: %+v", item)
+			}
+			ret = append(ret, fmt.Sprintf("%s=%v", item.Endpoint, item.Value))
+		}
+		return fmt.Sprint(ret)
+	}
+
+	endpoints := []string{"host01", "host02", "host03", "host04"}
+	// 最新值, host04没有数据, 不参与排名
+	if got := ranked(service.TopNParam{Endpoints: endpoints, Counter: "cpu.busy"}); got != "[host03=95 host02=50 host01=20]" {
+		t.Fatalf("unexpected ranking: %s", got)
+	}
+	if got := ranked(service.TopNParam{Endpoints: endpoints, Counter: "cpu.busy", Reducer: "avg", Window: 3600, N: 2}); got != "[host02=50 host01=40]" {
+		t.Fatalf("unexpected ranking: %s", got)
+	}
+	if got := ranked(service.TopNParam{Endpoints: endpoints, Counter: "cpu.busy", Reducer: "max", Window: 3600, Direction: "asc"}); got != "[host02=50 host01=90 host03=95]" {
+		t.Fatalf("unexpected ranking: %s", got)
+	}
+
+	var msg map[string]string
+	for _, param := range []service.TopNParam{
+		{Counter: "cpu.busy"},
+		{Endpoints: endpoints, Counter: "cpu.busy", Reducer: "avg"},
+		{Endpoints: endpoints, Counter: "cpu.busy", Reducer: "median", Window: 60},
+		{Endpoints: endpoints, Counter: "cpu.busy", Direction: "up"},
+	} {
+		if code := postJson(t, "/graph/topn", param, &msg); code != http.StatusBadRequest {
+			t.Fatalf("%+v: expected error, got %d", param, code)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	setup(t)
+	// 60秒一个点, end为600, 最近5分钟为 (300, 600]
+	fakeGraph.AddSeries(
+		series("host01", "cpu.busy", 60, 10, 10, 12, 8, 10, 10, 11, 9, 10, 99),
+		series("host02", "cpu.busy", 60, 10, 12, 8, 10, 11, 9, 10, 12, 8, 10),
+	)
+
+	body := service.EvaluateParam{
+		EndpointCounters: []cmodel.GraphInfoParam{{Endpoint: "host01", Counter: "cpu.busy"}, {Endpoint: "host02", Counter: "cpu.busy"}, {Endpoint: "host03", Counter: "cpu.busy"}},
+		Rules:            []string{"avg(5m) > 90", "all(3m) < 20", "zscore(5m) > 3"},
+		End:              600,
+	}
+	var data service.EvaluateResult
+	if code := postJson(t, "/graph/evaluate", body, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if !data.Fired || len(data.Items) != 9 {
+		t.Fatalf("unexpected result: %+v", data)
+	}
+
+	expected := []struct {
+		status string
+		fired  bool
+		points int
+	}{
+		// host01: 最近5分钟为 10, 11, 9, 10, 99, 平均值27.8; 最新的点99相对于基线[300, 540]突增
+		{graph.StatusOk, false, 0}, {graph.StatusOk, false, 0}, {graph.StatusOk, true, 1},
+		{graph.StatusOk, false, 0}, {graph.StatusOk, true, 3}, {graph.StatusOk, false, 0},
+		{graph.StatusNotFound, false, 0}, {graph.StatusNotFound, false, 0}, {graph.StatusNotFound, false, 0},
+	}
+	for i, want := range expected {
+		item := data.Items[i]
+		if item.Status != want.status || item.Fired != want.fired || len(item.Points) != want.points {
+			t.Fatalf("unexpected item %d: %+v", i, item)
+		}
+	}
+	if p := data.Items[2].Points[0]; p.Timestamp != 600 || p.Value != 99 || data.Items[0].Value != 27.8 {
+		t.Fatalf("unexpected items: %+v %+v", data.Items[0], p)
+	}
+
+	body.Rules = []string{"any(4m) >= 10", "max(10m) > 90"}
+	data = service.EvaluateResult{}
+	if code := postJson(t, "/graph/evaluate", body, &data); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if item := data.Items[0]; !item.Fired || item.Value != 3 || len(item.Points) != 3 || item.Points[0].Timestamp != 420 {
+		t.Fatalf("unexpected item: %+v", item)
+	}
+	if item := data.Items[1]; !item.Fired || item.Value != 99 || len(item.Points) != 1 || item.Points[0].Timestamp != 600 {
+		t.Fatalf("unexpected item: %+v", item)
+	}
+
+	if data.Unknown || data.Errors != 0 {
+		t.Fatalf("unexpected result: %+v", data)
+	}
+
+	// 查询失败时不能确定是否触发, 返回502
+	fakeGraph.SetError("Graph.Query", errors.New("disk failure"))
+	data = service.EvaluateResult{}
+	if code := postJson(t, "/graph/evaluate", body, &data); code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", code)
+	}
+	if data.Fired || !data.Unknown || data.Errors != 3 || data.Items[0].Status != graph.StatusBackendError {
+		t.Fatalf("unexpected result: %+v", data)
+	}
+	fakeGraph.SetError("Graph.Query", nil)
+
+	var msg map[string]string
+	for _, rules := range [][]string{nil, {"avg(5m)"}, {"median(5m) > 1"}, {"avg(5x) > 1"}, {"avg(5m) > high"}, {"avg(5m) > NaN"}} {
+		body.Rules = rules
+		if code := postJson(t, "/graph/evaluate", body, &msg); code != http.StatusBadRequest {
+			t.Fatalf("%v: expected error, got %d", rules, code)
+		}
+	}
+}
+
+func TestHistoryExport(t *testing.T) {
+	setup(t)
+	fakeGraph.AddSeries(
+		series("host01", "cpu.idle", 60, 1, math.NaN(), 3),
+		series("host02", "net.if.in.bytes/iface=eth 0", 60, 10, 20.5),
+	)
+	body := historyBody(60, 180, "host01", "cpu.idle", "host02", "net.if.in.bytes/iface=eth 0")
+
+	export := func(query string, accept string) (int, string, string) {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", testSrv.URL+"/graph/history?"+query, bytes.NewReader(bs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header.Get("Content-Type"), string(out)
+	}
+
+	expected := []struct {
+		query, accept, contentType, body string
+	}{
+		{"format=csv", "", "text/csv; charset=UTF-8",
+			"timestamp,host01:cpu.idle,host02:net.if.in.bytes/iface=eth 0\n60,1,10\n120,,20.5\n180,3,\n"},
+		{"", "text/csv", "text/csv; charset=UTF-8",
+			"timestamp,host01:cpu.idle,host02:net.if.in.bytes/iface=eth 0\n60,1,10\n120,,20.5\n180,3,\n"},
+		{"format=csv&layout=long&time_format=unix_ms", "", "text/csv; charset=UTF-8",
+			"timestamp,endpoint,counter,value\n60000,host01,cpu.idle,1\n120000,host01,cpu.idle,\n180000,host01,cpu.idle,3\n" +
+				"60000,host02,net.if.in.bytes/iface=eth 0,10\n120000,host02,net.if.in.bytes/iface=eth 0,20.5\n"},
+		{"format=ndjson", "", "application/x-ndjson",
+			`{"endpoint":"host01","counter":"cpu.idle","timestamp":60,"value":1.000000}` + "\n" +
+				`{"endpoint":"host01","counter":"cpu.idle","timestamp":120,"value":null}` + "\n" +
+				`{"endpoint":"host01","counter":"cpu.idle","timestamp":180,"value":3.000000}` + "\n" +
+				`{"endpoint":"host02","counter":"net.if.in.bytes/iface=eth 0","timestamp":60,"value":10.000000}` + "\n" +
+				`{"endpoint":"host02","counter":"net.if.in.bytes/iface=eth 0","timestamp":120,"value":20.500000}` + "\n"},
+		{"", "application/x-influxdb-line-protocol", "text/plain; charset=UTF-8",
+			"cpu.idle,endpoint=host01 value=1 60000000000\ncpu.idle,endpoint=host01 value=3 180000000000\n" +
+				"net.if.in.bytes,endpoint=host02,iface=eth\\ 0 value=10 60000000000\nnet.if.in.bytes,endpoint=host02,iface=eth\\ 0 value=20.5 120000000000\n"},
+	}
+	// csv的long布局、ndjson、influx默认流式输出, 曲线的顺序与请求无关, 按行比较
+	sortedLines := func(s string) string {
+		lines := strings.Split(s, "\n")
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+	}
+	for _, want := range expected {
+		code, contentType, out := export(want.query, want.accept)
+		if code != http.StatusOK || contentType != want.contentType || sortedLines(out) != sortedLines(want.body) {
+			t.Fatalf("%s %s: unexpected response %d %s\n%s", want.query, want.accept, code, contentType, out)
+		}
+	}
+	// stream=0时查询完成后按请求的顺序输出
+	if _, _, out := export("format=ndjson&stream=0", ""); out != expected[3].body {
+		t.Fatalf("unexpected buffered ndjson: %s", out)
+	}
+
+	_, _, out := export("format=ndjson&time_format=rfc3339", "")
+	if !strings.Contains(out, `"timestamp":"`+time.Unix(60, 0).Format(time.RFC3339)+`"`) {
+		t.Fatalf("unexpected rfc3339 timestamps: %s", out)
+	}
+
+	// 默认仍然是json
+	if code, contentType, _ := export("", "text/html,*/*"); code != http.StatusOK || !strings.HasPrefix(contentType, "application/json") {
+		t.Fatalf("unexpected default format: %d %s", code, contentType)
+	}
+	for _, query := range []string{"format=xml", "format=csv&layout=tall", "format=influx&time_format=rfc3339", "format=csv&envelope=1"} {
+		if code, _, _ := export(query, ""); code != http.StatusBadRequest {
+			t.Fatalf("%s: expected error, got %d", query, code)
+		}
+	}
+}
+
+func TestHistoryStream(t *testing.T) {
+	setup(t)
+	fakeGraph.AddSeries(
+		series("host01", "cpu.idle", 60, 1, math.NaN(), 3),
+		series("host02", "cpu.idle", 60, 10, 20),
+	)
+
+	stream := func(query string, body GraphHistoryParam) (*http.Response, string) {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(testSrv.URL+"/graph/history?stream=1&"+query, "application/json", bytes.NewReader(bs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		out, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(out)
+	}
+
+	body := historyBody(60, 180, "host01", "cpu.idle", "host02", "cpu.idle", "host03", "cpu.idle")
+	resp, out := stream("", body)
+	var msg map[string]string
+	var data []*cmodel.GraphQueryResponse
+	if err := json.Unmarshal([]byte(out), &data); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", resp.StatusCode, out)
+	}
+	points := map[string]int{}
+	for _, s := range data {
+		points[s.Endpoint] = len(s.Values)
+	}
+	if len(data) != 3 || points["host01"] != 3 || points["host02"] != 2 || points["host03"] != 0 {
+		t.Fatalf("unexpected series: %s", out)
+	}
+	if resp.Trailer.Get("X-Query-Error") != "" {
+		t.Fatalf("unexpected error trailer: %s", resp.Trailer.Get("X-Query-Error"))
+	}
+
+	resp, out = stream("format=ndjson", body)
+	if resp.Header.Get("Content-Type") != "application/x-ndjson" || strings.Count(out, "\n") != 5 || !strings.Contains(out, `"value":null`) {
+		t.Fatalf("unexpected ndjson: %s", out)
+	}
+
+	// 超过maxStreamPoints: 已经开始输出时, 错误写入trailer, 输出不能被当作完整的结果
+	many := func(endpoint string, n int) *cmodel.GraphQueryResponse {
+		values := make([]float64, n)
+		return series(endpoint, "cpu.idle", 60, values...)
+	}
+	fakeGraph.AddSeries(many("big01", testMaxStreamPoints*2/3), many("big02", testMaxStreamPoints*2/3))
+	bigBody := historyBody(0, 1<<30, "big01", "cpu.idle", "big02", "cpu.idle")
+	for _, format := range []string{"json", "ndjson", "influx", "csv&layout=long"} {
+		resp, out = stream("format="+format, bigBody)
+		if msg := resp.Trailer.Get("X-Query-Error"); resp.StatusCode != http.StatusOK || !strings.HasPrefix(msg, "too many points") {
+			t.Fatalf("%s: unexpected response %d, trailer %q", format, resp.StatusCode, msg)
+		}
+		// 输出的顺序与请求无关, 只有先返回的一条曲线被输出
+		if strings.Contains(out, "big01") == strings.Contains(out, "big02") {
+			t.Fatalf("%s: unexpected output %.200s", format, out)
+		}
+	}
+	// json数组不闭合, 不能解析
+	var truncated []*cmodel.GraphQueryResponse
+	if _, out = stream("", bigBody); json.Unmarshal([]byte(out), &truncated) == nil || strings.HasSuffix(out, "]") {
+		t.Fatalf("truncated json parsed as complete: %.200s", out)
+	}
+	// ndjson的最后一行是错误
+	_, out = stream("format=ndjson", bigBody)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	var last map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil || !strings.HasPrefix(fmt.Sprint(last["error"]), "too many points") || last["endpoint"] != nil {
+		t.Fatalf("unexpected last line: %s", lines[len(lines)-1])
+	}
+
+	// 非流式的查询同样受maxStreamPoints限制
+	if code := postJson(t, "/graph/history", bigBody, &msg); code != http.StatusBadRequest || !strings.HasPrefix(msg["msg"], "too many points") {
+		t.Fatalf("expected too many points, got %d %v", code, msg)
+	}
+	if code := postJson(t, "/graph/history?envelope=1", bigBody, &msg); code != http.StatusBadRequest || !strings.HasPrefix(msg["msg"], "too many points") {
+		t.Fatalf("expected too many points, got %d %v", code, msg)
+	}
+	// 非流式的查询在曲线返回时累计数据点, 超过上限后不再发出新的调用
+	capped := []string{}
+	for i := 0; i < 40; i++ {
+		endpoint := fmt.Sprintf("cap%02d", i)
+		fakeGraph.AddSeries(many(endpoint, testMaxStreamPoints*2/3))
+		capped = append(capped, endpoint, "cpu.idle")
+	}
+	before := fakeGraph.Calls("Graph.Query")
+	if code := postJson(t, "/graph/history", historyBody(0, 1<<30, capped...), &msg); code != http.StatusBadRequest || !strings.HasPrefix(msg["msg"], "too many points") {
+		t.Fatalf("expected too many points, got %d %v", code, msg)
+	}
+	if n := fakeGraph.Calls("Graph.Query") - before; n >= 40 {
+		t.Fatalf("expected the query to stop early, got %d calls", n)
+	}
+
+	// 输出阻塞时(客户端读取慢)暂停发出新的调用: 在途的调用数不超过maxConcurrentPerNode(默认8), 加上正在输出和等待输出的2个
+	params := []cmodel.GraphQueryParam{}
+	for i := 0; i < 100; i++ {
+		params = append(params, cmodel.GraphQueryParam{Start: 60, End: 180, ConsolFun: "AVERAGE", Endpoint: fmt.Sprintf("bp%03d", i), Counter: "cpu.idle"})
+	}
+	before = fakeGraph.Calls("Graph.Query")
+	release := make(chan struct{})
+	done := make(chan error)
+	delivered := 0
+	go func() {
+		done <- graph.QueryStream(context.Background(), params, func(i int, resp *cmodel.GraphQueryResponse, err error) error {
+			<-release
+			delivered++
+			return err
+		})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if n := fakeGraph.Calls("Graph.Query") - before; n > 10 {
+		t.Fatalf("expected calls to pause while output is blocked, got %d calls", n)
+	}
+	close(release)
+	if err := <-done; err != nil || delivered != len(params) {
+		t.Fatalf("unexpected stream result: %v, %d delivered", err, delivered)
+	}
+
+	// 还没有开始输出时返回400
+	fakeGraph.AddSeries(many("huge01", testMaxStreamPoints+1))
+	for _, c := range []struct {
+		query string
+		body  GraphHistoryParam
+	}{
+		{"", historyBody(0, 1<<30, "huge01", "cpu.idle")},
+		{"format=csv", body},
+		{"", GraphHistoryParam{Start: 60, End: 180, CF: "AVERAGE", EndpointCounters: body.EndpointCounters, Aggregate: &aggregate.Param{Fn: "sum"}}},
+	} {
+		resp, out := stream(c.query, c.body)
+		if resp.StatusCode != http.StatusBadRequest || json.Unmarshal([]byte(out), &msg) != nil || msg["msg"] == "" {
+			t.Fatalf("%s: expected error, got %d %s", c.query, resp.StatusCode, out)
+		}
+	}
+}
@@ -1,12 +1,18 @@
 package http
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"strconv"
+	"time"
 
+	"github.com/jianvhen/query/auth"
 	"github.com/jianvhen/query/g"
+	"github.com/jianvhen/query/proc"
 )
 
 type Dto struct {
@@ -32,13 +38,58 @@ func Start() {
 	s := &http.Server{
 		Addr:           addr,
 		MaxHeaderBytes: 1 << 30,
+		Handler:        withAuth(withLatency(http.DefaultServeMux)),
 	}
 
 	log.Println("http.Start ok, listening on", addr)
 	log.Fatalln(s.ListenAndServe())
 }
 
+// withLatency 按路由统计http请求的延迟
+func withLatency(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		mux.ServeHTTP(w, r)
+
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		proc.HttpRequestLatency.Observe(route, time.Since(start).Seconds())
+	})
+}
+
+// requestContext 返回与请求绑定的context, 客户端断开时取消;
+// 请求参数timeout(毫秒)为整个请求的deadline, 不超过graph.maxRequestTimeout; 没有timeout参数时使用maxRequestTimeout
+func requestContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	max := time.Duration(g.Config().Graph.MaxRequestTimeout) * time.Millisecond
+
+	timeout := max
+	if param := r.URL.Query().Get("timeout"); param != "" {
+		ms, err := strconv.ParseInt(param, 10, 64)
+		if err != nil || ms <= 0 {
+			return nil, nil, errors.New("invalid timeout")
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+		if max > 0 && timeout > max {
+			timeout = max
+		}
+	}
+
+	if timeout <= 0 {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
+
 func RenderJson(w http.ResponseWriter, v interface{}) {
+	RenderJsonStatus(w, http.StatusOK, v)
+}
+
+// RenderJsonStatus 以指定的状态码输出json; 头部要在WriteHeader之前设置
+func RenderJsonStatus(w http.ResponseWriter, code int, v interface{}) {
 	bs, err := json.Marshal(v)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -49,6 +100,7 @@ func RenderJson(w http.ResponseWriter, v interface{}) {
 	w.Header().Set("Access-Control-Allow-Methods", "POST,GET,OPTIONS,PUT")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.WriteHeader(code)
 	w.Write(bs)
 }
 
@@ -68,10 +120,14 @@ func AutoRender(w http.ResponseWriter, data interface{}, err error) {
 	RenderDataJson(w, data)
 }
 
+// StdRender 出错时返回400, 调用方不能读取请求引用的endpoint(*auth.ForbiddenError)时返回403
 func StdRender(w http.ResponseWriter, data interface{}, err error) {
+	if _, ok := err.(*auth.ForbiddenError); ok {
+		RenderJsonStatus(w, http.StatusForbidden, map[string]string{"msg": err.Error()})
+		return
+	}
 	if err != nil {
-		w.WriteHeader(400)
-		RenderMsgJson(w, err.Error())
+		RenderJsonStatus(w, http.StatusBadRequest, map[string]string{"msg": err.Error()})
 		return
 	}
 	RenderJson(w, data)
@@ -21,7 +21,35 @@ func configProcHttpRoutes() {
 
 	// conn pools
 	http.HandleFunc("/proc/connpool", func(w http.ResponseWriter, r *http.Request) {
-		result := strings.Join(graph.GraphConnPools.Proc(), "\n")
+		result := strings.Join(graph.ProcConnPools(), "\n")
 		w.Write([]byte(result))
 	})
+
+	// prometheus
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		proc.WriteMetrics(w)
+
+		active := make(map[string]float64)
+		idle := make(map[string]float64)
+		open := make(map[string]float64)
+		forceClosed := make(map[string]float64)
+		for _, stat := range graph.PoolStats() {
+			active[stat.Addr] = float64(stat.Active)
+			idle[stat.Addr] = float64(stat.Idle)
+			forceClosed[stat.Addr] = float64(stat.ForceClosed)
+			if stat.Circuit != graph.CircuitClosed {
+				open[stat.Addr] = 1
+			} else {
+				open[stat.Addr] = 0
+			}
+		}
+		proc.WriteGauge(w, "graph_pool_active_conns", "Connections in use by graph backend.", "addr", active)
+		proc.WriteGauge(w, "graph_pool_idle_conns", "Idle connections by graph backend.", "addr", idle)
+		proc.WriteGauge(w, "graph_pool_force_closed_conns", "Connections force closed in the current conn pool of graph backend.", "addr", forceClosed)
+		historySize, lastSize := graph.CacheSize()
+		proc.WriteGauge(w, "cache_items", "Items in the result cache.", "cache",
+			map[string]float64{"history": float64(historySize), "last": float64(lastSize)})
+		proc.WriteGauge(w, "graph_circuit_open", "Whether the circuit breaker of graph backend is open or half-open.", "addr", open)
+	})
 }
@@ -3,7 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/jianvhen/query/g"
 	"github.com/jianvhen/query/graph"
@@ -35,7 +38,16 @@ func main() {
 	graph.Start()
 
 	// http
-	http.Start()
-
-	select {}
+	go http.Start()
+
+	// kill -HUP 重新加载配置
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		if err := g.ReloadConfig(); err != nil {
+			log.Println("reload config fail:", err)
+			continue
+		}
+		graph.Reload()
+	}
 }
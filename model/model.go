@@ -0,0 +1,28 @@
+// Package model 是query http接口的请求参数, 由service和client共用;
+// 只依赖falcon的common/model, 客户端引用它不会引入graph连接池等服务端的依赖
+package model
+
+import (
+	cmodel "github.com/open-falcon/common/model"
+)
+
+// HistoryParam /graph/history 的请求参数
+type HistoryParam struct {
+	Start            int                     `json:"start"`
+	End              int                     `json:"end"`
+	CF               string                  `json:"cf"`
+	EndpointCounters []cmodel.GraphInfoParam `json:"endpoint_counters"`
+	Aggregate        *AggregateParam         `json:"aggregate"`
+}
+
+// AggregateParam /graph/history 的聚合参数, 由aggregate.Check检查
+// fn: sum, avg, max, min, count, 或 p50/p95/p99.9 等百分位
+// group_by: 为空时所有曲线聚合为一条; endpoint 按endpoint分组; counter 按counter分组; tag:<key> 按counter中tag的值分组
+// align_step: 对齐的步长(秒), 为0时取各曲线中最大的step
+// fill: 对齐后缺失数据点的填充方式, 见align包, 默认不填充
+type AggregateParam struct {
+	Fn        string `json:"fn"`
+	GroupBy   string `json:"group_by"`
+	AlignStep int    `json:"align_step"`
+	Fill      string `json:"fill"`
+}
@@ -0,0 +1,76 @@
+// Package pattern 是endpoint/counter中的模式: /.../ 为正则表达式, 含有 * ? [ { 的为glob;
+// 只依赖标准库, 供配置检查、dashboard展开和认证共用
+package pattern
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// IsPattern 判断endpoint/counter是否为需要展开的模式:
+// /.../ 为正则表达式; 含有 * ? [ { 的为glob, 如 web-*、net.if.in.bytes/iface={eth0,eth1}
+func IsPattern(s string) bool {
+	return IsRegex(s) || strings.ContainsAny(s, "*?[{")
+}
+
+// IsRegex 判断是否为 /.../ 形式的正则表达式
+func IsRegex(s string) bool {
+	return len(s) > 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/")
+}
+
+// Compile 把模式编译为完整匹配的正则表达式
+func Compile(pattern string) (*regexp.Regexp, error) {
+	if IsRegex(pattern) {
+		expr := pattern[1 : len(pattern)-1]
+		if !strings.HasPrefix(expr, "^") {
+			expr = "^(" + expr + ")"
+		}
+		if !strings.HasSuffix(expr, "$") {
+			expr = expr + "$"
+		}
+		return regexp.Compile(expr)
+	}
+	return regexp.Compile("^" + globToRegex(pattern) + "$")
+}
+
+func globToRegex(glob string) string {
+	buf := new(bytes.Buffer)
+	inBrace := false
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			buf.WriteString(".*")
+		case '?':
+			buf.WriteString(".")
+		case '[':
+			j := strings.IndexByte(glob[i:], ']')
+			if j < 0 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			buf.WriteString(glob[i : i+j+1])
+			i += j
+		case '{':
+			inBrace = true
+			buf.WriteString("(")
+		case '}':
+			if !inBrace {
+				buf.WriteString(`\}`)
+				continue
+			}
+			inBrace = false
+			buf.WriteString(")")
+		case ',':
+			if inBrace {
+				buf.WriteString("|")
+			} else {
+				buf.WriteString(",")
+			}
+		default:
+			buf.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return buf.String()
+}
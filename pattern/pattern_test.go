@@ -0,0 +1,40 @@
+package pattern
+
+import "testing"
+
+func TestCompile(t *testing.T) {
+	cases := []struct {
+		pattern string
+		match   []string
+		nomatch []string
+	}{
+		{"web-*", []string{"web-01", "web-"}, []string{"xweb-01", "db-01"}},
+		{"web-0?", []string{"web-01"}, []string{"web-001"}},
+		{"web-[12]", []string{"web-1"}, []string{"web-3"}},
+		{"net.if.in.bytes/iface={eth0,eth1}", []string{"net.if.in.bytes/iface=eth1"}, []string{"net.if.in.bytes/iface=eth2", "netxif.in.bytes/iface=eth0"}},
+		{"/web-\\d+|db-\\d+/", []string{"web-01", "db-2"}, []string{"web-01x", "xdb-2"}},
+	}
+	for _, c := range cases {
+		if !IsPattern(c.pattern) {
+			t.Errorf("%s should be a pattern", c.pattern)
+		}
+		re, err := Compile(c.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range c.match {
+			if !re.MatchString(s) {
+				t.Errorf("%s should match %s", c.pattern, s)
+			}
+		}
+		for _, s := range c.nomatch {
+			if re.MatchString(s) {
+				t.Errorf("%s should not match %s", c.pattern, s)
+			}
+		}
+	}
+
+	if IsPattern("web-01") || IsPattern("/") {
+		t.Fatal("literal should not be a pattern")
+	}
+}
@@ -0,0 +1,211 @@
+package proc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const metricsPrefix = "falcon_query_"
+
+// 延迟直方图的分桶, 单位秒
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// LabeledCounter 按一个标签(如graph地址)分组的计数器
+type LabeledCounter struct {
+	sync.RWMutex
+	Name  string
+	Help  string
+	Label string
+	M     map[string]int64
+}
+
+func NewLabeledCounter(name, help, label string) *LabeledCounter {
+	return &LabeledCounter{Name: name, Help: help, Label: label, M: make(map[string]int64)}
+}
+
+func (this *LabeledCounter) Incr(value string) {
+	this.Lock()
+	this.M[value]++
+	this.Unlock()
+}
+
+// Delete 删除一个标签值的计数, 如graph节点被移除时
+func (this *LabeledCounter) Delete(value string) {
+	this.Lock()
+	delete(this.M, value)
+	this.Unlock()
+}
+
+func (this *LabeledCounter) Get() map[string]int64 {
+	this.RLock()
+	defer this.RUnlock()
+	ret := make(map[string]int64, len(this.M))
+	for k, v := range this.M {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Histogram 按一个标签分组的直方图
+type Histogram struct {
+	sync.RWMutex
+	Name    string
+	Help    string
+	Label   string
+	Buckets []float64
+	M       map[string]*HistogramValue
+}
+
+type HistogramValue struct {
+	Counts []uint64 // 与Buckets一一对应, 非累计
+	Count  uint64
+	Sum    float64
+}
+
+func NewHistogram(name, help, label string, buckets []float64) *Histogram {
+	return &Histogram{Name: name, Help: help, Label: label, Buckets: buckets, M: make(map[string]*HistogramValue)}
+}
+
+func (this *Histogram) Observe(value string, v float64) {
+	this.Lock()
+	defer this.Unlock()
+
+	hv, found := this.M[value]
+	if !found {
+		hv = &HistogramValue{Counts: make([]uint64, len(this.Buckets))}
+		this.M[value] = hv
+	}
+	for i, le := range this.Buckets {
+		if v <= le {
+			hv.Counts[i]++
+			break
+		}
+	}
+	hv.Count++
+	hv.Sum += v
+}
+
+func (this *Histogram) Get() map[string]*HistogramValue {
+	this.RLock()
+	defer this.RUnlock()
+	ret := make(map[string]*HistogramValue, len(this.M))
+	for k, hv := range this.M {
+		counts := make([]uint64, len(hv.Counts))
+		copy(counts, hv.Counts)
+		ret[k] = &HistogramValue{Counts: counts, Count: hv.Count, Sum: hv.Sum}
+	}
+	return ret
+}
+
+// WriteMetrics 以Prometheus文本格式输出所有的统计指标
+func WriteMetrics(w io.Writer) {
+	buf := new(bytes.Buffer)
+
+	for _, c := range counters() {
+		cnt := c.Get()
+		name := metricsPrefix + snakeCase(strings.TrimSuffix(cnt.Name, "Cnt")) + "_total"
+		help, found := counterHelps[cnt.Name]
+		if !found {
+			help = cnt.Name + "."
+		}
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(buf, "# TYPE %s counter\n", name)
+		fmt.Fprintf(buf, "%s %d\n", name, cnt.Cnt)
+	}
+
+	for _, c := range labeledCounters() {
+		name := metricsPrefix + c.Name
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, c.Help)
+		fmt.Fprintf(buf, "# TYPE %s counter\n", name)
+		m := c.Get()
+		for _, k := range sortedKeys(m) {
+			fmt.Fprintf(buf, "%s{%s=%s} %d\n", name, c.Label, quoteLabel(k), m[k])
+		}
+	}
+
+	for _, h := range histograms() {
+		name := metricsPrefix + h.Name
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, h.Help)
+		fmt.Fprintf(buf, "# TYPE %s histogram\n", name)
+		m := h.Get()
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			hv := m[k]
+			label := fmt.Sprintf("%s=%s", h.Label, quoteLabel(k))
+			var cum uint64
+			for i, le := range h.Buckets {
+				cum += hv.Counts[i]
+				fmt.Fprintf(buf, "%s_bucket{%s,le=\"%s\"} %d\n", name, label, formatFloat(le), cum)
+			}
+			fmt.Fprintf(buf, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, label, hv.Count)
+			fmt.Fprintf(buf, "%s_sum{%s} %s\n", name, label, formatFloat(hv.Sum))
+			fmt.Fprintf(buf, "%s_count{%s} %d\n", name, label, hv.Count)
+		}
+	}
+
+	w.Write(buf.Bytes())
+}
+
+// WriteGauge 以Prometheus文本格式输出一组按标签分组的gauge
+func WriteGauge(w io.Writer, name, help, label string, m map[string]float64) {
+	name = metricsPrefix + name
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%s} %s\n", name, label, quoteLabel(k), formatFloat(m[k]))
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel 按Prometheus文本格式转义标签值: 只转义 \、" 和换行, 其他字符(包括非ASCII)原样输出
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// HistoryRequestCnt -> history_request_cnt
+func snakeCase(name string) string {
+	buf := new(bytes.Buffer)
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				buf.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
@@ -0,0 +1,45 @@
+package proc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestQuoteLabel(t *testing.T) {
+	cases := map[string]string{
+		"127.0.0.1:6070": `"127.0.0.1:6070"`,
+		`a\b`:            `"a\\b"`,
+		`say "hi"`:       `"say \"hi\""`,
+		"a\nb":           `"a\nb"`,
+		"a\tb":           "\"a\tb\"",
+		"主机":             `"主机"`,
+	}
+	for in, expected := range cases {
+		if got := quoteLabel(in); got != expected {
+			t.Errorf("quoteLabel(%q): expected %s, got %s", in, expected, got)
+		}
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	HistoryRequestCnt.Incr()
+	var buf bytes.Buffer
+	WriteMetrics(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		"# HELP falcon_query_history_request_total History query requests.",
+		"# TYPE falcon_query_history_request_total counter",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+
+	buf.Reset()
+	WriteGauge(&buf, "graph_pool_force_closed_conns", "help", "addr", map[string]float64{`a"b`: 2})
+	if !strings.Contains(buf.String(), "# TYPE falcon_query_graph_pool_force_closed_conns gauge\n") ||
+		!strings.Contains(buf.String(), `falcon_query_graph_pool_force_closed_conns{addr="a\"b"} 2`) {
+		t.Fatalf("unexpected gauge output:\n%s", buf.String())
+	}
+}
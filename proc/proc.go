@@ -19,27 +19,90 @@ var (
 	LastRequestItemCnt        = nproc.NewSCounterQps("LastRequestItemCnt")
 	LastRawRequestItemCnt     = nproc.NewSCounterQps("LastRawRequestItemCnt")
 
-	// TODO http request delay
+	// 缓存命中
+	HistoryCacheHitCnt  = nproc.NewSCounterQps("HistoryCacheHitCnt")
+	HistoryCacheMissCnt = nproc.NewSCounterQps("HistoryCacheMissCnt")
+	LastCacheHitCnt     = nproc.NewSCounterQps("LastCacheHitCnt")
+	LastCacheMissCnt    = nproc.NewSCounterQps("LastCacheMissCnt")
+
+	// http请求延迟, 按路由统计
+	HttpRequestLatency = NewHistogram("http_request_duration_seconds",
+		"Latency of http requests by route.", "route", LatencyBuckets)
+)
+
+// 后端graph的调用统计, 按graph地址统计
+var (
+	GraphCallLatency = NewHistogram("graph_call_duration_seconds",
+		"Latency of rpc calls by graph backend.", "addr", LatencyBuckets)
+	GraphCallErrorCnt = NewLabeledCounter("graph_call_errors_total",
+		"Failed rpc calls by graph backend.", "addr")
+	GraphCallTimeoutCnt = NewLabeledCounter("graph_call_timeouts_total",
+		"Timed out rpc calls by graph backend.", "addr")
+	// 当前连接池中被强制关闭的连接数; 连接池随节点移除时清零, 以gauge输出, 见PoolStats
+	GraphConnForceCloseCnt = NewLabeledCounter("graph_pool_force_closed_conns",
+		"Connections force closed in the current conn pool of graph backend.", "addr")
 )
 
+// /counter/all中的计数器在/metrics中的说明
+var counterHelps = map[string]string{
+	"HistoryRequestCnt":         "History query requests.",
+	"InfoRequestCnt":            "Info query requests.",
+	"LastRequestCnt":            "Last query requests.",
+	"LastRawRequestCnt":         "Last raw query requests.",
+	"HistoryResponseCounterCnt": "Series returned by history queries.",
+	"HistoryResponseItemCnt":    "Points returned by history queries.",
+	"LastRequestItemCnt":        "Items returned by last queries.",
+	"LastRawRequestItemCnt":     "Items returned by last raw queries.",
+	"HistoryCacheHitCnt":        "History queries served from the cache.",
+	"HistoryCacheMissCnt":       "History queries not found in the cache.",
+	"LastCacheHitCnt":           "Last queries served from the cache.",
+	"LastCacheMissCnt":          "Last queries not found in the cache.",
+}
+
 func Start() {
 	log.Println("proc.Start, ok")
 }
 
 func GetAll() []interface{} {
 	ret := make([]interface{}, 0)
+	for _, c := range counters() {
+		ret = append(ret, c.Get())
+	}
+	return ret
+}
 
-	// http request
-	ret = append(ret, HistoryRequestCnt.Get())
-	ret = append(ret, InfoRequestCnt.Get())
-	ret = append(ret, LastRequestCnt.Get())
-	ret = append(ret, LastRawRequestCnt.Get())
+func counters() []*nproc.SCounterQps {
+	return []*nproc.SCounterQps{
+		// http request
+		HistoryRequestCnt,
+		InfoRequestCnt,
+		LastRequestCnt,
+		LastRawRequestCnt,
 
-	// http response
-	ret = append(ret, HistoryResponseCounterCnt.Get())
-	ret = append(ret, HistoryResponseItemCnt.Get())
-	ret = append(ret, LastRequestItemCnt.Get())
-	ret = append(ret, LastRawRequestItemCnt.Get())
+		// http response
+		HistoryResponseCounterCnt,
+		HistoryResponseItemCnt,
+		LastRequestItemCnt,
+		LastRawRequestItemCnt,
 
-	return ret
+		// cache
+		HistoryCacheHitCnt,
+		HistoryCacheMissCnt,
+		LastCacheHitCnt,
+		LastCacheMissCnt,
+	}
+}
+
+func labeledCounters() []*LabeledCounter {
+	return []*LabeledCounter{
+		GraphCallErrorCnt,
+		GraphCallTimeoutCnt,
+	}
+}
+
+func histograms() []*Histogram {
+	return []*Histogram{
+		HttpRequestLatency,
+		GraphCallLatency,
+	}
 }
@@ -0,0 +1,213 @@
+// Package rule 解析并计算曲线上的阈值规则, 如
+//
+//	avg(5m) > 90      最近5分钟的平均值大于90
+//	all(10m) < 1      最近10分钟的每个点都小于1
+//	any(1h) >= 100    最近1小时内有点不小于100
+//	zscore(1h) > 3    最新的点相对于它之前1小时的z-score大于3
+//
+// 函数还可以是 max、min、sum、count、last 和 p95 等百分位; 时间窗口的单位为s、m、h、d, 不带单位时为秒
+package rule
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/aggregate"
+)
+
+type Rule struct {
+	Text      string
+	Fn        string
+	Window    int64 // 秒
+	Op        string
+	Threshold float64
+
+	reduce aggregate.ReduceFunc
+}
+
+// Result 规则的计算结果
+// Value: 归约后的值; any、all为满足条件的点数, zscore为最新点的z-score
+// Points: 规则触发时满足条件的点, 没有单个点满足条件时(如sum)为窗口内的全部点
+type Result struct {
+	NoData bool
+	Fired  bool
+	Value  float64
+	Points []*cmodel.RRDData
+}
+
+var ruleRegexp = regexp.MustCompile(`^\s*([a-z]+[0-9.]*)\s*\(\s*([0-9]+[a-z]*)\s*\)\s*(>=|<=|==|!=|>|<)\s*(\S+)\s*$`)
+
+func Parse(s string) (*Rule, error) {
+	m := ruleRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return nil, fmt.Errorf("invalid rule: %s", s)
+	}
+
+	r := &Rule{Text: strings.TrimSpace(s), Fn: m[1], Op: m[3]}
+	switch r.Fn {
+	case "all", "any", "last", "zscore":
+	default:
+		reduce, err := aggregate.Reducer(r.Fn)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %s: unknown function %s", s, r.Fn)
+		}
+		r.reduce = reduce
+	}
+
+	window, err := ParseWindow(m[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule %s: %v", s, err)
+	}
+	r.Window = window
+
+	threshold, err := strconv.ParseFloat(m[4], 64)
+	if err != nil || math.IsNaN(threshold) {
+		return nil, fmt.Errorf("invalid rule %s: bad threshold %s", s, m[4])
+	}
+	r.Threshold = threshold
+	return r, nil
+}
+
+// ParseWindow 解析时间窗口, 如 30s、5m、1h、1d, 不带单位时为秒
+func ParseWindow(s string) (int64, error) {
+	var d time.Duration
+	var err error
+	switch {
+	case strings.HasSuffix(s, "d"):
+		var n int64
+		n, err = strconv.ParseInt(strings.TrimSuffix(s, "d"), 10, 64)
+		d = time.Duration(n) * 24 * time.Hour
+	case strings.IndexAny(s, "smh") >= 0:
+		d, err = time.ParseDuration(s)
+	default:
+		var n int64
+		n, err = strconv.ParseInt(s, 10, 64)
+		d = time.Duration(n) * time.Second
+	}
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("bad window %s", s)
+	}
+	return int64(d / time.Second), nil
+}
+
+// Span 计算规则需要的数据的时间跨度(秒): zscore需要最新点之前一个窗口的基线
+func (this *Rule) Span() int64 {
+	if this.Fn == "zscore" {
+		return 2 * this.Window
+	}
+	return this.Window
+}
+
+func (this *Rule) match(v float64) bool {
+	switch this.Op {
+	case ">":
+		return v > this.Threshold
+	case ">=":
+		return v >= this.Threshold
+	case "<":
+		return v < this.Threshold
+	case "<=":
+		return v <= this.Threshold
+	case "==":
+		return v == this.Threshold
+	case "!=":
+		return v != this.Threshold
+	}
+	return false
+}
+
+// window 返回(end-window, end]之间的有效数据点
+func window(values []*cmodel.RRDData, end, window int64) []*cmodel.RRDData {
+	ret := []*cmodel.RRDData{}
+	for _, v := range values {
+		if v == nil || math.IsNaN(float64(v.Value)) || v.Timestamp <= end-window || v.Timestamp > end {
+			continue
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+// Eval 以end为窗口的结束时间计算规则; 窗口内没有有效数据点时NoData为true, 不触发
+func (this *Rule) Eval(values []*cmodel.RRDData, end int64) *Result {
+	points := window(values, end, this.Window)
+	if len(points) == 0 {
+		return &Result{NoData: true, Value: math.NaN()}
+	}
+
+	if this.Fn == "zscore" {
+		return this.zscore(values, points[len(points)-1])
+	}
+
+	matched := []*cmodel.RRDData{}
+	for _, p := range points {
+		if this.match(float64(p.Value)) {
+			matched = append(matched, p)
+		}
+	}
+
+	ret := &Result{}
+	switch this.Fn {
+	case "all":
+		ret.Value = float64(len(matched))
+		ret.Fired = len(matched) == len(points)
+	case "any":
+		ret.Value = float64(len(matched))
+		ret.Fired = len(matched) > 0
+	case "last":
+		ret.Value = float64(points[len(points)-1].Value)
+		ret.Fired = this.match(ret.Value)
+		matched = points[len(points)-1:]
+	default:
+		vs := make([]float64, 0, len(points))
+		for _, p := range points {
+			vs = append(vs, float64(p.Value))
+		}
+		ret.Value = this.reduce(vs)
+		ret.Fired = this.match(ret.Value)
+	}
+
+	if ret.Fired {
+		ret.Points = matched
+		if len(ret.Points) == 0 {
+			ret.Points = points
+		}
+	}
+	return ret
+}
+
+// zscore 计算最新点相对于它之前一个窗口内的点的z-score; 基线少于2个点或标准差为0时为NaN, 不触发
+func (this *Rule) zscore(values []*cmodel.RRDData, latest *cmodel.RRDData) *Result {
+	baseline := window(values, latest.Timestamp-1, this.Window)
+	vs := make([]float64, 0, len(baseline))
+	for _, p := range baseline {
+		vs = append(vs, float64(p.Value))
+	}
+
+	ret := &Result{Value: math.NaN()}
+	if len(vs) < 2 {
+		return ret
+	}
+	mean := aggregate.Avg(vs)
+	variance := 0.0
+	for _, v := range vs {
+		variance += (v - mean) * (v - mean)
+	}
+	std := math.Sqrt(variance / float64(len(vs)))
+	if std == 0 {
+		return ret
+	}
+
+	ret.Value = (float64(latest.Value) - mean) / std
+	ret.Fired = this.match(ret.Value)
+	if ret.Fired {
+		ret.Points = []*cmodel.RRDData{latest}
+	}
+	return ret
+}
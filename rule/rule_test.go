@@ -0,0 +1,133 @@
+package rule
+
+import (
+	"math"
+	"testing"
+
+	cmodel "github.com/open-falcon/common/model"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		text      string
+		fn        string
+		window    int64
+		op        string
+		threshold float64
+	}{
+		{"avg(5m) > 90", "avg", 300, ">", 90},
+		{"  all(10m)<1 ", "all", 600, "<", 1},
+		{"any( 1h ) >= 1e2", "any", 3600, ">=", 100},
+		{"zscore(1d) != -3.5", "zscore", 86400, "!=", -3.5},
+		{"p95(90) <= 0", "p95", 90, "<=", 0},
+		{"last(90) == 2", "last", 90, "==", 2},
+	}
+	for _, c := range cases {
+		r, err := Parse(c.text)
+		if err != nil {
+			t.Errorf("%s: %v", c.text, err)
+			continue
+		}
+		if r.Fn != c.fn || r.Window != c.window || r.Op != c.op || r.Threshold != c.threshold {
+			t.Errorf("%s: unexpected rule %+v", c.text, r)
+		}
+	}
+
+	for _, text := range []string{
+		"", "avg(5m)", "avg > 1", "avg(5m) => 1", "median(5m) > 1", "avg(5x) > 1",
+		"avg(0s) > 1", "avg(500ms) > 1", "avg(5m) > high", "avg(5m) > NaN", "avg(-5m) > 1", "avg(1h30m) > 1",
+	} {
+		if _, err := Parse(text); err == nil {
+			t.Errorf("%q: expected error", text)
+		}
+	}
+}
+
+func TestSpan(t *testing.T) {
+	for text, span := range map[string]int64{"avg(5m) > 1": 300, "zscore(5m) > 3": 600} {
+		r, err := Parse(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Span() != span {
+			t.Errorf("%s: expected span %d, got %d", text, span, r.Span())
+		}
+	}
+}
+
+func points(step int64, values ...float64) []*cmodel.RRDData {
+	ret := make([]*cmodel.RRDData, 0, len(values))
+	for i, v := range values {
+		ret = append(ret, &cmodel.RRDData{Timestamp: int64(i+1) * step, Value: cmodel.JsonFloat(v)})
+	}
+	return ret
+}
+
+func TestEval(t *testing.T) {
+	nan := math.NaN()
+	// 时间戳为60、120、...、600, 窗口以600为结束时间
+	values := points(60, 10, 10, 12, 8, 10, 10, 11, 9, 10, 99)
+	cases := []struct {
+		text   string
+		fired  bool
+		value  float64
+		points int
+	}{
+		// 归约函数触发时points为满足条件的点, 没有时为窗口内的全部点
+		{"avg(5m) > 25", true, 27.8, 1},
+		{"avg(5m) > 200", false, 27.8, 0},
+		{"sum(2m) > 100", true, 109, 2},
+		{"avg(5m) > 90", false, 27.8, 0},
+		{"max(2m) >= 99", true, 99, 1},
+		{"all(3m) < 20", false, 2, 0},
+		{"all(3m) < 100", true, 3, 3},
+		{"any(10m) > 50", true, 1, 1},
+		{"last(1m) == 99", true, 99, 1},
+		{"count(10m) == 10", true, 10, 5},
+		{"zscore(5m) > 3", true, 0, 1},
+	}
+	for _, c := range cases {
+		r, err := Parse(c.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := r.Eval(values, 600)
+		if res.NoData || res.Fired != c.fired || len(res.Points) != c.points {
+			t.Errorf("%s: unexpected result %+v", c.text, res)
+			continue
+		}
+		if c.value != 0 && math.Abs(res.Value-c.value) > 1e-9 {
+			t.Errorf("%s: expected value %v, got %v", c.text, c.value, res.Value)
+		}
+	}
+
+	// 窗口内只有NaN时为NoData, 不触发
+	r, _ := Parse("avg(2m) < 1")
+	if res := r.Eval(points(60, 0, 0, nan, nan), 240); !res.NoData || res.Fired || !math.IsNaN(res.Value) {
+		t.Errorf("unexpected result %+v", res)
+	}
+	// 窗口外的点不参与计算
+	if res := r.Eval(points(60, 0, 0, 5, 5, 0), 240); res.NoData || res.Fired || res.Value != 5 {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
+
+func TestZscore(t *testing.T) {
+	r, err := Parse("zscore(3m) > 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 基线标准差为0时为NaN, 不触发
+	if res := r.Eval(points(60, 10, 10, 10, 99), 240); res.Fired || !math.IsNaN(res.Value) {
+		t.Errorf("unexpected result %+v", res)
+	}
+	// 基线少于2个点
+	if res := r.Eval(points(60, 10, 99), 120); res.Fired || !math.IsNaN(res.Value) {
+		t.Errorf("unexpected result %+v", res)
+	}
+	// 基线为 8, 12, 10: 均值10, 标准差约1.63
+	res := r.Eval(points(60, 8, 12, 10, 20), 240)
+	if !res.Fired || len(res.Points) != 1 || res.Points[0].Timestamp != 240 || math.Abs(res.Value-6.1237) > 1e-3 {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
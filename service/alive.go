@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/g"
+	"github.com/jianvhen/query/graph"
+	"github.com/jianvhen/query/pattern"
+)
+
+const (
+	defaultAliveCounter   = "agent.alive"
+	defaultAliveThreshold = 120
+)
+
+// AliveParam 存活检测的参数, 为空的字段使用配置文件中alive的设置
+// endpoints: 支持通配符或/正则/, 通过dashboard展开
+// counter: 心跳counter, 默认agent.alive
+// threshold: 最新上报时间距今超过threshold秒则认为不存活
+// groups: 按endpoint的模式设置各组的threshold, 优先于threshold和配置文件
+// stale_only: 只返回不存活的endpoint
+type AliveParam struct {
+	Endpoints []string        `json:"endpoints"`
+	Counter   string          `json:"counter"`
+	Threshold int             `json:"threshold"`
+	Groups    []*g.AliveGroup `json:"groups"`
+	StaleOnly bool            `json:"stale_only"`
+}
+
+// AliveItem 单个endpoint的存活状态; status为1表示存活, 0表示不存活
+// last_seen为心跳counter最新的上报时间, age为距今的秒数, 没有数据时均为-1
+type AliveItem struct {
+	Endpoint  string `json:"endpoint"`
+	Status    int    `json:"status"`
+	LastSeen  int64  `json:"last_seen"`
+	Age       int64  `json:"age"`
+	Threshold int    `json:"threshold"`
+	Addr      string `json:"addr,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type aliveGroup struct {
+	re        *regexp.Regexp
+	threshold int
+}
+
+// Alive 批量查询endpoint心跳counter的最新值, 判断是否存活; 结果的顺序与展开后的endpoints一致
+func Alive(ctx context.Context, param *AliveParam) ([]*AliveItem, error) {
+	if len(param.Endpoints) == 0 {
+		return nil, errors.New("empty_payload")
+	}
+
+	cfg := g.Config().Alive
+	if cfg == nil {
+		cfg = &g.AliveConfig{}
+	}
+
+	counter := param.Counter
+	if counter == "" {
+		counter = cfg.Counter
+	}
+	if counter == "" {
+		counter = defaultAliveCounter
+	}
+
+	// 请求中的分组 > 请求的threshold > 配置文件中的分组 > 配置文件的threshold
+	groups, err := compileAliveGroups(param.Groups)
+	if err != nil {
+		return nil, err
+	}
+	if param.Threshold > 0 {
+		groups = append(groups, &aliveGroup{threshold: param.Threshold})
+	}
+	cfgGroups, err := compileAliveGroups(cfg.Groups)
+	if err != nil {
+		return nil, err
+	}
+	groups = append(groups, cfgGroups...)
+	threshold := cfg.Threshold
+	if threshold <= 0 {
+		threshold = defaultAliveThreshold
+	}
+	groups = append(groups, &aliveGroup{threshold: threshold})
+
+	ecs := make([]cmodel.GraphInfoParam, 0, len(param.Endpoints))
+	for _, endpoint := range param.Endpoints {
+		ecs = append(ecs, cmodel.GraphInfoParam{Endpoint: endpoint, Counter: counter})
+	}
+	ecs, err = Expand(ctx, ecs)
+	if err != nil {
+		return nil, err
+	}
+
+	params := make([]cmodel.GraphLastParam, 0, len(ecs))
+	for _, ec := range ecs {
+		params = append(params, cmodel.GraphLastParam{Endpoint: ec.Endpoint, Counter: ec.Counter})
+	}
+	lasts, errs := lastMany(ctx, params, false)
+
+	now := time.Now().Unix()
+	items := make([]*AliveItem, 0, len(params))
+	for i, para := range params {
+		item := &AliveItem{Endpoint: para.Endpoint, LastSeen: -1, Age: -1}
+		for _, group := range groups {
+			if group.re == nil || group.re.MatchString(para.Endpoint) {
+				item.Threshold = group.threshold
+				break
+			}
+		}
+
+		_, item.Addr = errorStatus(errs[i])
+		if item.Addr == "" {
+			item.Addr, _ = graph.Addr(para.Endpoint, para.Counter)
+		}
+		if errs[i] != nil {
+			item.Error = errs[i].Error()
+		} else if lasts[i] != nil && lasts[i].Value != nil && lasts[i].Value.Timestamp > 0 {
+			item.LastSeen = lasts[i].Value.Timestamp
+			item.Age = now - item.LastSeen
+			if item.Age <= int64(item.Threshold) {
+				item.Status = 1
+			}
+		}
+
+		if param.StaleOnly && item.Status == 1 {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func compileAliveGroups(groups []*g.AliveGroup) ([]*aliveGroup, error) {
+	ret := make([]*aliveGroup, 0, len(groups))
+	for _, group := range groups {
+		if group == nil {
+			continue
+		}
+		if group.Threshold <= 0 {
+			return nil, fmt.Errorf("invalid threshold of group %s", group.Pattern)
+		}
+		re, err := pattern.Compile(group.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad group pattern %s: %v", group.Pattern, err)
+		}
+		ret = append(ret, &aliveGroup{re: re, threshold: group.Threshold})
+	}
+	return ret, nil
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/auth"
+	"github.com/jianvhen/query/graph"
+	"github.com/jianvhen/query/pattern"
+)
+
+// StatusForbidden ctx中的调用方不能读取该endpoint, 没有向graph发出查询; 其他状态见graph包
+const StatusForbidden = "forbidden"
+
+// 授权检查都在本包中进行, graph不检查调用方: 模式展开后去掉不能读取的endpoint(见Expand),
+// 查询graph之前逐个检查, 不能读取的endpoint不发出调用, 以*auth.ForbiddenError作为它的错误
+
+// errorStatus 与graph.ErrorStatus相同, 另外把*auth.ForbiddenError对应到StatusForbidden
+func errorStatus(err error) (status string, addr string) {
+	if _, ok := err.(*auth.ForbiddenError); ok {
+		return StatusForbidden, ""
+	}
+	return graph.ErrorStatus(err)
+}
+
+// authorize 检查ctx中的调用方能否读取n个endpoint, 返回能读取的下标; 不能读取的下标在errs中为*auth.ForbiddenError
+func authorize(ctx context.Context, n int, endpoint func(i int) string) ([]int, []error) {
+	allowed := make([]int, 0, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		if err := auth.Authorize(ctx, endpoint(i)); err != nil {
+			errs[i] = err
+			continue
+		}
+		allowed = append(allowed, i)
+	}
+	return allowed, errs
+}
+
+// allowedEndpoints 返回ctx中的调用方能读取的endpoint
+func allowedEndpoints(ctx context.Context, endpoints []string) []string {
+	p := auth.FromContext(ctx)
+	if p == nil || !p.RestrictsEndpoints() {
+		return endpoints
+	}
+	ret := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if p.AllowEndpoint(endpoint) {
+			ret = append(ret, endpoint)
+		}
+	}
+	return ret
+}
+
+// filterExpanded 去掉由模式展开得到、ctx中的调用方不能读取的endpoint, 避免泄露endpoint的名字;
+// 请求中直接写出的endpoint保留, 查询时返回*auth.ForbiddenError
+func filterExpanded(ctx context.Context, requested, expanded []cmodel.GraphInfoParam) []cmodel.GraphInfoParam {
+	p := auth.FromContext(ctx)
+	if p == nil || !p.RestrictsEndpoints() {
+		return expanded
+	}
+
+	literals := make(map[string]bool)
+	for _, ec := range requested {
+		if !pattern.IsPattern(ec.Endpoint) {
+			literals[ec.Endpoint] = true
+		}
+	}
+	ret := make([]cmodel.GraphInfoParam, 0, len(expanded))
+	for _, ec := range expanded {
+		if literals[ec.Endpoint] || p.AllowEndpoint(ec.Endpoint) {
+			ret = append(ret, ec)
+		}
+	}
+	return ret
+}
+
+// queryManyAuthorized 与graph.QueryManyPlanned相同, 但只查询ctx中的调用方能读取的endpoint
+func queryManyAuthorized(ctx context.Context, params []cmodel.GraphQueryParam) ([]*cmodel.GraphQueryResponse, []error) {
+	allowed, errs := authorize(ctx, len(params), func(i int) string { return params[i].Endpoint })
+	sub := make([]cmodel.GraphQueryParam, len(allowed))
+	for k, i := range allowed {
+		sub[k] = params[i]
+	}
+
+	resps := make([]*cmodel.GraphQueryResponse, len(params))
+	subResps, subErrs := graph.QueryManyPlanned(ctx, sub)
+	for k, i := range allowed {
+		resps[i], errs[i] = subResps[k], subErrs[k]
+	}
+	return resps, errs
+}
+
+// infoMany 与graph.InfoMany相同, 但只查询ctx中的调用方能读取的endpoint
+func infoMany(ctx context.Context, params []cmodel.GraphInfoParam) ([]*cmodel.GraphFullyInfo, []error) {
+	allowed, errs := authorize(ctx, len(params), func(i int) string { return params[i].Endpoint })
+	sub := make([]cmodel.GraphInfoParam, len(allowed))
+	for k, i := range allowed {
+		sub[k] = params[i]
+	}
+
+	infos := make([]*cmodel.GraphFullyInfo, len(params))
+	subInfos, subErrs := graph.InfoMany(ctx, sub)
+	for k, i := range allowed {
+		infos[i], errs[i] = subInfos[k], subErrs[k]
+	}
+	return infos, errs
+}
+
+// lastMany 与graph.LastMany(raw为true时graph.LastRawMany)相同, 但只查询ctx中的调用方能读取的endpoint
+func lastMany(ctx context.Context, params []cmodel.GraphLastParam, raw bool) ([]*cmodel.GraphLastResp, []error) {
+	allowed, errs := authorize(ctx, len(params), func(i int) string { return params[i].Endpoint })
+	sub := make([]cmodel.GraphLastParam, len(allowed))
+	for k, i := range allowed {
+		sub[k] = params[i]
+	}
+
+	var subLasts []*cmodel.GraphLastResp
+	var subErrs []error
+	if raw {
+		subLasts, subErrs = graph.LastRawMany(ctx, sub)
+	} else {
+		subLasts, subErrs = graph.LastMany(ctx, sub)
+	}
+	lasts := make([]*cmodel.GraphLastResp, len(params))
+	for k, i := range allowed {
+		lasts[i], errs[i] = subLasts[k], subErrs[k]
+	}
+	return lasts, errs
+}
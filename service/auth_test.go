@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/auth"
+	"github.com/jianvhen/query/g"
+	"github.com/jianvhen/query/graph"
+)
+
+// restrictedContext 返回带有只能读取web-*的调用方的context
+func restrictedContext(t *testing.T) context.Context {
+	authn, err := auth.New(&g.AuthConfig{Tokens: []*g.AuthPrincipal{{Name: "team-a", Secret: "token", Endpoints: []string{"web-*"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	p, err := authn.Authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth.NewContext(context.Background(), p)
+}
+
+func TestAuthorize(t *testing.T) {
+	endpoints := []string{"web-01", "host01", "web-02"}
+	endpoint := func(i int) string { return endpoints[i] }
+
+	allowed, errs := authorize(context.Background(), len(endpoints), endpoint)
+	if len(allowed) != 3 || errs[0] != nil || errs[1] != nil || errs[2] != nil {
+		t.Fatalf("unexpected result without principal: %v %v", allowed, errs)
+	}
+
+	allowed, errs = authorize(restrictedContext(t), len(endpoints), endpoint)
+	if len(allowed) != 2 || allowed[0] != 0 || allowed[1] != 2 || errs[0] != nil || errs[2] != nil {
+		t.Fatalf("unexpected result: %v %v", allowed, errs)
+	}
+	if status, addr := errorStatus(errs[1]); status != StatusForbidden || addr != "" {
+		t.Fatalf("unexpected status of %v: %s %s", errs[1], status, addr)
+	}
+	if status, _ := errorStatus(errors.New("disk failure")); status != graph.StatusBackendError {
+		t.Fatalf("unexpected status: %s", status)
+	}
+}
+
+func TestAllowedEndpoints(t *testing.T) {
+	endpoints := []string{"web-01", "host01", "web-02"}
+	if got := allowedEndpoints(context.Background(), endpoints); len(got) != 3 {
+		t.Fatalf("unexpected endpoints without principal: %v", got)
+	}
+	if got := allowedEndpoints(restrictedContext(t), endpoints); len(got) != 2 || got[0] != "web-01" || got[1] != "web-02" {
+		t.Fatalf("unexpected endpoints: %v", got)
+	}
+}
+
+func TestFilterExpanded(t *testing.T) {
+	requested := []cmodel.GraphInfoParam{{Endpoint: "*", Counter: "cpu.idle"}, {Endpoint: "db01", Counter: "cpu.idle"}}
+	expanded := []cmodel.GraphInfoParam{
+		{Endpoint: "host01", Counter: "cpu.idle"},
+		{Endpoint: "web-01", Counter: "cpu.idle"},
+		{Endpoint: "db01", Counter: "cpu.idle"},
+	}
+	if got := filterExpanded(context.Background(), requested, expanded); len(got) != 3 {
+		t.Fatalf("unexpected result without principal: %v", got)
+	}
+
+	// 模式展开得到的host01被去掉; 直接写出的db01保留, 查询时返回forbidden
+	got := filterExpanded(restrictedContext(t), requested, expanded)
+	if len(got) != 2 || got[0].Endpoint != "web-01" || got[1].Endpoint != "db01" {
+		t.Fatalf("unexpected result: %v", got)
+	}
+}
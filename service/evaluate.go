@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/graph"
+	"github.com/jianvhen/query/rule"
+)
+
+// EvaluateParam 规则计算的参数, 规则的语法见rule包
+// endpoint_counters: endpoint/counter均支持通配符或/正则/, 通过dashboard展开
+// end: 规则窗口的结束时间, 默认为当前时间
+type EvaluateParam struct {
+	EndpointCounters []cmodel.GraphInfoParam `json:"endpoint_counters"`
+	Rules            []string                `json:"rules"`
+	End              int64                   `json:"end"`
+	CF               string                  `json:"cf"`
+}
+
+// EvaluateResult fired为true表示至少有一条曲线的一个规则被触发;
+// 有曲线查询失败、无法计算时unknown为true, errors为这些曲线的数量, 此时fired为false不代表没有触发
+type EvaluateResult struct {
+	Fired   bool            `json:"fired"`
+	Unknown bool            `json:"unknown"`
+	Errors  int             `json:"errors"`
+	Items   []*EvaluateItem `json:"items"`
+}
+
+// EvaluateItem 单条曲线上单个规则的计算结果
+// status: ok, not_found(窗口内没有数据), timeout, backend_error, circuit_open; 只有ok时规则才可能触发
+// value: 归约后的值, 见rule.Result; points: 触发规则的数据点
+type EvaluateItem struct {
+	Endpoint string            `json:"endpoint"`
+	Counter  string            `json:"counter"`
+	Rule     string            `json:"rule"`
+	Status   string            `json:"status"`
+	Fired    bool              `json:"fired"`
+	Value    cmodel.JsonFloat  `json:"value"`
+	Points   []*cmodel.RRDData `json:"points,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// Evaluate 查询曲线在规则窗口内的历史数据, 计算每条曲线上的每个规则; 结果按曲线、规则的顺序排列
+func Evaluate(ctx context.Context, param *EvaluateParam) (*EvaluateResult, error) {
+	if len(param.EndpointCounters) == 0 || len(param.Rules) == 0 {
+		return nil, errors.New("empty endpoint_counters or rules")
+	}
+
+	rules := make([]*rule.Rule, 0, len(param.Rules))
+	var span int64
+	for _, text := range param.Rules {
+		r, err := rule.Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		if r.Span() > span {
+			span = r.Span()
+		}
+		rules = append(rules, r)
+	}
+
+	ecs, err := Expand(ctx, param.EndpointCounters)
+	if err != nil {
+		return nil, err
+	}
+
+	end := param.End
+	if end <= 0 {
+		end = time.Now().Unix()
+	}
+	cf := param.CF
+	if cf == "" {
+		cf = "AVERAGE"
+	}
+
+	results, errs := queryMany(ctx, end-span, end, cf, ecs)
+	ret := &EvaluateResult{Items: make([]*EvaluateItem, 0, len(ecs)*len(rules))}
+	for i, ec := range ecs {
+		status, _ := errorStatus(errs[i])
+		if errs[i] != nil {
+			ret.Unknown = true
+			ret.Errors++
+		}
+		for _, r := range rules {
+			item := &EvaluateItem{Endpoint: ec.Endpoint, Counter: ec.Counter, Rule: r.Text, Status: status}
+			ret.Items = append(ret.Items, item)
+			if errs[i] != nil {
+				item.Error = errs[i].Error()
+				continue
+			}
+
+			var values []*cmodel.RRDData
+			if results[i] != nil {
+				values = results[i].Values
+			}
+			res := r.Eval(values, end)
+			item.Value = cmodel.JsonFloat(res.Value)
+			if res.NoData {
+				item.Status = graph.StatusNotFound
+				continue
+			}
+			item.Fired = res.Fired
+			item.Points = res.Points
+			ret.Fired = ret.Fired || res.Fired
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/align"
+	"github.com/jianvhen/query/auth"
+	"github.com/jianvhen/query/expr"
+)
+
+// ExprParam 表达式查询的参数, 表达式的语法见expr包
+// endpoint: 表达式中省略了endpoint的曲线引用使用的endpoint
+// step: 对齐的步长(秒), 为0时取各曲线中最大的step; fill: 对齐后缺失数据点的填充方式, 见align包
+type ExprParam struct {
+	Expr     string `json:"expr"`
+	Endpoint string `json:"endpoint"`
+	Start    int64  `json:"start"`
+	End      int64  `json:"end"`
+	CF       string `json:"cf"`
+	Step     int64  `json:"step"`
+	Fill     string `json:"fill"`
+}
+
+type seriesKey struct {
+	endpoint string
+	counter  string
+}
+
+// Expr 查询表达式中引用的曲线, 按时间戳对齐后计算表达式; 每条结果曲线的counter为作用在该曲线上的表达式
+func Expr(ctx context.Context, param *ExprParam) ([]*cmodel.GraphQueryResponse, error) {
+	if param.Expr == "" {
+		return nil, errors.New("empty expr")
+	}
+	if param.End < param.Start || param.Step < 0 {
+		return nil, errors.New("invalid start, end or step")
+	}
+	if err := align.CheckFill(param.Fill); err != nil {
+		return nil, err
+	}
+	cf := param.CF
+	if cf == "" {
+		cf = "AVERAGE"
+	}
+
+	node, err := expr.Parse(param.Expr)
+	if err != nil {
+		return nil, err
+	}
+
+	// 展开每个曲线引用中的模式, 多个引用的曲线合并为一次批量查询
+	refs := make(map[*expr.RefNode][]seriesKey)
+	ecs := []cmodel.GraphInfoParam{}
+	seen := make(map[seriesKey]bool)
+	for _, ref := range expr.Refs(node) {
+		endpoint := ref.Endpoint
+		if endpoint == "" {
+			endpoint = param.Endpoint
+		}
+		if endpoint == "" {
+			return nil, fmt.Errorf("no endpoint for counter %s", ref.Counter)
+		}
+
+		expanded, err := Expand(ctx, []cmodel.GraphInfoParam{{Endpoint: endpoint, Counter: ref.Counter}})
+		if err != nil {
+			return nil, err
+		}
+		for _, ec := range expanded {
+			key := seriesKey{ec.Endpoint, ec.Counter}
+			refs[ref] = append(refs[ref], key)
+			if !seen[key] {
+				seen[key] = true
+				ecs = append(ecs, ec)
+			}
+		}
+	}
+
+	// 引用的曲线查询失败时整个表达式失败, 否则结果会悄悄缺少曲线; 没有数据的曲线按NaN参与运算.
+	// 模式展开时已去掉调用方不能读取的endpoint, 直接引用了不能读取的endpoint时返回*auth.ForbiddenError
+	data := make([]*cmodel.GraphQueryResponse, 0, len(ecs))
+	results, errs := queryMany(ctx, param.Start, param.End, cf, ecs)
+	for i, result := range results {
+		if errs[i] != nil {
+			if _, ok := errs[i].(*auth.ForbiddenError); ok {
+				return nil, errs[i]
+			}
+			return nil, fmt.Errorf("query %s:%s fail, %v", ecs[i].Endpoint, ecs[i].Counter, errs[i])
+		}
+		if result != nil {
+			data = append(data, result)
+		}
+	}
+	aligned := align.Align(data, param.Start, param.End, param.Step, cf, param.Fill)
+	values := make(map[seriesKey][]float64, len(aligned.Series))
+	for i, s := range aligned.Series {
+		values[seriesKey{s.Endpoint, s.Counter}] = aligned.Values[i]
+	}
+
+	result, err := expr.Eval(node, &expr.Input{
+		Points: len(aligned.Timestamps),
+		Step:   aligned.Step,
+		Lookup: func(ref *expr.RefNode) []*expr.Series {
+			ret := []*expr.Series{}
+			for _, key := range refs[ref] {
+				if vs, ok := values[key]; ok {
+					ret = append(ret, &expr.Series{Endpoint: key.endpoint, Counter: key.counter, Values: vs})
+				}
+			}
+			return ret
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*cmodel.GraphQueryResponse, 0, len(result))
+	for _, s := range result {
+		resp := &cmodel.GraphQueryResponse{
+			Endpoint: s.Endpoint,
+			Counter:  s.Counter,
+			DsType:   "GAUGE",
+			Step:     int(aligned.Step),
+			Values:   make([]*cmodel.RRDData, 0, len(s.Values)),
+		}
+		for i, v := range s.Values {
+			resp.Values = append(resp.Values, &cmodel.RRDData{Timestamp: aligned.Timestamps[i], Value: cmodel.JsonFloat(v)})
+		}
+		ret = append(ret, resp)
+	}
+	return ret, nil
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/graph"
+	"github.com/jianvhen/query/proc"
+)
+
+// Envelope 批量查询的envelope格式, 每个请求的endpoint/counter对应一个Item, 顺序与请求一致
+type Envelope struct {
+	Items []*Item `json:"items"`
+}
+
+// Item 单个endpoint/counter的查询结果
+// status: ok, not_found(没有数据), timeout, backend_error, circuit_open; 只有status为ok时data不为空
+type Item struct {
+	Endpoint string      `json:"endpoint"`
+	Counter  string      `json:"counter"`
+	Status   string      `json:"status"`
+	Addr     string      `json:"addr,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Data     interface{} `json:"data"`
+}
+
+func newItem(endpoint, counter string, data interface{}, found bool, err error) *Item {
+	status, addr := errorStatus(err)
+	item := &Item{Endpoint: endpoint, Counter: counter, Status: status, Addr: addr}
+	if addr == "" {
+		item.Addr, _ = graph.Addr(endpoint, counter)
+	}
+
+	switch {
+	case err != nil:
+		item.Error = err.Error()
+	case !found:
+		item.Status = graph.StatusNotFound
+	default:
+		item.Data = data
+	}
+	return item
+}
+
+// HistoryItems 与History相同, 但每个endpoint/counter都返回一个Item; 不支持聚合
+func HistoryItems(ctx context.Context, param *HistoryParam) ([]*Item, error) {
+	proc.HistoryRequestCnt.Incr()
+
+	if len(param.EndpointCounters) == 0 {
+		return nil, errors.New("empty_payload")
+	}
+	if param.Aggregate != nil {
+		return nil, errors.New("aggregate is not supported with envelope")
+	}
+
+	ecs, err := Expand(ctx, param.EndpointCounters)
+	if err != nil {
+		return nil, err
+	}
+
+	results, errs, err := queryManyLimited(ctx, int64(param.Start), int64(param.End), param.CF, ecs)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*Item, len(ecs))
+	for i, ec := range ecs {
+		found := results[i] != nil && len(results[i].Values) > 0
+		items[i] = newItem(ec.Endpoint, ec.Counter, results[i], found, errs[i])
+	}
+	return items, nil
+}
+
+// InfoItems 与Info相同, 但每个endpoint/counter都返回一个Item
+func InfoItems(ctx context.Context, params []cmodel.GraphInfoParam) ([]*Item, error) {
+	proc.InfoRequestCnt.Incr()
+
+	if len(params) == 0 {
+		return nil, errors.New("empty")
+	}
+
+	infos, errs := infoMany(ctx, params)
+	items := make([]*Item, len(params))
+	for i, param := range params {
+		items[i] = newItem(param.Endpoint, param.Counter, infos[i], infos[i] != nil, errs[i])
+	}
+	return items, nil
+}
+
+// LastItems 与Last相同, 但每个endpoint/counter都返回一个Item
+func LastItems(ctx context.Context, params []cmodel.GraphLastParam) ([]*Item, error) {
+	proc.LastRequestCnt.Incr()
+
+	if len(params) == 0 {
+		return nil, errors.New("empty")
+	}
+
+	lasts, errs := lastMany(ctx, params, false)
+	items := lastItems(params, lasts, errs)
+
+	// statistics
+	proc.LastRequestItemCnt.IncrBy(int64(countOk(items)))
+	return items, nil
+}
+
+// LastRawItems 与LastRaw相同, 但每个endpoint/counter都返回一个Item
+func LastRawItems(ctx context.Context, params []cmodel.GraphLastParam) ([]*Item, error) {
+	proc.LastRawRequestCnt.Incr()
+
+	if len(params) == 0 {
+		return nil, errors.New("empty")
+	}
+
+	lasts, errs := lastMany(ctx, params, true)
+	items := lastItems(params, lasts, errs)
+
+	// statistics
+	proc.LastRawRequestItemCnt.IncrBy(int64(countOk(items)))
+	return items, nil
+}
+
+func lastItems(params []cmodel.GraphLastParam, lasts []*cmodel.GraphLastResp, errs []error) []*Item {
+	items := make([]*Item, len(params))
+	for i, param := range params {
+		found := lasts[i] != nil && lasts[i].Value != nil
+		items[i] = newItem(param.Endpoint, param.Counter, lasts[i], found, errs[i])
+	}
+	return items
+}
+
+func countOk(items []*Item) int {
+	n := 0
+	for _, item := range items {
+		if item.Status == graph.StatusOk {
+			n++
+		}
+	}
+	return n
+}
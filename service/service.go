@@ -0,0 +1,204 @@
+// Package service 是query的查询服务层, http接口(/graph/*、/api/*、grafana)都通过它查询graph;
+// 其他服务也可以把query作为库嵌入, 直接调用本包的函数:
+//
+//	g.ParseConfig("cfg.json")
+//	graph.Start()
+//	data, err := service.History(context.Background(), &service.HistoryParam{...})
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/aggregate"
+	"github.com/jianvhen/query/dashboard"
+	"github.com/jianvhen/query/model"
+	"github.com/jianvhen/query/proc"
+)
+
+// HistoryParam History的参数, 定义在model包中, 与client共用
+type HistoryParam = model.HistoryParam
+
+// History 展开endpoint/counter中的模式, 查询历史数据, 并按param.Aggregate聚合;
+// 单个endpoint/counter查询失败时只记录日志, 不在结果中返回
+func History(ctx context.Context, param *HistoryParam) ([]*cmodel.GraphQueryResponse, error) {
+	proc.HistoryRequestCnt.Incr()
+
+	if len(param.EndpointCounters) == 0 {
+		return nil, errors.New("empty_payload")
+	}
+
+	if param.Aggregate != nil {
+		if err := aggregate.Check(param.Aggregate); err != nil {
+			return nil, err
+		}
+	}
+
+	// endpoint/counter 中的通配符、正则, 通过dashboard展开
+	ecs, err := Expand(ctx, param.EndpointCounters)
+	if err != nil {
+		return nil, err
+	}
+
+	results, errs, err := queryManyLimited(ctx, int64(param.Start), int64(param.End), param.CF, ecs)
+	if err != nil {
+		return nil, err
+	}
+	data := dropFailed(results, errs)
+	if param.Aggregate != nil {
+		return aggregate.Aggregate(param.Aggregate, param.CF, data, int64(param.Start), int64(param.End))
+	}
+	return data, nil
+}
+
+// Expand 通过dashboard的索引展开endpoint/counter中的通配符、正则, 去掉展开得到的、ctx中的调用方不能读取的endpoint
+func Expand(ctx context.Context, ecs []cmodel.GraphInfoParam) ([]cmodel.GraphInfoParam, error) {
+	expanded, err := dashboard.Expand(ctx, ecs)
+	if err != nil {
+		return nil, err
+	}
+	return filterExpanded(ctx, ecs, expanded), nil
+}
+
+// Query 批量查询确定的endpoint/counter在[start, end]之间的历史数据, 不展开模式
+func Query(ctx context.Context, start, end int64, cf string, ecs []cmodel.GraphInfoParam) []*cmodel.GraphQueryResponse {
+	results, errs := queryMany(ctx, start, end, cf, ecs)
+	return dropFailed(results, errs)
+}
+
+// dropFailed 去掉查询失败或没有结果的曲线, 失败的只记录日志
+func dropFailed(results []*cmodel.GraphQueryResponse, errs []error) []*cmodel.GraphQueryResponse {
+	data := []*cmodel.GraphQueryResponse{}
+	for i, result := range results {
+		if errs[i] != nil {
+			log.Printf("graph.queryOne fail, %v", errs[i])
+		}
+		if result == nil {
+			continue
+		}
+		data = append(data, result)
+	}
+
+	return data
+}
+
+func queryMany(ctx context.Context, start, end int64, cf string, ecs []cmodel.GraphInfoParam) ([]*cmodel.GraphQueryResponse, []error) {
+	results, errs := queryManyAuthorized(ctx, historyRequests(start, end, cf, ecs))
+
+	// statistics
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		proc.HistoryResponseCounterCnt.Incr()
+		proc.HistoryResponseItemCnt.IncrBy(int64(len(result.Values)))
+	}
+	return results, errs
+}
+
+func historyRequests(start, end int64, cf string, ecs []cmodel.GraphInfoParam) []cmodel.GraphQueryParam {
+	requests := make([]cmodel.GraphQueryParam, 0, len(ecs))
+	for _, ec := range ecs {
+		requests = append(requests, cmodel.GraphQueryParam{
+			Start:     start,
+			End:       end,
+			ConsolFun: cf,
+			Endpoint:  ec.Endpoint,
+			Counter:   ec.Counter,
+		})
+	}
+	return requests
+}
+
+// Info 批量查询counter的rrd文件信息
+func Info(ctx context.Context, params []cmodel.GraphInfoParam) ([]*cmodel.GraphFullyInfo, error) {
+	proc.InfoRequestCnt.Incr()
+
+	if len(params) == 0 {
+		return nil, errors.New("empty")
+	}
+
+	data := []*cmodel.GraphFullyInfo{}
+	infos, errs := infoMany(ctx, params)
+	for i, info := range infos {
+		if errs[i] != nil {
+			log.Printf("graph.info fail, resp: %v, err: %v", info, errs[i])
+		}
+		if info == nil {
+			continue
+		}
+		data = append(data, info)
+	}
+	return data, nil
+}
+
+// Last 批量查询counter的最新值
+func Last(ctx context.Context, params []cmodel.GraphLastParam) ([]*cmodel.GraphLastResp, error) {
+	proc.LastRequestCnt.Incr()
+
+	if len(params) == 0 {
+		return nil, errors.New("empty")
+	}
+
+	data := []*cmodel.GraphLastResp{}
+	lasts, errs := lastMany(ctx, params, false)
+	for i, last := range lasts {
+		if errs[i] != nil {
+			log.Printf("graph.last fail, resp: %v, err: %v", last, errs[i])
+		}
+		if last == nil {
+			continue
+		}
+		data = append(data, last)
+	}
+
+	// statistics
+	proc.LastRequestItemCnt.IncrBy(int64(len(data)))
+	return data, nil
+}
+
+// LastRaw 批量查询counter最新的原始值
+func LastRaw(ctx context.Context, params []cmodel.GraphLastParam) ([]*cmodel.GraphLastResp, error) {
+	proc.LastRawRequestCnt.Incr()
+
+	if len(params) == 0 {
+		return nil, errors.New("empty")
+	}
+
+	data := []*cmodel.GraphLastResp{}
+	lasts, errs := lastMany(ctx, params, true)
+	for i, last := range lasts {
+		if errs[i] != nil {
+			log.Printf("graph.last.raw fail, resp: %v, err: %v", last, errs[i])
+		}
+		if last == nil {
+			continue
+		}
+		data = append(data, last)
+	}
+
+	// statistics
+	proc.LastRawRequestItemCnt.IncrBy(int64(len(data)))
+	return data, nil
+}
+
+// Endpoints 按正则表达式查询endpoint, 最多返回limit个; 只返回ctx中的调用方能读取的endpoint
+func Endpoints(ctx context.Context, regex string, limit int) ([]string, error) {
+	endpoints, err := dashboard.Endpoints(ctx, regex, limit)
+	if err != nil {
+		return nil, err
+	}
+	return allowedEndpoints(ctx, endpoints), nil
+}
+
+// Counters 查询endpoints上包含关键字q的counter, 最多返回limit个; ctx中的调用方不能读取的endpoint被忽略
+func Counters(ctx context.Context, endpoints []string, q string, limit int) ([]string, error) {
+	endpoints = allowedEndpoints(ctx, endpoints)
+	if len(endpoints) == 0 {
+		return []string{}, nil
+	}
+	return dashboard.Counters(ctx, endpoints, q, limit)
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/graph"
+)
+
+const (
+	StaleFresh = "fresh"
+	StaleStale = "stale"
+)
+
+// StaleParam 数据新鲜度检查的参数
+// endpoint_counters: endpoint/counter均支持通配符或/正则/, 通过dashboard展开
+// max_age: 最新值距今超过max_age秒则认为曲线已经停止上报
+// stale_only: 只返回不新鲜(stale及查询失败)的曲线, 统计数字不受影响
+type StaleParam struct {
+	EndpointCounters []cmodel.GraphInfoParam `json:"endpoint_counters"`
+	MaxAge           int                     `json:"max_age"`
+	StaleOnly        bool                    `json:"stale_only"`
+}
+
+// StaleReport 按graph节点分组的新鲜度报告, 节点按stale的曲线数从多到少排列
+type StaleReport struct {
+	Total  int          `json:"total"`
+	Stale  int          `json:"stale"`
+	Errors int          `json:"errors"`
+	Nodes  []*StaleNode `json:"nodes"`
+}
+
+// StaleNode 单个graph节点上的曲线; 只有部分节点的stale比例很高时, 通常是该节点或写入该节点的链路有问题
+type StaleNode struct {
+	Addr   string       `json:"addr"`
+	Total  int          `json:"total"`
+	Stale  int          `json:"stale"`
+	Errors int          `json:"errors"`
+	Items  []*StaleItem `json:"items"`
+}
+
+// StaleItem 单条曲线的新鲜度
+// status: fresh、stale, 查询失败时为timeout、backend_error或circuit_open
+// last_seen/value为最新的数据点, age为last_seen距今的秒数, stale_for为超过max_age的秒数; 没有数据时last_seen、age为-1
+type StaleItem struct {
+	Endpoint string            `json:"endpoint"`
+	Counter  string            `json:"counter"`
+	Status   string            `json:"status"`
+	LastSeen int64             `json:"last_seen"`
+	Age      int64             `json:"age"`
+	StaleFor int64             `json:"stale_for"`
+	Value    *cmodel.JsonFloat `json:"value"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// Stale 批量查询曲线的最新值, 报告哪些曲线已经停止上报
+func Stale(ctx context.Context, param *StaleParam) (*StaleReport, error) {
+	if len(param.EndpointCounters) == 0 {
+		return nil, errors.New("empty_payload")
+	}
+	if param.MaxAge <= 0 {
+		return nil, errors.New("invalid max_age")
+	}
+
+	ecs, err := Expand(ctx, param.EndpointCounters)
+	if err != nil {
+		return nil, err
+	}
+
+	params := make([]cmodel.GraphLastParam, 0, len(ecs))
+	for _, ec := range ecs {
+		params = append(params, cmodel.GraphLastParam{Endpoint: ec.Endpoint, Counter: ec.Counter})
+	}
+	lasts, errs := lastMany(ctx, params, false)
+
+	now := time.Now().Unix()
+	report := &StaleReport{Nodes: []*StaleNode{}}
+	nodes := make(map[string]*StaleNode)
+	for i, para := range params {
+		item := &StaleItem{Endpoint: para.Endpoint, Counter: para.Counter, LastSeen: -1, Age: -1}
+
+		status, addr := errorStatus(errs[i])
+		if addr == "" {
+			addr, _ = graph.Addr(para.Endpoint, para.Counter)
+		}
+		if errs[i] != nil {
+			item.Status = status
+			item.Error = errs[i].Error()
+		} else {
+			item.Status = StaleStale
+			if lasts[i] != nil && lasts[i].Value != nil && lasts[i].Value.Timestamp > 0 {
+				value := lasts[i].Value.Value
+				item.Value = &value
+				item.LastSeen = lasts[i].Value.Timestamp
+				item.Age = now - item.LastSeen
+				if item.Age <= int64(param.MaxAge) {
+					item.Status = StaleFresh
+				} else {
+					item.StaleFor = item.Age - int64(param.MaxAge)
+				}
+			}
+		}
+
+		node, ok := nodes[addr]
+		if !ok {
+			node = &StaleNode{Addr: addr, Items: []*StaleItem{}}
+			nodes[addr] = node
+			report.Nodes = append(report.Nodes, node)
+		}
+		node.Total++
+		report.Total++
+		switch item.Status {
+		case StaleFresh:
+			if param.StaleOnly {
+				continue
+			}
+		case StaleStale:
+			node.Stale++
+			report.Stale++
+		default:
+			node.Errors++
+			report.Errors++
+		}
+		node.Items = append(node.Items, item)
+	}
+
+	sort.Slice(report.Nodes, func(i, j int) bool {
+		if report.Nodes[i].Stale != report.Nodes[j].Stale {
+			return report.Nodes[i].Stale > report.Nodes[j].Stale
+		}
+		return report.Nodes[i].Addr < report.Nodes[j].Addr
+	})
+	return report, nil
+}
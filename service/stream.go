@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/g"
+	"github.com/jianvhen/query/graph"
+	"github.com/jianvhen/query/proc"
+)
+
+// TooManyPointsError 单个历史数据查询的数据点超过了graph.maxStreamPoints
+type TooManyPointsError struct {
+	Limit int64
+}
+
+func (this *TooManyPointsError) Error() string {
+	return fmt.Sprintf("too many points, limit %d per request; narrow the time range or split the endpoint_counters", this.Limit)
+}
+
+// HistoryStream 与History相同, 但每条曲线的rpc返回时立即调用fn输出, 不在内存中保留已经输出的曲线;
+// 曲线的顺序与请求无关, 查询失败的曲线只记录日志; 不支持聚合参数.
+// 累计的数据点超过graph.maxStreamPoints时停止查询, 返回*TooManyPointsError, 超出的曲线不会交给fn
+func HistoryStream(ctx context.Context, param *HistoryParam, fn func(resp *cmodel.GraphQueryResponse) error) error {
+	proc.HistoryRequestCnt.Incr()
+
+	if len(param.EndpointCounters) == 0 {
+		return errors.New("empty_payload")
+	}
+	if param.Aggregate != nil {
+		return errors.New("aggregate is not supported in stream mode")
+	}
+
+	ecs, err := Expand(ctx, param.EndpointCounters)
+	if err != nil {
+		return err
+	}
+
+	// 调用方不能读取的endpoint与查询失败的曲线一样只记录日志
+	allowed, errs := authorize(ctx, len(ecs), func(i int) string { return ecs[i].Endpoint })
+	for _, err := range errs {
+		if err != nil {
+			log.Printf("graph.queryOne fail, %v", err)
+		}
+	}
+	requests := make([]cmodel.GraphQueryParam, 0, len(allowed))
+	for _, i := range allowed {
+		ec := ecs[i]
+		requests = append(requests, cmodel.GraphQueryParam{
+			Start:     int64(param.Start),
+			End:       int64(param.End),
+			ConsolFun: param.CF,
+			Endpoint:  ec.Endpoint,
+			Counter:   ec.Counter,
+		})
+	}
+
+	limit := g.Config().Graph.MaxStreamPoints
+	var points int64
+	return graph.QueryStreamPlanned(ctx, requests, func(i int, resp *cmodel.GraphQueryResponse, err error) error {
+		if err != nil {
+			log.Printf("graph.queryOne fail, %v", err)
+			return nil
+		}
+		if resp == nil {
+			return nil
+		}
+
+		points += int64(len(resp.Values))
+		if limit > 0 && points > limit {
+			return &TooManyPointsError{Limit: limit}
+		}
+
+		// statistics
+		proc.HistoryResponseCounterCnt.Incr()
+		proc.HistoryResponseItemCnt.IncrBy(int64(len(resp.Values)))
+		return fn(resp)
+	})
+}
+
+// queryManyLimited 与queryMany相同, 但在每条曲线返回时累计数据点, 超过graph.maxStreamPoints时立即停止查询并返回*TooManyPointsError,
+// 不必等全部曲线返回、保存在内存中之后才发现超过上限
+func queryManyLimited(ctx context.Context, start, end int64, cf string, ecs []cmodel.GraphInfoParam) ([]*cmodel.GraphQueryResponse, []error, error) {
+	limit := g.Config().Graph.MaxStreamPoints
+	if limit <= 0 {
+		results, errs := queryMany(ctx, start, end, cf, ecs)
+		return results, errs, nil
+	}
+
+	requests := historyRequests(start, end, cf, ecs)
+	allowed, errs := authorize(ctx, len(requests), func(i int) string { return requests[i].Endpoint })
+	sub := make([]cmodel.GraphQueryParam, len(allowed))
+	for k, i := range allowed {
+		sub[k] = requests[i]
+	}
+
+	results := make([]*cmodel.GraphQueryResponse, len(requests))
+	delivered := make([]bool, len(allowed))
+	var points int64
+	err := graph.QueryStreamPlanned(ctx, sub, func(k int, resp *cmodel.GraphQueryResponse, err error) error {
+		i := allowed[k]
+		results[i], errs[i], delivered[k] = resp, err, true
+		if resp == nil {
+			return nil
+		}
+
+		points += int64(len(resp.Values))
+		if points > limit {
+			return &TooManyPointsError{Limit: limit}
+		}
+
+		// statistics
+		proc.HistoryResponseCounterCnt.Incr()
+		proc.HistoryResponseItemCnt.IncrBy(int64(len(resp.Values)))
+		return nil
+	})
+	if tooMany, ok := err.(*TooManyPointsError); ok {
+		return nil, nil, tooMany
+	}
+	// 请求被取消或超时时, 没有返回的曲线与queryMany一样以该错误作为结果
+	if err != nil {
+		for k, i := range allowed {
+			if !delivered[k] {
+				errs[i] = err
+			}
+		}
+	}
+	return results, errs, nil
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	cmodel "github.com/open-falcon/common/model"
+
+	"github.com/jianvhen/query/aggregate"
+)
+
+const defaultTopN = 10
+
+// TopNParam 按counter的值对endpoint排序的参数
+// endpoints: 支持通配符或/正则/, 通过dashboard展开; counter也支持模式, 此时每个endpoint/counter单独排名
+// reducer: last(默认, 最新值, 不需要window), 或对最近window秒的历史数据做归约: avg, max, min, sum, pNN(如p95)
+// direction: desc(默认, 从大到小)或asc; n: 返回的个数, 默认10
+type TopNParam struct {
+	Endpoints []string `json:"endpoints"`
+	Counter   string   `json:"counter"`
+	Window    int      `json:"window"`
+	CF        string   `json:"cf"`
+	Reducer   string   `json:"reducer"`
+	N         int      `json:"n"`
+	Direction string   `json:"direction"`
+}
+
+type TopNItem struct {
+	Rank     int              `json:"rank"`
+	Endpoint string           `json:"endpoint"`
+	Counter  string           `json:"counter"`
+	Value    cmodel.JsonFloat `json:"value"`
+}
+
+func (this *TopNParam) Check() error {
+	if len(this.Endpoints) == 0 || this.Counter == "" {
+		return errors.New("empty endpoints or counter")
+	}
+	if this.Reducer != "" && this.Reducer != "last" {
+		if _, err := aggregate.Reducer(this.Reducer); err != nil {
+			return err
+		}
+		if this.Window <= 0 {
+			return errors.New("invalid window")
+		}
+	}
+	if this.N < 0 {
+		return errors.New("invalid n")
+	}
+	switch this.Direction {
+	case "", "desc", "asc":
+	default:
+		return fmt.Errorf("invalid direction: %s", this.Direction)
+	}
+	return nil
+}
+
+// TopN 查询每个endpoint上counter的值并排序, 返回前n个; 没有数据或查询失败的endpoint不参与排名
+func TopN(ctx context.Context, param *TopNParam) ([]*TopNItem, error) {
+	if err := param.Check(); err != nil {
+		return nil, err
+	}
+
+	ecs := make([]cmodel.GraphInfoParam, 0, len(param.Endpoints))
+	for _, endpoint := range param.Endpoints {
+		ecs = append(ecs, cmodel.GraphInfoParam{Endpoint: endpoint, Counter: param.Counter})
+	}
+	ecs, err := Expand(ctx, ecs)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []float64
+	if param.Reducer == "" || param.Reducer == "last" {
+		values = lastValues(ctx, ecs)
+	} else {
+		values = reducedValues(ctx, ecs, param)
+	}
+
+	items := make([]*TopNItem, 0, len(ecs))
+	for i, ec := range ecs {
+		if math.IsNaN(values[i]) {
+			continue
+		}
+		items = append(items, &TopNItem{Endpoint: ec.Endpoint, Counter: ec.Counter, Value: cmodel.JsonFloat(values[i])})
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if param.Direction == "asc" {
+			return items[i].Value < items[j].Value
+		}
+		return items[i].Value > items[j].Value
+	})
+
+	n := param.N
+	if n == 0 {
+		n = defaultTopN
+	}
+	if n < len(items) {
+		items = items[:n]
+	}
+	for i, item := range items {
+		item.Rank = i + 1
+	}
+	return items, nil
+}
+
+// lastValues 返回每个endpoint/counter的最新值, 没有数据或查询失败时为NaN
+func lastValues(ctx context.Context, ecs []cmodel.GraphInfoParam) []float64 {
+	params := make([]cmodel.GraphLastParam, 0, len(ecs))
+	for _, ec := range ecs {
+		params = append(params, cmodel.GraphLastParam{Endpoint: ec.Endpoint, Counter: ec.Counter})
+	}
+
+	ret := make([]float64, len(params))
+	lasts, errs := lastMany(ctx, params, false)
+	for i, last := range lasts {
+		ret[i] = math.NaN()
+		if errs[i] != nil {
+			log.Printf("graph.last fail, resp: %v, err: %v", last, errs[i])
+			continue
+		}
+		if last != nil && last.Value != nil && last.Value.Timestamp > 0 {
+			ret[i] = float64(last.Value.Value)
+		}
+	}
+	return ret
+}
+
+// reducedValues 返回每个endpoint/counter最近window秒的历史数据按reducer归约后的值
+func reducedValues(ctx context.Context, ecs []cmodel.GraphInfoParam, param *TopNParam) []float64 {
+	reduce, _ := aggregate.Reducer(param.Reducer)
+	cf := param.CF
+	if cf == "" {
+		cf = "AVERAGE"
+	}
+
+	end := time.Now().Unix()
+	ret := make([]float64, len(ecs))
+	results, errs := queryMany(ctx, end-int64(param.Window), end, cf, ecs)
+	for i, result := range results {
+		ret[i] = math.NaN()
+		if errs[i] != nil {
+			log.Printf("graph.queryOne fail, %v", errs[i])
+		}
+		if result == nil {
+			continue
+		}
+		values := make([]float64, 0, len(result.Values))
+		for _, v := range result.Values {
+			values = append(values, float64(v.Value))
+		}
+		ret[i] = reduce(values)
+	}
+	return ret
+}